@@ -0,0 +1,465 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aggregateSpec describes an aggregation over a numeric payload field
+type aggregateSpec struct {
+	Function   string    `json:"function"`   // count, sum, mean, min, max, first, last, p50, p90, p95, p99, percentile or histogram
+	Field      string    `json:"field"`      // Dotted JSON path, empty for the whole payload
+	Interval   string    `json:"interval"`   // Bucket width such as "1m", empty for one bucket
+	Fill       string    `json:"fill"`       // Empty bucket handling: none, null, previous, linear or a number
+	Percentile float64   `json:"percentile"` // Percentile (0-100) of the percentile function
+	Buckets    []float64 `json:"buckets"`    // Ascending boundaries of the histogram function
+	NoRollup   bool      `json:"no_rollup"`  // Always read raw points, even when a rollup could answer
+}
+
+var aggregateFunctions = map[string]bool{
+	"count":      true,
+	"sum":        true,
+	"mean":       true,
+	"min":        true,
+	"max":        true,
+	"first":      true,
+	"last":       true,
+	"p50":        true,
+	"p90":        true,
+	"p95":        true,
+	"p99":        true,
+	"percentile": true,
+	"histogram":  true,
+}
+
+// quantile returns the fraction (0 to 1) computed by a percentile function, or false
+func (spec aggregateSpec) quantile() (float64, bool) {
+	switch spec.Function {
+	case "p50":
+		return 0.50, true
+	case "p90":
+		return 0.90, true
+	case "p95":
+		return 0.95, true
+	case "p99":
+		return 0.99, true
+	case "percentile":
+		return spec.Percentile / 100, true
+	}
+	return 0, false
+}
+
+// aggregateState accumulates the values that fall into one bucket
+type aggregateState struct {
+	Count     int64
+	Sum       float64
+	Min       float64
+	Max       float64
+	First     float64
+	Last      float64
+	Sketch    *ddSketch // Percentile functions only
+	Histogram []uint64  // Histogram function only
+}
+
+func newAggregateState(spec aggregateSpec) *aggregateState {
+	state := &aggregateState{}
+	if _, ok := spec.quantile(); ok {
+		state.Sketch = newSketch()
+	}
+	if spec.Function == "histogram" {
+		state.Histogram = make([]uint64, len(spec.Buckets)+1)
+	}
+	return state
+}
+
+func (s *aggregateState) add(value float64, buckets []float64) {
+	if s.Count == 0 {
+		s.Min, s.Max, s.First = value, value, value
+	}
+	s.Count++
+	s.Sum += value
+	s.Min = math.Min(s.Min, value)
+	s.Max = math.Max(s.Max, value)
+	s.Last = value
+
+	if s.Sketch != nil {
+		s.Sketch.add(value)
+	}
+	if s.Histogram != nil {
+		// Bucket i counts values below buckets[i] and at or above buckets[i-1]
+		s.Histogram[sort.SearchFloat64s(buckets, math.Nextafter(value, math.Inf(1)))]++
+	}
+}
+
+func (s *aggregateState) result(spec aggregateSpec) interface{} {
+	if q, ok := spec.quantile(); ok {
+		return s.Sketch.quantile(q)
+	}
+
+	switch spec.Function {
+	case "count":
+		return float64(s.Count)
+	case "sum":
+		return s.Sum
+	case "mean":
+		return s.Sum / float64(s.Count)
+	case "min":
+		return s.Min
+	case "max":
+		return s.Max
+	case "first":
+		return s.First
+	case "histogram":
+		return map[string]interface{}{"buckets": spec.Buckets, "counts": s.Histogram}
+	default:
+		return s.Last
+	}
+}
+
+// parseInterval converts a duration like "500ms", "1m", "6h", "1d" or "1w" to ticks of a precision
+func parseInterval(value, precision string) (int64, error) {
+	multiplier := int64(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		multiplier = int64(24 * time.Hour)
+	case strings.HasSuffix(value, "w"):
+		multiplier = int64(7 * 24 * time.Hour)
+	}
+
+	nanoseconds := int64(0)
+	if multiplier > 0 {
+		n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid interval '%s'", value)
+		}
+		nanoseconds = n * multiplier
+	} else {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return 0, fmt.Errorf("invalid interval '%s'", value)
+		}
+		nanoseconds = duration.Nanoseconds()
+	}
+
+	unit := precisionUnit(precision)
+	if nanoseconds%unit != 0 {
+		return 0, fmt.Errorf("interval '%s' is not a whole number of %s", value, precision)
+	}
+	return nanoseconds / unit, nil
+}
+
+// numericValue extracts a number from a decoded payload
+func numericValue(data interface{}, path []string) (float64, bool) {
+	value, ok := lookupPath(data, path)
+	if !ok {
+		return 0, false
+	}
+	number, ok := value.(float64)
+	return number, ok
+}
+
+// aggregateValue extracts the value a function aggregates; count accepts any present value
+func aggregateValue(function string, data interface{}, path []string) (float64, bool) {
+	if function == "count" {
+		_, ok := lookupPath(data, path)
+		return 1, ok
+	}
+	return numericValue(data, path)
+}
+
+// bucketStart aligns a timestamp to the start of its interval bucket
+func bucketStart(ts, interval int64) int64 {
+	if interval <= 0 {
+		return 0
+	}
+	bucket := ts - ts%interval
+	if ts < 0 && ts%interval != 0 {
+		bucket -= interval
+	}
+	return bucket
+}
+
+// aggregator groups values into interval buckets aligned to the epoch
+type aggregator struct {
+	spec     aggregateSpec
+	start    int64
+	interval int64
+	buckets  []int64
+	states   map[int64]*aggregateState
+}
+
+func newAggregator(spec aggregateSpec, start, interval int64) *aggregator {
+	return &aggregator{spec: spec, start: start, interval: interval, states: map[int64]*aggregateState{}}
+}
+
+// state returns the state of the bucket holding a timestamp
+func (a *aggregator) state(ts int64) *aggregateState {
+	bucket := a.start
+	if a.interval > 0 {
+		bucket = bucketStart(ts, a.interval)
+	}
+
+	state, exists := a.states[bucket]
+	if !exists {
+		state = newAggregateState(a.spec)
+		a.states[bucket] = state
+		a.buckets = append(a.buckets, bucket) // Points arrive in time order
+	}
+	return state
+}
+
+func (a *aggregator) add(ts int64, value float64) {
+	a.state(ts).add(value, a.spec.Buckets)
+}
+
+// addSketch merges a stored segment sketch into the bucket holding ts
+func (a *aggregator) addSketch(ts int64, sketch *ddSketch) {
+	if sketch.Count == 0 {
+		return
+	}
+	state := a.state(ts)
+	state.Count += int64(sketch.Count)
+	state.Sketch.merge(sketch)
+}
+
+// series returns one point per non-empty bucket
+func (a *aggregator) series() []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, bucket := range a.buckets {
+		result = append(result, map[string]interface{}{
+			"time": bucket,
+			"data": a.states[bucket].result(a.spec),
+		})
+	}
+	return result
+}
+
+// maxFillBuckets bounds the number of buckets a fill may generate
+const maxFillBuckets = 1000000
+
+// validateFill checks a fill mode: none, null, previous, linear or a numeric constant
+func validateFill(fill string) error {
+	switch fill {
+	case "", "none", "null", "previous", "linear":
+		return nil
+	}
+	if _, err := strconv.ParseFloat(fill, 64); err != nil {
+		return fmt.Errorf("invalid fill '%s'", fill)
+	}
+	return nil
+}
+
+// fillBuckets adds the empty buckets between start and end according to the fill mode
+func fillBuckets(series []map[string]interface{}, start, end, interval int64, fill string) ([]map[string]interface{}, error) {
+	if fill == "" || fill == "none" || interval <= 0 {
+		return series, nil
+	}
+
+	first := bucketStart(start, interval)
+	if (end-first)/interval >= maxFillBuckets {
+		return nil, fmt.Errorf("fill would generate more than %d buckets", maxFillBuckets)
+	}
+
+	values := map[int64]interface{}{}
+	for _, point := range series {
+		values[point["time"].(int64)] = point["data"]
+	}
+
+	constant, _ := strconv.ParseFloat(fill, 64)
+
+	result := []map[string]interface{}{}
+	var previous interface{}
+	for bucket := first; bucket <= end; bucket += interval {
+		value, exists := values[bucket]
+		if !exists {
+			switch fill {
+			case "null":
+				value = nil
+			case "previous":
+				value = previous
+			case "linear":
+				value = nil // Interpolated once both neighbours are known
+			default:
+				value = constant
+			}
+		}
+
+		previous = value
+		result = append(result, map[string]interface{}{"time": bucket, "data": value})
+	}
+
+	if fill == "linear" {
+		interpolate(result)
+	}
+	return result, nil
+}
+
+// interpolate replaces null values lying between two numbers with a linear interpolation.
+// Leading and trailing nulls have only one neighbour and are kept.
+func interpolate(series []map[string]interface{}) {
+	last := -1
+	for i, point := range series {
+		value, ok := point["data"].(float64)
+		if !ok {
+			continue
+		}
+
+		if last >= 0 && i-last > 1 {
+			from := series[last]["data"].(float64)
+			fromTime := series[last]["time"].(int64)
+			toTime := point["time"].(int64)
+			for j := last + 1; j < i; j++ {
+				ratio := float64(series[j]["time"].(int64)-fromTime) / float64(toTime-fromTime)
+				series[j]["data"] = from + (value-from)*ratio
+			}
+		}
+		last = i
+	}
+}
+
+// validateAggregate checks an aggregation before any data is read
+func validateAggregate(spec aggregateSpec, precision string, start, end int64) error {
+	if !aggregateFunctions[spec.Function] {
+		return fmt.Errorf("unknown aggregate function '%s'", spec.Function)
+	}
+
+	if spec.Function == "percentile" && (spec.Percentile < 0 || spec.Percentile > 100) {
+		return fmt.Errorf("percentile must be between 0 and 100")
+	}
+
+	if spec.Function == "histogram" {
+		if len(spec.Buckets) == 0 {
+			return fmt.Errorf("histogram requires bucket boundaries")
+		}
+		if !sort.Float64sAreSorted(spec.Buckets) {
+			return fmt.Errorf("histogram bucket boundaries must be ascending")
+		}
+	}
+
+	if err := validateFill(spec.Fill); err != nil {
+		return err
+	}
+
+	if spec.Interval == "" {
+		if spec.Fill != "" && spec.Fill != "none" {
+			return fmt.Errorf("fill requires an interval")
+		}
+		return nil
+	}
+
+	interval, err := parseInterval(spec.Interval, precision)
+	if err != nil {
+		return err
+	}
+	if spec.Fill != "" && spec.Fill != "none" && (end-bucketStart(start, interval))/interval >= maxFillBuckets {
+		return fmt.Errorf("fill over this time range would generate more than %d buckets", maxFillBuckets)
+	}
+	return nil
+}
+
+// aggregateRange groups the numeric values of a collection into interval buckets
+func aggregateRange(collectionDir string, start, end int64, spec aggregateSpec) ([]map[string]interface{}, error) {
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAggregate(spec, manifest.Precision, start, end); err != nil {
+		return nil, err
+	}
+
+	// Coarse aggregations are answered from a rollup when one matches. Only its buckets lying
+	// entirely in the range are used, the edges are read from the raw points.
+	if target, rollup, ok := findRollup(filepath.Base(collectionDir), spec); ok {
+		interval, _ := parseInterval(spec.Interval, manifest.Precision)
+		rollupInterval, _ := parseInterval(rollup.Interval, manifest.Precision)
+		from := bucketStart(start+rollupInterval-1, rollupInterval) // Start of the first whole bucket
+		to := bucketStart(end+1, rollupInterval) - 1                // End of the last whole bucket
+		if from < to {
+			return aggregateRollup(collectionDir, target, spec, start, end, from, to, interval)
+		}
+	}
+
+	list, err := findSeries(collectionDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateSeries(list, manifest.Precision, start, end, spec)
+}
+
+// aggregateSeries groups the numeric values of several series into interval buckets
+func aggregateSeries(list []seriesInfo, precision string, start, end int64, spec aggregateSpec) ([]map[string]interface{}, error) {
+	if err := validateAggregate(spec, precision, start, end); err != nil {
+		return nil, err
+	}
+
+	interval := int64(0)
+	if spec.Interval != "" {
+		interval, _ = parseInterval(spec.Interval, precision)
+	}
+
+	path := []string{}
+	if spec.Field != "" {
+		path = strings.Split(spec.Field, ".")
+	}
+
+	agg := newAggregator(spec, start, interval)
+
+	// Other functions depend on the order of the points, so the series are merged by time
+	if _, usesSketch := spec.quantile(); !usesSketch {
+		err := scanSeries(list, start, end, func(_ seriesInfo, point dataPoint) error {
+			if value, ok := aggregateValue(spec.Function, decodeData(point.Data), path); ok {
+				agg.add(point.Time, value)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return fillBuckets(agg.series(), start, end, interval, spec.Fill)
+	}
+
+	// Buckets are added in time order, so the series are taken one segment at a time
+	segments, err := seriesSegments(list, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range segments {
+		points := []dataPoint{}
+		for _, file := range group {
+			// Percentiles read the stored sketch of segments that fit in one bucket
+			if segmentStart, segmentEnd, ok := segmentBounds(file.filePath, precision); ok &&
+				segmentStart >= start && segmentEnd <= end &&
+				(interval == 0 || bucketStart(segmentStart, interval) == bucketStart(segmentEnd, interval)) {
+				if sketch := storedSketch(file.filePath, spec.Field); sketch != nil {
+					agg.addSketch(segmentStart, sketch)
+					continue
+				}
+			}
+
+			segmentPoints, err := readSegment(file.filePath, start, end)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, expandPoints(segmentPoints)...)
+		}
+
+		if len(group) > 1 {
+			sort.SliceStable(points, func(i, j int) bool {
+				return points[i].Time < points[j].Time
+			})
+		}
+		for _, point := range points {
+			if value, ok := aggregateValue(spec.Function, decodeData(point.Data), path); ok {
+				agg.add(point.Time, value)
+			}
+		}
+	}
+
+	return fillBuckets(agg.series(), start, end, interval, spec.Fill)
+}
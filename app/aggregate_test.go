@@ -0,0 +1,80 @@
+package app
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAggregateSeriesPercentileOrder(t *testing.T) {
+	day := time.Date(2023, 11, 14, 0, 0, 0, 0, time.Local).Unix()
+	hour := int64(3600)
+
+	type bucket struct {
+		time  int64
+		value float64
+	}
+
+	tests := []struct {
+		name     string
+		interval string
+		a        map[int64]interface{}
+		b        map[int64]interface{}
+		evict    bool // Drop the saved segments from memory, so whole segments are read from sketches
+		want     []bucket
+	}{
+		{
+			name:     "buckets within a segment",
+			interval: "1m",
+			a:        map[int64]interface{}{day + 60: 1, day + 120: 2},
+			b:        map[int64]interface{}{day: 3, day + 180: 4},
+			want:     []bucket{{day, 3}, {day + 60, 1}, {day + 120, 2}, {day + 180, 4}},
+		},
+		{
+			name:     "buckets across segments",
+			interval: "6h",
+			a:        map[int64]interface{}{day + 7*hour: 10},
+			b:        map[int64]interface{}{day + hour: 20, day + 8*hour: 30},
+			want:     []bucket{{day, 20}, {day + 6*hour, 10}},
+		},
+		{
+			name:     "segments read from sketches",
+			interval: "6h",
+			a:        map[int64]interface{}{day + 13*hour: 10},
+			b:        map[int64]interface{}{day + hour: 20, day + 14*hour: 30},
+			evict:    true,
+			want:     []bucket{{day, 20}, {day + 12*hour, 10}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useDataDir(t)
+			writePoints(t, "latency", "s", map[string]string{"host": "a"}, test.a)
+			writePoints(t, "latency", "s", map[string]string{"host": "b"}, test.b)
+			if test.evict {
+				saveSegments(t)
+				resetCaches()
+			}
+
+			list, err := findSeries("./data/latency", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := aggregateSeries(list, "s", day, day+24*hour-1, aggregateSpec{Function: "p50", Interval: test.interval})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(result) != len(test.want) {
+				t.Fatalf("got %v, want %v", result, test.want)
+			}
+			for i, want := range test.want {
+				value, _ := result[i]["data"].(float64)
+				if result[i]["time"] != want.time || math.Abs(value-want.value) > want.value*0.02 {
+					t.Fatalf("got %v, want %v", result, test.want)
+				}
+			}
+		})
+	}
+}
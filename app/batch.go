@@ -0,0 +1,262 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchOperation is a write to or a range delete from one collection
+type batchOperation struct {
+	Op         string            `json:"op"` // write or delete
+	Collection string            `json:"collection"`
+	Items      []ingestItem      `json:"items"` // Points to write, as in PUT /data
+	Start      json.RawMessage   `json:"start"` // Range to delete
+	End        json.RawMessage   `json:"end"`
+	Tags       map[string]string `json:"tags"` // Only delete from series carrying these tags
+}
+
+// operationErrors lists why an operation of a batch was rejected
+type operationErrors struct {
+	Operation int          `json:"operation"`
+	Error     string       `json:"error,omitempty"`
+	Items     []itemErrors `json:"items,omitempty"`
+}
+
+// plannedOperation is a validated operation, ready to be staged
+type plannedOperation struct {
+	batchOperation
+	collectionDir string
+	manifest      collectionManifest
+	prepared      []preparedPoint // Points to write
+	series        []seriesInfo    // Series to delete from
+	start, end    int64
+	times         []int64 // Times of the staged points
+}
+
+// planOperation validates an operation of a batch
+func planOperation(op batchOperation) (plannedOperation, *operationErrors, error) {
+	dataPath := "./data" // Base directory for data
+	planned := plannedOperation{batchOperation: op, collectionDir: fmt.Sprintf("%s/%s", dataPath, op.Collection)}
+
+	if op.Collection != "" && !validCollectionName(op.Collection) {
+		return planned, &operationErrors{Error: fmt.Sprintf("Invalid collection name '%s'", op.Collection)}, nil
+	}
+	if _, err := os.Stat(planned.collectionDir); op.Collection == "" || os.IsNotExist(err) {
+		return planned, &operationErrors{Error: fmt.Sprintf("Collection '%s' does not exist", op.Collection)}, nil
+	}
+
+	manifest, err := loadManifest(planned.collectionDir)
+	if err != nil {
+		return planned, nil, err
+	}
+	planned.manifest = manifest
+
+	switch op.Op {
+	case "write":
+		prepared, failures, err := preparePoints(planned.collectionDir, manifest, op.Items)
+		if err != nil {
+			return planned, nil, err
+		}
+		if len(failures) > 0 {
+			return planned, &operationErrors{Items: failures}, nil
+		}
+		planned.prepared = prepared
+
+	case "delete":
+		if planned.start, err = decodeTimestamp(op.Start, manifest.Precision); err != nil {
+			return planned, &operationErrors{Error: fmt.Sprintf("Invalid start: %v", err)}, nil
+		}
+
+		// Without an end the range runs up to now
+		end := op.End
+		if len(end) == 0 {
+			end = json.RawMessage(`"now"`)
+		}
+		if planned.end, err = decodeTimestamp(end, manifest.Precision); err != nil {
+			return planned, &operationErrors{Error: fmt.Sprintf("Invalid end: %v", err)}, nil
+		}
+		if planned.end < planned.start {
+			return planned, &operationErrors{Error: "end must not be before start"}, nil
+		}
+
+		if err := validateTags(op.Tags); err != nil {
+			return planned, &operationErrors{Error: fmt.Sprintf("Invalid tags: %v", err)}, nil
+		}
+		if planned.series, err = findSeries(planned.collectionDir, op.Tags); err != nil {
+			return planned, nil, err
+		}
+
+	default:
+		return planned, &operationErrors{Error: fmt.Sprintf("Unknown op '%s', expected 'write' or 'delete'", op.Op)}, nil
+	}
+
+	return planned, nil, nil
+}
+
+// stagePlanLocked stages the operations of a batch in order, so later ones see the effect
+// of earlier ones, and returns the write operations refused by a reject collection. The
+// caller must hold the write lock on dataMutex.
+func stagePlanLocked(plan []plannedOperation) (*segmentChanges, []operationErrors, error) {
+	changes := newSegmentChanges()
+	failures := []operationErrors{}
+	for i := range plan {
+		planned := &plan[i]
+
+		if planned.Op == "write" {
+			result := ingestResult{}
+			times, err := stagePointsLocked(changes, planned.manifest, planned.prepared, &result)
+			if err != nil {
+				return nil, nil, err
+			}
+			if result.Conflict {
+				failures = append(failures, operationErrors{Operation: i, Items: result.Failures})
+			}
+			planned.times = times
+			continue
+		}
+
+		for _, series := range planned.series {
+			files, err := segmentFilesLocked(series.Dir, series.Precision, planned.start, planned.end)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, filePath := range files {
+				if err := changes.deleteRangeLocked(filePath, planned.start, planned.end); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	return changes, failures, nil
+}
+
+// batch_data applies writes and range deletes across collections atomically. Every
+// operation is validated and staged first, then the changed segments are recorded in the
+// write-ahead log before they become visible, so after a crash the batch is either
+// completed at startup or was never applied.
+func batch_data(c *gin.Context) {
+	var request struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(request.Operations) == 0 {
+		c.JSON(400, gin.H{"error": "At least one operation is required"})
+		return
+	}
+
+	// Validate every operation before touching any data
+	plan := []plannedOperation{}
+	failures := []operationErrors{}
+	for i, op := range request.Operations {
+		planned, failure, err := planOperation(op)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if failure != nil {
+			failure.Operation = i
+			failures = append(failures, *failure)
+			continue
+		}
+		plan = append(plan, planned)
+	}
+	if len(failures) > 0 {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("%d operation(s) were rejected, nothing was applied", len(failures)), "operations": failures})
+		return
+	}
+
+	// Look for conflicts before any series is registered, so a rejected batch leaves nothing behind
+	for _, planned := range plan {
+		locatePoints(planned.collectionDir, planned.prepared)
+	}
+	dataMutex.Lock()
+	_, failures, err := stagePlanLocked(plan)
+	dataMutex.Unlock()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if len(failures) > 0 {
+		c.JSON(409, gin.H{"error": fmt.Sprintf("%d operation(s) were rejected, nothing was applied", len(failures)), "operations": failures})
+		return
+	}
+
+	for _, planned := range plan {
+		if err := registerPoints(planned.collectionDir, planned.manifest, planned.prepared); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	nowTime := time.Now().Unix()
+
+	dataMutex.Lock()
+	changes, failures, err := stagePlanLocked(plan)
+	if err != nil {
+		dataMutex.Unlock()
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(failures) > 0 {
+		dataMutex.Unlock()
+		for _, planned := range plan {
+			discardBlobs(planned.prepared, nil)
+		}
+		c.JSON(409, gin.H{"error": fmt.Sprintf("%d operation(s) were rejected, nothing was applied", len(failures)), "operations": failures})
+		return
+	}
+
+	images, err := changes.imagesLocked()
+	if err != nil {
+		dataMutex.Unlock()
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	released, err := releasedBlobsLocked(images)
+	if err != nil {
+		dataMutex.Unlock()
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Once the log is written the batch is committed
+	if err := writeWAL(images, released); err != nil {
+		dataMutex.Unlock()
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := applyImagesLocked(images, released, nowTime); err != nil {
+		dataMutex.Unlock()
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Batch committed but not fully saved, it will be completed at restart: %v", err)})
+		return
+	}
+	if err := os.Remove(walFile); err != nil {
+		fmt.Printf("Failed to clear write-ahead log: %v\n", err)
+	}
+	dataMutex.Unlock()
+
+	// Recompute the rollups of every changed collection
+	for _, planned := range plan {
+		var err error
+		if planned.Op == "write" {
+			err = updateRollups(planned.Collection, planned.times)
+		} else {
+			err = updateRollupsRange(planned.Collection, planned.start, planned.end)
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to update rollups: %v", err)})
+			return
+		}
+	}
+
+	c.JSON(200, gin.H{"message": fmt.Sprintf("Batch of %d operation(s) applied", len(plan))})
+}
@@ -0,0 +1,317 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blobMarker starts the stored value of a binary value kept in its own file next to the
+// segment. Like appendMarker and binaryMarker it cannot begin a JSON document.
+const blobMarker = 0x1d
+
+// defaultBlobThreshold is the size above which binary values are stored out of line
+const defaultBlobThreshold = 64 << 10
+
+// blobRef is what the segment holds for a binary value stored out of line
+type blobRef struct {
+	ContentType string
+	Size        uint64
+	Name        string // File name in the segment directory, "<time>-<hash>.blob"
+}
+
+func encodeBlobRef(ref blobRef) []byte {
+	encoded := []byte{blobMarker}
+	encoded = binary.AppendUvarint(encoded, uint64(len(ref.ContentType)))
+	encoded = append(encoded, ref.ContentType...)
+	encoded = binary.AppendUvarint(encoded, ref.Size)
+	return append(encoded, ref.Name...)
+}
+
+// decodeBlobRef reads a value stored by encodeBlobRef
+func decodeBlobRef(data []byte) (blobRef, bool) {
+	if len(data) == 0 || data[0] != blobMarker {
+		return blobRef{}, false
+	}
+	rest := data[1:]
+	length, n := binary.Uvarint(rest)
+	if n <= 0 || length > uint64(len(rest)-n) {
+		return blobRef{}, false
+	}
+	contentType := string(rest[n : n+int(length)])
+	rest = rest[n+int(length):]
+
+	size, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return blobRef{}, false
+	}
+	return blobRef{ContentType: contentType, Size: size, Name: string(rest[n:])}, true
+}
+
+// isBinaryValue reports whether a stored value holds bytes, inline or out of line
+func isBinaryValue(data []byte) bool {
+	return len(data) > 0 && (data[0] == binaryMarker || data[0] == blobMarker)
+}
+
+// blobThreshold returns the configured out-of-line size, 64 KiB if unset
+func blobThreshold() int {
+	if AppConfig.Storage.BlobThreshold > 0 {
+		return AppConfig.Storage.BlobThreshold
+	}
+	return defaultBlobThreshold
+}
+
+var (
+	releasedBlobs = make(map[string]map[string]bool) // Segment path -> blob files to remove once it is saved
+	blobMutex     sync.Mutex                         // Guards releasedBlobs
+)
+
+// storeBlob writes the bytes of a binary value to the segment directory of its point.
+// Every write gets a new file name, so a released file is never referenced again.
+func storeBlob(segmentDir string, ts int64, value binaryValue) (blobRef, string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return blobRef{}, "", fmt.Errorf("failed to name blob: %w", err)
+	}
+	ref := blobRef{
+		ContentType: value.ContentType,
+		Size:        uint64(len(value.Bytes)),
+		Name:        fmt.Sprintf("%d-%s.blob", ts, hex.EncodeToString(suffix)),
+	}
+	path := filepath.Join(segmentDir, ref.Name)
+
+	// Write next to the blob and swap it in, so a reader never sees half a file
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, value.Bytes, 0644); err != nil {
+		return ref, "", fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return ref, "", fmt.Errorf("failed to write blob: %w", err)
+	}
+	return ref, path, nil
+}
+
+// releaseBlob marks the blob of a value replaced by current, or deleted when current is
+// nil, for removal. The file is kept until the segment is saved without it, so the
+// segment on disk never points at a missing blob.
+func releaseBlob(filePath string, old, current []byte) {
+	ref, ok := decodeBlobRef(old)
+	if !ok || string(old) == string(current) {
+		return
+	}
+
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+	if releasedBlobs[filePath] == nil {
+		releasedBlobs[filePath] = map[string]bool{}
+	}
+	releasedBlobs[filePath][ref.Name] = true
+}
+
+// removeReleasedBlobs deletes the blobs released from a segment once fileData, the content
+// just saved, is on disk. The caller must hold dataMutex, so no value changes meanwhile.
+func removeReleasedBlobs(filePath string, fileData map[int64][]byte) {
+	blobMutex.Lock()
+	names := releasedBlobs[filePath]
+	delete(releasedBlobs, filePath)
+	blobMutex.Unlock()
+
+	for name := range names {
+		// A segment evicted before it was saved comes back from disk with the old value
+		prefix, _, _ := strings.Cut(name, "-")
+		if ts, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+			if ref, ok := decodeBlobRef(fileData[ts]); ok && ref.Name == name {
+				continue
+			}
+		}
+		removeBlobs(filePath, []string{name})
+	}
+}
+
+// releasedBlobsLocked lists, for every segment of a batch, the blob files its current
+// values reference and its new image does not. The caller must hold the write lock on
+// dataMutex.
+func releasedBlobsLocked(images map[string]map[int64][]byte) (map[string][]string, error) {
+	released := map[string][]string{}
+	for filePath, image := range images {
+		fileData, err := loadSegmentLocked(filePath)
+		if err != nil {
+			return nil, err
+		}
+		for ts, value := range fileData {
+			if ref, ok := decodeBlobRef(value); ok && string(value) != string(image[ts]) {
+				released[filePath] = append(released[filePath], ref.Name)
+			}
+		}
+	}
+	return released, nil
+}
+
+// removeBlobs deletes blob files of a segment by name
+func removeBlobs(filePath string, names []string) {
+	for _, name := range names {
+		path := filepath.Join(filepath.Dir(filePath), name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to remove blob %s: %v\n", path, err)
+		}
+	}
+}
+
+// discardBlobs removes the blob files written for points that were not stored in the end
+func discardBlobs(prepared []preparedPoint, accepted []int) {
+	stored := map[int]bool{}
+	for _, index := range accepted {
+		stored[index] = true
+	}
+	for _, point := range prepared {
+		if point.blob != "" && !stored[point.index] {
+			os.Remove(point.blob)
+		}
+	}
+}
+
+// lookupValue returns the value stored in a segment at a timestamp
+func lookupValue(filePath string, ts int64) ([]byte, bool, error) {
+	dataMutex.RLock()
+	fileData, cached := inMemoryData[filePath]
+	if cached {
+		value, exists := fileData[ts]
+		dataMutex.RUnlock()
+		return value, exists, nil
+	}
+	dataMutex.RUnlock()
+
+	// Segments not yet on disk must not be created by a read
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	points, err := readSegment(filePath, ts, ts)
+	if err != nil || len(points) == 0 {
+		return nil, false, err
+	}
+	return points[0].Data, true, nil
+}
+
+// add_value stores the request body as it is, with its Content-Type, at one timestamp
+func add_value(c *gin.Context) {
+	dataPath := "./data" // Base directory for data
+	collectionName := c.Param("collection_name")
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+
+	// Check if the collection directory exists
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", collectionName)})
+		return
+	}
+
+	timestamp, err := parseTimestamp(c.Param("timestamp"), collectionPrecision(collectionName))
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid timestamp: %v", err)})
+		return
+	}
+
+	tags, err := parseTags(c.Query("tags"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid tags parameter: %v", err)})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	item := ingestItem{
+		Time: json.RawMessage(fmt.Sprint(timestamp)),
+		Data: binaryValue{ContentType: contentType, Bytes: body},
+		Tags: tags,
+	}
+	idempotent(c, collectionName, body, func() (int, interface{}) {
+		result, err := ingest(collectionName, []ingestItem{item}, false)
+		if err != nil {
+			return 500, gin.H{"error": err.Error()}
+		}
+		return ingestResponse(result, 1, false)
+	})
+}
+
+// get_value returns the value stored at one timestamp. Binary values are sent back as the
+// exact bytes with the content type they were written with, other values as JSON.
+func get_value(c *gin.Context) {
+	dataPath := "./data" // Base directory for data
+	collectionName := c.Param("collection_name")
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+
+	// Check if the collection directory exists
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", collectionName)})
+		return
+	}
+
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	timestamp, err := parseTimestamp(c.Param("timestamp"), manifest.Precision)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid timestamp: %v", err)})
+		return
+	}
+
+	tags, err := parseTags(c.Query("tags"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid tags parameter: %v", err)})
+		return
+	}
+
+	_, sanFilePath := segmentPath(seriesPath(collectionDir, tags), manifest.Precision, timestamp)
+	value, exists, err := lookupValue(sanFilePath, timestamp)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read data: %v", err)})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("No value at time %d", timestamp)})
+		return
+	}
+
+	if stored, ok := decodeBinary(value); ok {
+		c.Data(200, stored.ContentType, stored.Bytes)
+		return
+	}
+
+	if ref, ok := decodeBlobRef(value); ok {
+		file, err := os.Open(filepath.Join(filepath.Dir(sanFilePath), ref.Name))
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read blob: %v", err)})
+			return
+		}
+		defer file.Close()
+		c.DataFromReader(200, int64(ref.Size), ref.ContentType, file, nil)
+		return
+	}
+
+	if values, ok := appendedValues(value); ok {
+		c.JSON(200, values)
+		return
+	}
+	c.Data(200, "application/json; charset=utf-8", value)
+}
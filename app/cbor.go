@@ -0,0 +1,291 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// cborDecoder reads a CBOR document into the same generic values as msgpackDecoder
+type cborDecoder struct {
+	buf []byte
+}
+
+// cborBreak ends an indefinite-length string, array or map
+var cborBreak = &struct{}{}
+
+// decodeCBOR decodes a single CBOR document. Tags are read through, so an epoch time
+// tagged 1 is its number.
+func decodeCBOR(buf []byte) (interface{}, error) {
+	d := &cborDecoder{buf: buf}
+	value, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if value == cborBreak {
+		return nil, fmt.Errorf("unexpected break")
+	}
+	if len(d.buf) > 0 {
+		return nil, fmt.Errorf("unexpected data after the document")
+	}
+	return value, nil
+}
+
+func (d *cborDecoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, fmt.Errorf("truncated document")
+	}
+	taken := d.buf[:n]
+	d.buf = d.buf[n:]
+	return taken, nil
+}
+
+// argument reads the argument of an initial byte; indefinite is true for additional info 31
+func (d *cborDecoder) argument(info byte) (uint64, bool, error) {
+	switch {
+	case info < 24:
+		return uint64(info), false, nil
+	case info <= 27:
+		raw, err := d.take(1 << (info - 24))
+		if err != nil {
+			return 0, false, err
+		}
+		value := uint64(0)
+		for _, b := range raw {
+			value = value<<8 | uint64(b)
+		}
+		return value, false, nil
+	case info == 31:
+		return 0, true, nil
+	}
+	return 0, false, fmt.Errorf("invalid additional information %d", info)
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, fmt.Errorf("document nested too deeply")
+	}
+	head, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := head[0]>>5, head[0]&0x1f
+
+	// Floating point numbers keep their bits in the argument
+	if major == 7 && info >= 25 && info <= 27 {
+		raw, err := d.take(1 << (info - 24))
+		if err != nil {
+			return nil, err
+		}
+		switch info {
+		case 25:
+			return halfFloat(binary.BigEndian.Uint16(raw)), nil
+		case 26:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), nil
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+	}
+
+	arg, indefinite, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && (major == 0 || major == 1 || major == 6) {
+		return nil, fmt.Errorf("invalid indefinite length")
+	}
+
+	switch major {
+	case 0:
+		if arg <= math.MaxInt64 {
+			return int64(arg), nil
+		}
+		return arg, nil
+	case 1:
+		if arg <= math.MaxInt64 {
+			return -1 - int64(arg), nil
+		}
+		return -1 - float64(arg), nil
+
+	case 2, 3:
+		var raw []byte
+		if indefinite {
+			// Chunks of the same type until a break
+			for {
+				chunk, err := d.value(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				if chunk == cborBreak {
+					break
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					raw = append(raw, c...)
+				case string:
+					raw = append(raw, c...)
+				default:
+					return nil, fmt.Errorf("invalid chunk in indefinite-length string")
+				}
+			}
+		} else {
+			chunk, err := d.take(arg)
+			if err != nil {
+				return nil, err
+			}
+			raw = append([]byte{}, chunk...)
+		}
+		if major == 3 {
+			return string(raw), nil
+		}
+		if raw == nil {
+			raw = []byte{}
+		}
+		return raw, nil
+
+	case 4:
+		if !indefinite && arg > uint64(len(d.buf)) {
+			return nil, fmt.Errorf("truncated document")
+		}
+		list := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			value, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if value == cborBreak {
+				if !indefinite {
+					return nil, fmt.Errorf("unexpected break")
+				}
+				break
+			}
+			list = append(list, value)
+		}
+		return list, nil
+
+	case 5:
+		if !indefinite && arg > uint64(len(d.buf))/2 {
+			return nil, fmt.Errorf("truncated document")
+		}
+		object := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			key, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if key == cborBreak {
+				if !indefinite {
+					return nil, fmt.Errorf("unexpected break")
+				}
+				break
+			}
+			value, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if value == cborBreak {
+				return nil, fmt.Errorf("unexpected break")
+			}
+			object[mapKey(key)] = value
+		}
+		return object, nil
+
+	case 6:
+		return d.value(depth + 1)
+	}
+
+	// Simple values
+	switch {
+	case info == 20:
+		return false, nil
+	case info == 21:
+		return true, nil
+	case info == 22, info == 23:
+		return nil, nil
+	case indefinite:
+		return cborBreak, nil
+	}
+	return nil, fmt.Errorf("unsupported simple value %d", arg)
+}
+
+// halfFloat converts an IEEE 754 half-precision number
+func halfFloat(bits uint16) float64 {
+	exponent := int(bits>>10) & 0x1f
+	mantissa := float64(bits & 0x3ff)
+
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 31:
+		value = math.Inf(1)
+		if mantissa != 0 {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if bits&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
+
+// encodeCBOR encodes a value after plainValue has reduced it to basic types
+func encodeCBOR(value interface{}) []byte {
+	return appendCBOR(nil, plainValue(value))
+}
+
+// appendCBORHead writes a major type with its argument in the shortest form
+func appendCBORHead(buf []byte, major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return append(buf, major|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(buf, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, major|27), arg)
+}
+
+func appendCBOR(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0xf6)
+	case bool:
+		if v {
+			return append(buf, 0xf5)
+		}
+		return append(buf, 0xf4)
+	case int64:
+		if v < 0 {
+			return appendCBORHead(buf, 1, uint64(-1-v))
+		}
+		return appendCBORHead(buf, 0, uint64(v))
+	case uint64:
+		return appendCBORHead(buf, 0, v)
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xfb), math.Float64bits(v))
+	case string:
+		return append(appendCBORHead(buf, 3, uint64(len(v))), v...)
+	case []byte:
+		return append(appendCBORHead(buf, 2, uint64(len(v))), v...)
+	case []interface{}:
+		buf = appendCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			buf = appendCBOR(buf, item)
+		}
+		return buf
+	case map[string]interface{}:
+		buf = appendCBORHead(buf, 5, uint64(len(v)))
+		for _, key := range sortedKeys(v) {
+			buf = appendCBOR(buf, key)
+			buf = appendCBOR(buf, v[key])
+		}
+		return buf
+	}
+	return append(buf, 0xf6)
+}
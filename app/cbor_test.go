@@ -0,0 +1,87 @@
+package app
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCBORRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "nil", value: nil},
+		{name: "bool", value: false},
+		{name: "small integer", value: int64(23)},
+		{name: "negative integer", value: int64(-500)},
+		{name: "int64", value: int64(1700000000000000000)},
+		{name: "uint64", value: uint64(math.MaxUint64)},
+		{name: "float", value: -0.125},
+		{name: "string", value: strings.Repeat("é", 100)},
+		{name: "byte string", value: []byte{0xff, 0x00}},
+		{name: "array", value: []interface{}{int64(1), []interface{}{}, "a"}},
+		{name: "map", value: map[string]interface{}{"reading": map[string]interface{}{"temp": 21.5}, "ok": true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeCBOR(encodeCBOR(test.value))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.value) {
+				t.Fatalf("got %#v, want %#v", got, test.value)
+			}
+		})
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// Documents from the examples of RFC 8949, appendix A
+	tests := []struct {
+		name    string
+		input   []byte
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "half float", input: []byte{0xf9, 0x3c, 0x00}, want: 1.0},
+		{name: "single float", input: []byte{0xfa, 0x47, 0xc3, 0x50, 0x00}, want: 100000.0},
+		{name: "tagged value", input: []byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, want: int64(1363896240)},
+		{name: "indefinite string", input: []byte{0x7f, 0x65, 's', 't', 'r', 'e', 'a', 0x64, 'm', 'i', 'n', 'g', 0xff}, want: "streaming"},
+		{name: "indefinite array", input: []byte{0x9f, 0x01, 0x02, 0xff}, want: []interface{}{int64(1), int64(2)}},
+		{name: "indefinite map", input: []byte{0xbf, 0x61, 'a', 0x01, 0xff}, want: map[string]interface{}{"a": int64(1)}},
+		{name: "undefined", input: []byte{0xf7}, want: nil},
+
+		{name: "empty", input: []byte{}, wantErr: true},
+		{name: "truncated string", input: []byte{0x63, 'a'}, wantErr: true},
+		{name: "truncated argument", input: []byte{0x19, 0x01}, wantErr: true},
+		{name: "truncated float", input: []byte{0xfb, 0, 0}, wantErr: true},
+		{name: "truncated array", input: []byte{0x82, 0x01}, wantErr: true},
+		{name: "truncated map", input: []byte{0xa1, 0x61, 'a'}, wantErr: true},
+		{name: "unterminated indefinite array", input: []byte{0x9f, 0x01}, wantErr: true},
+		{name: "huge array length", input: []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "stray break", input: []byte{0x82, 0x01, 0xff}, wantErr: true},
+		{name: "indefinite integer", input: []byte{0x1f}, wantErr: true},
+		{name: "trailing data", input: []byte{0x01, 0x02}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeCBOR(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -3,18 +3,25 @@ package app
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func collections(c *gin.Context) {
+// validCollectionName rejects collection names that would leave the data directory or
+// clash with its hidden files
+func validCollectionName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// listCollections returns the names of the collections, for the REST and gRPC APIs
+func listCollections() ([]string, error) {
 	dataPath := "./data" // Path to the data directory
 
 	// Open the directory
 	files, err := os.ReadDir(dataPath)
 	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read data directory: %v", err)})
-		return
+		return nil, err
 	}
 
 	// Collect folder names
@@ -24,6 +31,69 @@ func collections(c *gin.Context) {
 			collections = append(collections, file.Name())
 		}
 	}
+	return collections, nil
+}
+
+// validateManifest checks the settings of a new collection and fills in the defaults
+func validateManifest(manifest *collectionManifest) error {
+	if manifest.WriteMode == "" {
+		manifest.WriteMode = "overwrite"
+	}
+	if !writeModes[manifest.WriteMode] {
+		return fmt.Errorf("Unknown write mode '%s'", manifest.WriteMode)
+	}
+	if manifest.Precision == "" {
+		manifest.Precision = "ms"
+	}
+	if _, exists := precisionUnits[manifest.Precision]; !exists {
+		return fmt.Errorf("Unknown precision '%s'", manifest.Precision)
+	}
+	return nil
+}
+
+// createCollection creates a collection with validated settings unless it exists, and
+// reports whether it was created
+func createCollection(collectionName string, manifest collectionManifest) (bool, error) {
+	dataPath := "./data" // Path to the data directory
+
+	// Create the collection directory if it doesn't exist
+	collectionPath := fmt.Sprintf("%s/%s", dataPath, collectionName)
+	if _, err := os.Stat(collectionPath); !os.IsNotExist(err) {
+		return false, nil
+	}
+	if err := os.Mkdir(collectionPath, os.ModePerm); err != nil {
+		return false, fmt.Errorf("Failed to create collection '%s': %v", collectionName, err)
+	}
+	if err := saveManifest(collectionPath, manifest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeCollection deletes an existing collection with its cached segments and rollups
+func removeCollection(collectionName string) error {
+	dataPath := "./data" // Path to the data directory
+
+	// Delete the collection directory
+	collectionPath := fmt.Sprintf("%s/%s", dataPath, collectionName)
+	if err := os.RemoveAll(collectionPath); err != nil {
+		return fmt.Errorf("Failed to delete collection '%s': %v", collectionName, err)
+	}
+	dropCachedCollection(collectionPath)
+
+	// Rollups reading from or writing to the collection go away with it
+	if err := renameRollups(collectionName, ""); err != nil {
+		return fmt.Errorf("Failed to update rollups: %v", err)
+	}
+	return nil
+}
+
+func collections(c *gin.Context) {
+	collections, err := listCollections()
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read data directory: %v", err)})
+		return
+	}
 
 	// Return the list of collections as JSON
 	c.JSON(200, gin.H{"collections": collections})
@@ -41,20 +111,45 @@ func collection_detail(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{"message": fmt.Sprintf("Collection '%s' exists", collectionName)})
+	manifest, err := loadManifest(collectionPath)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":    fmt.Sprintf("Collection '%s' exists", collectionName),
+		"write_mode": manifest.WriteMode,
+		"precision":  manifest.Precision,
+	})
 }
 
 func add_collection(c *gin.Context) {
 	collectionName := c.Param("collection_name")
-	dataPath := "./data" // Path to the data directory
+	if !validCollectionName(collectionName) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid collection name '%s'", collectionName)})
+		return
+	}
 
-	// Create the collection directory if it doesn't exist
-	collectionPath := fmt.Sprintf("%s/%s", dataPath, collectionName)
-	if _, err := os.Stat(collectionPath); os.IsNotExist(err) {
-		if err := os.Mkdir(collectionPath, os.ModePerm); err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create collection '%s': %v", collectionName, err)})
+	// Settings are optional and only apply to a new collection
+	manifest := collectionManifest{WriteMode: "overwrite", Precision: "ms"}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&manifest); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
 			return
 		}
+		if err := validateManifest(&manifest); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	created, err := createCollection(collectionName, manifest)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if created {
 		c.JSON(201, gin.H{"message": fmt.Sprintf("Collection '%s' created", collectionName)})
 		return
 	}
@@ -73,8 +168,8 @@ func delete_collection(c *gin.Context) {
 		return
 	}
 
-	if err := os.RemoveAll(collectionPath); err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to delete collection '%s': %v", collectionName, err)})
+	if err := removeCollection(collectionName); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -84,10 +179,21 @@ func delete_collection(c *gin.Context) {
 func update_collection(c *gin.Context) {
 	oldName := c.Param("collection_name")
 	newName := c.Query("new_name")
+	writeMode := c.Query("write_mode")
 	dataPath := "./data" // Path to the data directory
 
-	if oldName == "" || newName == "" {
-		c.JSON(400, gin.H{"error": "Both 'old_name' and 'new_name' must be provided"})
+	if c.Query("precision") != "" {
+		c.JSON(400, gin.H{"error": "The precision of a collection is fixed when it is created"})
+		return
+	}
+
+	if oldName == "" || (newName == "" && writeMode == "") {
+		c.JSON(400, gin.H{"error": "Either 'new_name' or 'write_mode' must be provided"})
+		return
+	}
+
+	if newName != "" && !validCollectionName(newName) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid collection name '%s'", newName)})
 		return
 	}
 
@@ -100,6 +206,43 @@ func update_collection(c *gin.Context) {
 		return
 	}
 
+	if writeMode != "" {
+		if !writeModes[writeMode] {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Unknown write mode '%s'", writeMode)})
+			return
+		}
+
+		manifest, err := loadManifest(oldPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Append collections store their values differently, so only empty ones can switch
+		if (manifest.WriteMode == "append") != (writeMode == "append") {
+			_, _, found, err := collectionBounds(oldPath)
+			if err != nil {
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read collection '%s': %v", oldName, err)})
+				return
+			}
+			if found {
+				c.JSON(409, gin.H{"error": fmt.Sprintf("Collection '%s' must be empty to switch to or from append mode", oldName)})
+				return
+			}
+		}
+
+		manifest.WriteMode = writeMode
+		if err := saveManifest(oldPath, manifest); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		if newName == "" {
+			c.JSON(200, gin.H{"message": fmt.Sprintf("Collection '%s' now uses write mode '%s'", oldName, writeMode)})
+			return
+		}
+	}
+
 	// Check if the new  collection name already exists
 	if _, err := os.Stat(newPath); err == nil {
 		c.JSON(400, gin.H{"error": fmt.Sprintf("Collection '%s' already exists", newName)})
@@ -111,6 +254,12 @@ func update_collection(c *gin.Context) {
 		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to rename collection '%s' to '%s': %v", oldName, newName, err)})
 		return
 	}
+	dropCachedCollection(oldPath)
+
+	if err := renameRollups(oldName, newName); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to update rollups: %v", err)})
+		return
+	}
 
 	c.JSON(200, gin.H{"message": fmt.Sprintf("Collection '%s' renamed to '%s'", oldName, newName)})
-}
\ No newline at end of file
+}
@@ -0,0 +1,46 @@
+package app
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAddCollectionName(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+	}{
+		{name: "cpu", code: 201},
+		{name: ".wal", code: 400},
+		{name: ".rollups.json", code: 400},
+		{name: "..", code: 400},
+		{name: `a\b`, code: 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useDataDir(t)
+			gin.SetMode(gin.TestMode)
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Params = gin.Params{{Key: "collection_name", Value: test.name}}
+			c.Request = httptest.NewRequest("PUT", "/collections/x", nil)
+			add_collection(c)
+
+			if recorder.Code != test.code {
+				t.Fatalf("got %d, want %d: %s", recorder.Code, test.code, recorder.Body.String())
+			}
+			// Nothing is created for a rejected name
+			entries, err := os.ReadDir("./data")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created := len(entries) > 0; created != (test.code == 201) {
+				t.Fatalf("got %d entries in ./data", len(entries))
+			}
+		})
+	}
+}
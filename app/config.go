@@ -17,11 +17,32 @@ type Config struct {
 			IdleTimeout  int `yaml:"IdleTimeout"`
 		} `yaml:"timeout"`
 		ShutdownTimeout int `yaml:"shutdown-timeout"` // New field
+		GRPCPort int `yaml:"grpc-port"` // Port of the gRPC API, 0 disables it
+		Listeners []ListenerConfig `yaml:"listeners"` // Optional Graphite and OpenTSDB listeners
 	} `yaml:"server"`
 	Memory struct {
 		MaxData int `yaml:"max-data"`
 		MaxSize int `yaml:"max-size"`
 	} `yaml:"memory"`
+	Query struct {
+		Workers int `yaml:"workers"` // Concurrent collection scans per query
+	} `yaml:"query"`
+	Idempotency struct {
+		Window int `yaml:"window"` // Seconds an Idempotency-Key is remembered
+	} `yaml:"idempotency"`
+	Storage struct {
+		BlobThreshold int `yaml:"blob-threshold"` // Binary values larger than this many bytes get their own file
+	} `yaml:"storage"`
+}
+
+// ListenerConfig describes a plaintext TCP or UDP listener for legacy collectors
+type ListenerConfig struct {
+	Name      string   `yaml:"name"`
+	Format    string   `yaml:"format"`    // graphite or opentsdb
+	Protocol  string   `yaml:"protocol"`  // tcp or udp
+	Address   string   `yaml:"address"`   // e.g. ":2003"
+	Precision string   `yaml:"precision"` // Precision of the collections it creates
+	Templates []string `yaml:"templates"` // Map metric paths to collections, tags and fields
 }
 
 var AppConfig *Config
@@ -33,6 +54,7 @@ func init() {
 		panic(fmt.Sprintf("Failed to load config: %v", err))
 	}
 	go StartMemoryManager()
+	go StartIdempotencyExpiry()
 }
 
 func LoadConfig() (*Config, error) {
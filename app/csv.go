@@ -0,0 +1,457 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// csvColumn says where the cells of a CSV column go in an item
+type csvColumn struct {
+	Skip bool
+	Tag  string   // Tag key, for columns mapped to "tags.<key>"
+	Path []string // Path in data; empty for the whole value
+	Type string   // string, number, boolean or json; inferred from each cell when empty
+}
+
+// csvOptions describes how CSV rows become items
+type csvOptions struct {
+	TimeColumn string
+	TimeFormat string               // Empty, an epoch unit (s, ms, us, ns) or a Go time layout
+	Mapping    map[string]csvColumn // Column name -> destination, for columns not stored under their own name
+}
+
+var csvTypes = map[string]bool{"string": true, "number": true, "boolean": true, "json": true}
+
+// errStopScan ends a scan early without reporting an error
+var errStopScan = errors.New("stop scan")
+
+// parseCSVColumn reads a destination such as "temp", "reading.temp:number", "tags.site" or "-"
+func parseCSVColumn(destination string) (csvColumn, error) {
+	if destination == "-" {
+		return csvColumn{Skip: true}, nil
+	}
+
+	column := csvColumn{}
+	if path, kind, found := strings.Cut(destination, ":"); found {
+		if !csvTypes[kind] {
+			return column, fmt.Errorf("unknown type '%s'", kind)
+		}
+		destination, column.Type = path, kind
+	}
+
+	if tag, found := strings.CutPrefix(destination, "tags."); found {
+		if tag == "" {
+			return column, fmt.Errorf("missing tag key in '%s'", destination)
+		}
+		column.Tag = tag
+		return column, nil
+	}
+	// "data.<path>" names a field of data explicitly, as exported for fields whose name
+	// collides with a point column
+	if field, found := strings.CutPrefix(destination, "data."); found {
+		column.Path = strings.Split(field, ".")
+	} else if destination != "data" {
+		column.Path = strings.Split(destination, ".")
+	}
+	return column, nil
+}
+
+// parseCSVOptions reads the time_column, time_format and mapping query parameters
+func parseCSVOptions(c *gin.Context) (csvOptions, error) {
+	options := csvOptions{
+		TimeColumn: c.DefaultQuery("time_column", "time"),
+		TimeFormat: c.Query("time_format"),
+		Mapping:    map[string]csvColumn{},
+	}
+
+	if param := c.Query("mapping"); param != "" {
+		for _, pair := range strings.Split(param, ",") {
+			name, destination, found := strings.Cut(pair, "=")
+			if !found {
+				return options, fmt.Errorf("invalid mapping '%s', expected column=path", pair)
+			}
+			column, err := parseCSVColumn(destination)
+			if err != nil {
+				return options, fmt.Errorf("invalid mapping '%s': %v", pair, err)
+			}
+			options.Mapping[name] = column
+		}
+	}
+	return options, nil
+}
+
+// csvTime converts a cell of the time column to ticks of a precision
+func csvTime(value, format, precision string) (int64, error) {
+	value = strings.TrimSpace(value)
+
+	switch format {
+	case "":
+		return parseTimestamp(value, precision)
+
+	case "s", "ms", "us", "ns":
+		if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return ts * precisionUnits[format] / precisionUnit(precision), nil
+		}
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid epoch time '%s'", value)
+		}
+		return int64(seconds * float64(precisionUnits[format]) / float64(precisionUnit(precision))), nil
+	}
+
+	t, err := time.ParseInLocation(format, value, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("time '%s' does not match the format '%s'", value, format)
+	}
+	return timestampOf(t, precision), nil
+}
+
+// csvValue converts a cell to a JSON value, inferring its type unless one is given
+func csvValue(cell, kind string) (interface{}, error) {
+	switch kind {
+	case "string":
+		return cell, nil
+	case "number":
+		number, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", cell)
+		}
+		return number, nil
+	case "boolean":
+		boolean, err := strconv.ParseBool(strings.TrimSpace(cell))
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a boolean", cell)
+		}
+		return boolean, nil
+	case "json":
+		var value interface{}
+		if err := json.Unmarshal([]byte(cell), &value); err != nil {
+			return nil, fmt.Errorf("invalid JSON '%s'", cell)
+		}
+		return value, nil
+	}
+
+	if number, err := strconv.ParseFloat(cell, 64); err == nil && !math.IsInf(number, 0) && !math.IsNaN(number) {
+		return number, nil
+	}
+	if cell == "true" || cell == "false" {
+		return cell == "true", nil
+	}
+	return cell, nil
+}
+
+// setPath stores a value under a dotted path of an object, creating nested objects
+func setPath(object map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := object[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			object[key] = next
+		}
+		object = next
+	}
+	object[path[len(path)-1]] = value
+}
+
+// parseCSVItems turns a CSV body with a header row into items. Columns are stored under their
+// own name unless mapped, so "tags.<key>" headers become tags. Empty cells are left out.
+// Rows that cannot be converted carry their errors to be reported with the batch.
+func parseCSVItems(body []byte, options csvOptions, precision string) ([]ingestItem, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timeIndex := -1
+	columns := make([]csvColumn, len(header))
+	for i, name := range header {
+		if name == options.TimeColumn {
+			timeIndex = i
+			columns[i] = csvColumn{Skip: true}
+			continue
+		}
+		if column, mapped := options.Mapping[name]; mapped {
+			columns[i] = column
+			continue
+		}
+		if columns[i], err = parseCSVColumn(name); err != nil {
+			return nil, fmt.Errorf("invalid column '%s': %v", name, err)
+		}
+	}
+	if timeIndex < 0 {
+		return nil, fmt.Errorf("missing time column '%s'", options.TimeColumn)
+	}
+
+	items := []ingestItem{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		item := ingestItem{}
+		if len(record) != len(header) {
+			item.errors = []string{fmt.Sprintf("expected %d columns, found %d", len(header), len(record))}
+			items = append(items, item)
+			continue
+		}
+
+		if ts, err := csvTime(record[timeIndex], options.TimeFormat, precision); err != nil {
+			item.errors = append(item.errors, fmt.Sprintf("%s: %v", header[timeIndex], err))
+		} else {
+			item.Time = json.RawMessage(strconv.FormatInt(ts, 10))
+		}
+
+		data := map[string]interface{}{}
+		for i, column := range columns {
+			if column.Skip || record[i] == "" {
+				continue
+			}
+			if column.Tag != "" {
+				if item.Tags == nil {
+					item.Tags = map[string]string{}
+				}
+				item.Tags[column.Tag] = record[i]
+				continue
+			}
+
+			value, err := csvValue(record[i], column.Type)
+			if err != nil {
+				item.errors = append(item.errors, fmt.Sprintf("%s: %v", header[i], err))
+				continue
+			}
+			if len(column.Path) == 0 {
+				item.Data = value
+				continue
+			}
+			setPath(data, column.Path, value)
+		}
+		if item.Data == nil {
+			item.Data = data
+		}
+
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// flattenPoint turns a formatted point into CSV cells keyed by column. Data objects are
+// spread over dotted columns, tags go to "tags.<key>" columns and other data to "data".
+// Data fields that would take the name of another column are prefixed with "data.".
+func flattenPoint(point map[string]interface{}) map[string]string {
+	cells := map[string]string{}
+	for key, value := range point {
+		switch key {
+		case "data":
+			if object, ok := value.(map[string]interface{}); ok {
+				fields := map[string]string{}
+				flattenObject(fields, "", object)
+				for column, cell := range fields {
+					if csvReserved(column) {
+						column = "data." + column
+					}
+					cells[column] = cell
+				}
+			} else if value != nil {
+				cells["data"] = csvCell(value)
+			}
+		case "tags":
+			if tags, ok := value.(map[string]string); ok {
+				for tag, tagValue := range tags {
+					cells["tags."+tag] = tagValue
+				}
+			}
+		default:
+			cells[key] = csvCell(value)
+		}
+	}
+	return cells
+}
+
+// csvReserved reports whether a flattened data field would be read back as something else
+func csvReserved(column string) bool {
+	switch column {
+	case "time", "seq", "data":
+		return true
+	}
+	return strings.HasPrefix(column, "tags.") || strings.HasPrefix(column, "data.")
+}
+
+func flattenObject(cells map[string]string, prefix string, object map[string]interface{}) {
+	for key, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenObject(cells, prefix+key+".", nested)
+			continue
+		}
+		cells[prefix+key] = csvCell(value)
+	}
+}
+
+// csvCell formats a JSON value as a cell; arrays stay JSON
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// csvHeader orders columns as time, seq, tags and then data fields
+func csvHeader(columns map[string]bool) []string {
+	rank := func(column string) int {
+		switch {
+		case column == "time":
+			return 0
+		case column == "seq":
+			return 1
+		case strings.HasPrefix(column, "tags."):
+			return 2
+		}
+		return 3
+	}
+
+	header := make([]string, 0, len(columns))
+	for column := range columns {
+		header = append(header, column)
+	}
+	sort.Slice(header, func(i, j int) bool {
+		if rank(header[i]) != rank(header[j]) {
+			return rank(header[i]) < rank(header[j])
+		}
+		return header[i] < header[j]
+	})
+	return header
+}
+
+// csvWriter streams rows under a fixed header
+type csvWriter struct {
+	c      *gin.Context
+	writer *csv.Writer
+	header []string
+	rows   int
+}
+
+func newCSVWriter(c *gin.Context, header []string) *csvWriter {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(200)
+
+	writer := &csvWriter{c: c, writer: csv.NewWriter(c.Writer), header: header}
+	writer.writer.Write(header)
+	return writer
+}
+
+func (w *csvWriter) write(point map[string]interface{}) error {
+	cells := flattenPoint(point)
+	record := make([]string, len(w.header))
+	for i, column := range w.header {
+		record[i] = cells[column]
+	}
+	if err := w.writer.Write(record); err != nil {
+		return err
+	}
+
+	// Hand rows to the client as they are produced
+	w.rows++
+	if w.rows%1000 == 0 {
+		w.writer.Flush()
+		w.c.Writer.Flush()
+	}
+	return nil
+}
+
+func (w *csvWriter) close() {
+	w.writer.Flush()
+}
+
+// writeCSVRows writes points that are already in memory, such as aggregates
+func writeCSVRows(c *gin.Context, rows []map[string]interface{}) {
+	columns := map[string]bool{"time": true}
+	for _, row := range rows {
+		for column := range flattenPoint(row) {
+			columns[column] = true
+		}
+	}
+
+	writer := newCSVWriter(c, csvHeader(columns))
+	for _, row := range rows {
+		writer.write(row)
+	}
+	writer.close()
+}
+
+// streamCSV writes the points of several series between start and end without holding them.
+// A first scan finds the columns and the number of rows, a second writes the rows.
+func streamCSV(c *gin.Context, list []seriesInfo, start, end int64, fields [][]string, offset, limit int) error {
+	format := func(series seriesInfo, point dataPoint) map[string]interface{} {
+		return seriesPoint(series, point, projectFields(decodeData(point.Data), fields))
+	}
+
+	columns := map[string]bool{"time": true}
+	total := 0
+	err := scanSeries(list, start, end, func(series seriesInfo, point dataPoint) error {
+		for column := range flattenPoint(format(series, point)) {
+			columns[column] = true
+		}
+		total++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Like JSON reads, an offset past the end returns every point
+	if offset >= total {
+		offset = 0
+	}
+
+	writer := newCSVWriter(c, csvHeader(columns))
+	index, written := 0, 0
+	err = scanSeries(list, start, end, func(series seriesInfo, point dataPoint) error {
+		index++
+		if index <= offset {
+			return nil
+		}
+		if limit > 0 && written == limit {
+			return errStopScan
+		}
+		written++
+		return writer.write(format(series, point))
+	})
+	writer.close()
+
+	if errors.Is(err, errStopScan) {
+		return nil
+	}
+	return err
+}
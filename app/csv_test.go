@@ -0,0 +1,131 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlattenPoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		point map[string]interface{}
+		want  map[string]string
+	}{
+		{
+			name: "object data and tags",
+			point: map[string]interface{}{
+				"time": int64(100),
+				"tags": map[string]string{"site": "a"},
+				"data": map[string]interface{}{"reading": map[string]interface{}{"temp": 21.5}, "list": []interface{}{1.0}},
+			},
+			want: map[string]string{"time": "100", "tags.site": "a", "reading.temp": "21.5", "list": "[1]"},
+		},
+		{
+			name:  "other data",
+			point: map[string]interface{}{"time": int64(100), "seq": 2, "data": "text"},
+			want:  map[string]string{"time": "100", "seq": "2", "data": "text"},
+		},
+		{
+			name: "fields named after point columns",
+			point: map[string]interface{}{
+				"time": int64(100),
+				"seq":  2,
+				"tags": map[string]string{"site": "a"},
+				"data": map[string]interface{}{
+					"time": 5.0,
+					"seq":  6.0,
+					"data": 7.0,
+					"tags": map[string]interface{}{"site": "b"},
+					"temp": 8.0,
+				},
+			},
+			want: map[string]string{
+				"time": "100", "seq": "2", "tags.site": "a",
+				"data.time": "5", "data.seq": "6", "data.data": "7", "data.tags.site": "b", "temp": "8",
+			},
+		},
+		{
+			name:  "nested field under data",
+			point: map[string]interface{}{"time": int64(100), "data": map[string]interface{}{"data": map[string]interface{}{"x": 1.0}}},
+			want:  map[string]string{"time": "100", "data.data.x": "1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := flattenPoint(test.point); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	data := map[string]interface{}{
+		"time": 5.0,
+		"data": map[string]interface{}{"x": 1.0},
+		"tags": map[string]interface{}{"site": "b"},
+		"temp": 8.0,
+	}
+	cells := flattenPoint(map[string]interface{}{"time": int64(100), "tags": map[string]string{"site": "a"}, "data": data})
+
+	columns := map[string]bool{}
+	for column := range cells {
+		columns[column] = true
+	}
+	header := csvHeader(columns)
+	record := make([]string, len(header))
+	for i, column := range header {
+		record[i] = cells[column]
+	}
+	body := strings.Join(header, ",") + "\n" + strings.Join(record, ",") + "\n"
+
+	items, err := parseCSVItems([]byte(body), csvOptions{TimeColumn: "time"}, "s")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(items) != 1 || len(items[0].errors) > 0 {
+		t.Fatalf("got %+v", items)
+	}
+	if string(items[0].Time) != "100" || !reflect.DeepEqual(items[0].Tags, map[string]string{"site": "a"}) || !reflect.DeepEqual(items[0].Data, data) {
+		t.Fatalf("got %s %v %v, want 100 map[site:a] %v", items[0].Time, items[0].Tags, items[0].Data, data)
+	}
+}
+
+func TestParseCSVColumn(t *testing.T) {
+	tests := []struct {
+		destination string
+		want        csvColumn
+		wantErr     bool
+	}{
+		{destination: "temp", want: csvColumn{Path: []string{"temp"}}},
+		{destination: "reading.temp:number", want: csvColumn{Path: []string{"reading", "temp"}, Type: "number"}},
+		{destination: "data", want: csvColumn{}},
+		{destination: "data.time", want: csvColumn{Path: []string{"time"}}},
+		{destination: "data.data", want: csvColumn{Path: []string{"data"}}},
+		{destination: "data.tags.site", want: csvColumn{Path: []string{"tags", "site"}}},
+		{destination: "tags.site", want: csvColumn{Tag: "site"}},
+		{destination: "-", want: csvColumn{Skip: true}},
+		{destination: "tags.", wantErr: true},
+		{destination: "temp:date", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.destination, func(t *testing.T) {
+			got, err := parseCSVColumn(test.destination)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -5,10 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"sort"
 	"strconv"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -31,94 +30,106 @@ func add_data(c *gin.Context) {
 	}
 
 	// Parse JSON body
-	var requestData []struct {
-		Time int64       `json:"time"` // Millisecond timestamp
-		Data interface{} `json:"data"` // Data can be any JSON type
-	}
-	
-	if err := c.ShouldBindJSON(&requestData); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	nowTime := time.Now().Unix()
-
-	for _, item := range requestData {
-		if item.Time <= 0 {
-			c.JSON(400, gin.H{"error": "Each item must have a valid 'time'"})
+	var requestData []ingestItem
+	if c.ContentType() == "text/csv" {
+		// One item per row, with the time and fields taken from the columns
+		options, err := parseCSVOptions(c)
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid CSV parameters: %v", err)})
 			return
 		}
-
-		// Convert `item.Data` to JSON byte slice
-		dataJSON, err := json.Marshal(item.Data)
+		if requestData, err = parseCSVItems(body, options, collectionPrecision(collectionName)); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid CSV: %v", err)})
+			return
+		}
+	} else if format := bodyFormat(c.ContentType()); format == "msgpack" || format == "cbor" || format == "protobuf" {
+		if requestData, err = decodeItems(format, body); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+	} else if format == "binary" {
+		// The whole body is stored as one opaque value
+		tags, err := parseTags(c.Query("tags"))
 		if err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to process data: %v", err)})
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid tags parameter: %v", err)})
 			return
 		}
-
-		// Convert timestamp to year, day, and 6-hour segment
-		t := time.UnixMilli(item.Time)
-		year, day := t.Year(), t.YearDay()
-		hour := t.Hour()
-		segment := (hour / 6) + 1 // Calculate 6-hour segment (1-4)
-
-		// Define file path
-		segmentDir := fmt.Sprintf("%s/%d/%d", collectionDir, year, day)
-		sanFilePath := fmt.Sprintf("%s/%d.san", segmentDir, segment)
-
-		// Ensure directory exists
-		if err := os.MkdirAll(segmentDir, os.ModePerm); err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create directory: %v", err)})
+		timestamp, err := parseTimestamp(c.DefaultQuery("time", "now"), collectionPrecision(collectionName))
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid time parameter: %v", err)})
 			return
 		}
+		requestData = []ingestItem{{
+			Time: json.RawMessage(strconv.FormatInt(timestamp, 10)),
+			Data: binaryValue{ContentType: "application/octet-stream", Bytes: body},
+			Tags: tags,
+		}}
+	} else if err := json.Unmarshal(body, &requestData); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
 
-		// Safely load file into memory if not already loaded
-		dataMutex.Lock()
-		if _, exists := inMemoryData[sanFilePath]; !exists {
-			inMemoryData[sanFilePath] = make(map[int64][]byte)
+	// With partial=true the valid items are written and the others reported
+	partial := c.Query("partial") == "true"
 
-			// Load existing data if the file exists
-			if _, err := os.Stat(sanFilePath); !os.IsNotExist(err) {
-				file, err := os.Open(sanFilePath)
-				if err != nil {
-					dataMutex.Unlock()
-					c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to open .san file: %v", err)})
-					return
-				}
-				defer file.Close()
-
-				// Temporary variable to decode data
-				var tempData map[int64][]byte
-				decoder := gob.NewDecoder(file)
-				if err := decoder.Decode(&tempData); err != nil {
-					dataMutex.Unlock()
-					c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to decode .san file: %v", err)})
-					return
-				}
-				inMemoryData[sanFilePath] = tempData
-			}
+	// A retry carrying the same Idempotency-Key gets the first response back
+	idempotent(c, collectionName, body, func() (int, interface{}) {
+		result, err := ingest(collectionName, requestData, partial)
+		if err != nil {
+			return 500, gin.H{"error": err.Error()}
 		}
+		return ingestResponse(result, len(requestData), partial)
+	})
+}
 
-		// Insert or overwrite data in memory
-		inMemoryData[sanFilePath][item.Time] = dataJSON
-
-		// Update the last access timestamp
-		lastAccessTimestamps[sanFilePath] = nowTime
-
-		dataMutex.Unlock()
+// ingestResponse reports the outcome of a write request
+func ingestResponse(result ingestResult, total int, partial bool) (int, gin.H) {
+	if partial {
+		code := 201
+		if len(result.Accepted) == 0 && total > 0 {
+			code = 400
+		}
+		return code, gin.H{
+			"message":  fmt.Sprintf("%d of %d item(s) added", len(result.Accepted), total),
+			"accepted": len(result.Accepted),
+			"rejected": len(result.Failures),
+			"items":    result.report(total),
+		}
 	}
 
-	go save_to_disk(nowTime);
+	if len(result.Failures) > 0 {
+		code := 400
+		if result.Conflict {
+			code = 409
+		}
+		return code, gin.H{"error": fmt.Sprintf("%d item(s) were rejected, nothing was written", len(result.Failures)), "items": result.Failures}
+	}
 
-	c.JSON(201, gin.H{"message": "Data added successfully"})
+	return 201, gin.H{"message": "Data added successfully"}
 }
 
 func save_to_disk(timestamp int64) {
 	// Save only files with the specified timestamp
-	for filePath, data := range inMemoryData {
+	dataMutex.RLock()
+	filePaths := []string{}
+	for filePath := range inMemoryData {
+		if fileTimestamp, exists := lastAccessTimestamps[filePath]; exists && fileTimestamp == timestamp {
+			filePaths = append(filePaths, filePath)
+		}
+	}
+	dataMutex.RUnlock()
+
+	for _, filePath := range filePaths {
 		dataMutex.RLock() // Read lock for safe concurrent access
+		data, loaded := inMemoryData[filePath]
 		fileTimestamp, exists := lastAccessTimestamps[filePath]
-		if !exists || fileTimestamp != timestamp {
+		if !loaded || !exists || fileTimestamp != timestamp {
 			dataMutex.RUnlock()
 			continue
 		}
@@ -137,6 +148,12 @@ func save_to_disk(timestamp int64) {
 			continue
 		}
 		file.Close()
+
+		// The percentile sketches of the segment no longer match its data
+		dropSketch(filePath)
+
+		// Blobs replaced in the segment can go now that it is saved without them
+		removeReleasedBlobs(filePath, data)
 		dataMutex.RUnlock()
 	}
 
@@ -153,21 +170,36 @@ func get_data(c *gin.Context) {
 		return
 	}
 
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Parse query parameters
-	start, err := strconv.ParseInt(c.Query("start"), 10, 64)
+	start, err := parseTimestamp(c.Query("start"), manifest.Precision)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid start parameter"})
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid start parameter: %v", err)})
 		return
 	}
 
-	end, err := strconv.ParseInt(c.Query("end"), 10, 64)
+	// Without an end the range runs up to now
+	end, err := parseTimestamp(c.DefaultQuery("end", "now"), manifest.Precision)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid end parameter"})
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid end parameter: %v", err)})
 		return
 	}
 
 	limitParam := c.Query("limit")
 	offsetParam := c.Query("offset")
+	fields := parseFields(c.Query("fields"))
+
+	// Without a format parameter the Accept header can ask for MessagePack, CBOR or protobuf
+	format := c.DefaultQuery("format", acceptFormat(c))
+	if format != "json" && format != "csv" && format != "msgpack" && format != "cbor" && format != "protobuf" {
+		c.JSON(400, gin.H{"error": "Invalid format parameter, expected 'json', 'csv', 'msgpack', 'cbor' or 'protobuf'"})
+		return
+	}
 
 	limit := -1
 	offset := 0
@@ -188,139 +220,186 @@ func get_data(c *gin.Context) {
 		}
 	}
 
-	nowTime := time.Now().Unix()
-
-	// Convert start and end timestamps
-	startTime := time.UnixMilli(start)
-	endTime := time.UnixMilli(end)
+	transforms, err := parseTransforms(c.Query("transform"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid transform parameter: %v", err)})
+		return
+	}
 
-	startYear, startDay := startTime.Year(), startTime.YearDay()
-	startSegment := (startTime.Hour() / 6) + 1
+	unit, err := parseInterval(c.DefaultQuery("unit", "1s"), manifest.Precision)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid unit parameter"})
+		return
+	}
 
-	endYear, endDay := endTime.Year(), endTime.YearDay()
-	endSegment := (endTime.Hour() / 6) + 1
+	fieldPath := []string{}
+	if field := c.Query("field"); field != "" {
+		fieldPath = strings.Split(field, ".")
+	}
 
-	result := []map[string]interface{}{}
+	downsample := c.Query("downsample")
+	points := 0
+	if downsample != "" {
+		if c.Query("resample") != "" || len(transforms) > 0 {
+			c.JSON(400, gin.H{"error": "downsample cannot be combined with resample or transform"})
+			return
+		}
+		points, err = strconv.Atoi(c.Query("points"))
+		if err != nil || points <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid points parameter"})
+			return
+		}
+		if _, err := newDownsampler(downsample, points, 0, 0); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid downsample parameter: %v", err)})
+			return
+		}
+	}
 
-	// Loop through years
-	for year := startYear; year <= endYear; year++ {
-		yearDir := fmt.Sprintf("%s/%d", collectionDir, year)
+	filter, err := parseTags(c.Query("tags"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid tags parameter: %v", err)})
+		return
+	}
 
-		if _, err := os.Stat(yearDir); os.IsNotExist(err) {
-			continue
-		}
+	groupBy := []string{}
+	if param := c.Query("group_by"); param != "" {
+		groupBy = strings.Split(param, ",")
+	}
 
-		// Determine day range
-		dayStart := 1
-		dayEnd := 366
+	list, err := findSeries(collectionDir, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read series index: %v", err)})
+		return
+	}
 
-		if year == startYear {
-			dayStart = startDay
-		}
-		if year == endYear {
-			dayEnd = endDay
+	// Resample a numeric field into evenly spaced buckets
+	resample := c.Query("resample")
+	spec := aggregateSpec{
+		Function: c.DefaultQuery("aggregate", "mean"),
+		Field:    c.Query("field"),
+		Interval: resample,
+		Fill:     c.DefaultQuery("fill", "null"),
+		NoRollup: c.Query("rollup") == "false",
+	}
+	if resample != "" {
+		if err := validateAggregate(spec, manifest.Precision, start, end); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid resample parameters: %v", err)})
+			return
 		}
+	}
 
-		for day := dayStart; day <= dayEnd; day++ {
-			dayDir := fmt.Sprintf("%s/%d", yearDir, day)
+	// read answers the query for a set of series; the whole collection may use a rollup
+	read := func(list []seriesInfo, whole bool) ([]map[string]interface{}, error) {
+		if downsample != "" {
+			return downsampleRange(list, start, end, downsample, points, fieldPath, fields)
+		}
 
-			if _, err := os.Stat(dayDir); os.IsNotExist(err) {
-				continue
+		if resample != "" {
+			var result []map[string]interface{}
+			var err error
+			if whole {
+				result, err = aggregateRange(collectionDir, start, end, spec)
+			} else {
+				result, err = aggregateSeries(list, manifest.Precision, start, end, spec)
 			}
-
-			files, err := os.ReadDir(dayDir)
-			if err != nil {
-				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read directory: %v", err)})
-				return
+			if err == nil && len(transforms) > 0 {
+				result = transformSeries(result, transforms, unit)
 			}
+			return result, err
+		}
 
-			for _, file := range files {
-				if file.IsDir() {
-					continue
-				}
-
-				segment, err := strconv.Atoi(file.Name()[:len(file.Name())-4])
-				if err != nil {
-					continue
+		result := []map[string]interface{}{}
+		if len(transforms) > 0 {
+			// Stream the numeric field of every series through its own copy of the transforms
+			pipelines := newSeriesTransforms(transforms)
+			err := scanSeries(list, start, end, func(series seriesInfo, point dataPoint) error {
+				value, ok := numericValue(decodeData(point.Data), fieldPath)
+				if !ok {
+					return nil
 				}
-
-				if (year == startYear && day == startDay && segment < startSegment) ||
-					(year == endYear && day == endDay && segment > endSegment) {
-					continue
+				if value, ok = pipelines.apply(series, point.Time, value, unit); ok {
+					result = append(result, seriesPoint(series, point, value))
 				}
+				return nil
+			})
+			return result, err
+		}
 
-				filePath := fmt.Sprintf("%s/%s", dayDir, file.Name())
-
-				// Check if the file is already in memory
-				dataMutex.RLock()
-				fileData, exists := inMemoryData[filePath]
-				dataMutex.RUnlock()
-
-				if !exists {
-					// Load the file into memory
-					dataMutex.Lock()
-					file, err := os.Open(filePath)
-					if err != nil {
-						dataMutex.Unlock()
-						c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to open file: %v", err)})
-						return
-					}
-
-					defer file.Close()
-
-					fileData = make(map[int64][]byte)
-					decoder := gob.NewDecoder(file)
-					if err := decoder.Decode(&fileData); err != nil {
-						dataMutex.Unlock()
-						c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to decode file: %v", err)})
-						return
-					}
-
-					// Insert or overwrite data in memory
-					inMemoryData[filePath] = fileData
-
-					// Update the last access timestamp
-					lastAccessTimestamps[filePath] = nowTime
+		// Collect points in time order
+		err := scanSeries(list, start, end, func(series seriesInfo, point dataPoint) error {
+			// Keep only the requested fields
+			result = append(result, seriesPoint(series, point, projectFields(decodeData(point.Data), fields)))
+			return nil
+		})
+		return result, err
+	}
 
-					dataMutex.Unlock()
-				}
+	// Apply offset and limit
+	paginate := func(result []map[string]interface{}) []map[string]interface{} {
+		if offset < len(result) {
+			result = result[offset:]
+		}
+		if limit > 0 && limit < len(result) {
+			result = result[:limit]
+		}
+		return result
+	}
 
-				// Filter data by timestamp range
-				for ts, data := range fileData {
-					if ts >= start && ts <= end {
-						var deserializedData interface{}
-
-						// Attempt to unmarshal the data into a generic interface{}
-						err := json.Unmarshal(data, &deserializedData)
-						if err != nil {
-							// If unmarshaling fails, keep the original data as is
-							deserializedData = string(data)
-						}
-
-						result = append(result, map[string]interface{}{
-							"time": ts,
-							"data": deserializedData,
-						})
-					}
-				}
-			}
+	// Plain reads are streamed as CSV without holding the range in memory
+	if format == "csv" && downsample == "" && resample == "" && len(transforms) == 0 && len(groupBy) == 0 {
+		if err := streamCSV(c, list, start, end, fields, offset, limit); err != nil {
+			fmt.Printf("Failed to stream CSV of %s: %v\n", collectionName, err)
 		}
+		return
 	}
 
-	// Sort results by timestamp
-	sort.Slice(result, func(i, j int) bool {
-		return result[i]["time"].(int64) < result[j]["time"].(int64)
-	})
+	if len(groupBy) == 0 {
+		result, err := read(list, len(filter) == 0)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read data: %v", err)})
+			return
+		}
+		if format == "csv" {
+			writeCSVRows(c, paginate(result))
+			return
+		}
+		if format == "protobuf" {
+			respondPoints(c, paginate(result))
+			return
+		}
+		respondData(c, format, 200, gin.H{"data": paginate(result)})
+		return
+	}
 
-	// Apply offset and limit
-	if offset < len(result) {
-		result = result[offset:]
+	// One result per combination of the group_by tags
+	groups := []gin.H{}
+	for _, group := range groupSeries(list, groupBy) {
+		result, err := read(group.Series, false)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read data: %v", err)})
+			return
+		}
+		groups = append(groups, gin.H{"tags": group.Tags, "data": paginate(result)})
 	}
-	if limit > 0 && limit < len(result) {
-		result = result[:limit]
+
+	if format == "csv" || format == "protobuf" {
+		// Every row carries the tags of its group
+		rows := []map[string]interface{}{}
+		for _, group := range groups {
+			for _, point := range group["data"].([]map[string]interface{}) {
+				point["tags"] = group["tags"]
+				rows = append(rows, point)
+			}
+		}
+		if format == "protobuf" {
+			respondPoints(c, rows)
+			return
+		}
+		writeCSVRows(c, rows)
+		return
 	}
 
-	c.JSON(200, gin.H{"data": result})
+	respondData(c, format, 200, gin.H{"groups": groups})
 }
 
 func delete_data(c *gin.Context) {
@@ -334,137 +413,68 @@ func delete_data(c *gin.Context) {
 		return
 	}
 
-	// Parse query parameters
-	start, err := strconv.ParseInt(c.Query("start"), 10, 64)
+	manifest, err := loadManifest(collectionDir)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid start parameter"})
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	end, err := strconv.ParseInt(c.Query("end"), 10, 64)
+	// Parse query parameters
+	start, err := parseTimestamp(c.Query("start"), manifest.Precision)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid end parameter"})
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid start parameter: %v", err)})
 		return
 	}
 
-	// Convert start and end timestamps
-	startTime := time.UnixMilli(start)
-	endTime := time.UnixMilli(end)
-
-	startYear, startDay := startTime.Year(), startTime.YearDay()
-	startSegment := (startTime.Hour() / 6) + 1
+	// Without an end the range runs up to now
+	end, err := parseTimestamp(c.DefaultQuery("end", "now"), manifest.Precision)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid end parameter: %v", err)})
+		return
+	}
 
-	endYear, endDay := endTime.Year(), endTime.YearDay()
-	endSegment := (endTime.Hour() / 6) + 1
+	filter, err := parseTags(c.Query("tags"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid tags parameter: %v", err)})
+		return
+	}
 
-	// Loop through years
-	for year := startYear; year <= endYear; year++ {
-		yearDir := fmt.Sprintf("%s/%d", collectionDir, year)
+	// Without tags every series of the collection is cleared
+	list, err := findSeries(collectionDir, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read series index: %v", err)})
+		return
+	}
 
-		if _, err := os.Stat(yearDir); os.IsNotExist(err) {
-			continue
+	// In append collections a single value of each timestamp can be deleted by its sequence number
+	seq := -1
+	if seqParam := c.Query("seq"); seqParam != "" {
+		seq, err = strconv.Atoi(seqParam)
+		if err != nil || seq < 0 {
+			c.JSON(400, gin.H{"error": "Invalid seq parameter"})
+			return
 		}
+		if len(list) > 0 && !list[0].Append {
+			c.JSON(400, gin.H{"error": "seq can only be used on append collections"})
+			return
+		}
+	}
 
-		// Determine day range
-		dayStart := 1
-		dayEnd := 366
-
-		if year == startYear {
-			dayStart = startDay
+	for _, series := range list {
+		if seq >= 0 {
+			err = deleteSequence(series, start, end, seq)
+		} else {
+			err = deleteRange(series.Dir, series.Precision, start, end)
 		}
-		if year == endYear {
-			dayEnd = endDay
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to delete data: %v", err)})
+			return
 		}
+	}
 
-		for day := dayStart; day <= dayEnd; day++ {
-			dayDir := fmt.Sprintf("%s/%d", yearDir, day)
-
-			if _, err := os.Stat(dayDir); os.IsNotExist(err) {
-				continue
-			}
-
-			files, err := os.ReadDir(dayDir)
-			if err != nil {
-				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read directory: %v", err)})
-				return
-			}
-
-			for _, file := range files {
-				if file.IsDir() {
-					continue
-				}
-
-				segment, err := strconv.Atoi(file.Name()[:len(file.Name())-4])
-				if err != nil {
-					continue
-				}
-
-				filePath := fmt.Sprintf("%s/%s", dayDir, file.Name())
-
-				if (year == startYear && day == startDay && segment < startSegment) ||
-					(year == endYear && day == endDay && segment > endSegment) {
-					continue
-				}
-
-				// Check if the file is already in memory
-				dataMutex.Lock()
-				fileData, exists := inMemoryData[filePath]
-				if !exists {
-					// Load the file into memory
-					file, err := os.Open(filePath)
-					if err != nil {
-						dataMutex.Unlock()
-						c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to open file: %v", err)})
-						return
-					}
-
-					defer file.Close()
-
-					fileData = make(map[int64][]byte)
-					decoder := gob.NewDecoder(file)
-					if err := decoder.Decode(&fileData); err != nil {
-						dataMutex.Unlock()
-						c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to decode file: %v", err)})
-						return
-					}
-					inMemoryData[filePath] = fileData
-				}
-
-				// Remove data inside the range from inMemoryData
-				for ts := range fileData {
-					if ts >= start && ts <= end {
-						delete(fileData, ts)
-					}
-				}
-
-				// Rewrite the file if data remains, otherwise delete the file
-				if len(fileData) > 0 {
-					file, err := os.Create(filePath)
-					if err != nil {
-						dataMutex.Unlock()
-						c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to rewrite file: %v", err)})
-						return
-					}
-					defer file.Close()
-
-					encoder := gob.NewEncoder(file)
-					if err := encoder.Encode(fileData); err != nil {
-						dataMutex.Unlock()
-						c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to encode file: %v", err)})
-						return
-					}
-				} else {
-					if err := os.Remove(filePath); err != nil {
-						dataMutex.Unlock()
-						c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to delete file: %v", err)})
-						return
-					}
-					delete(inMemoryData, filePath) // Remove from inMemoryData
-					delete(lastAccessTimestamps, filePath) // Remove from lastAccessTimestamps
-				}
-				dataMutex.Unlock()
-			}
-		}
+	if err := updateRollupsRange(collectionName, start, end); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to update rollups: %v", err)})
+		return
 	}
 
 	c.JSON(200, gin.H{"message": "Data deleted successfully"})
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// sampledPoint is a point considered by a downsampler
+type sampledPoint struct {
+	Time   int64
+	Seq    int
+	Value  float64
+	Data   interface{}
+	Series seriesInfo
+}
+
+// downsampler reduces a time-ordered stream of points to a bounded number of points
+type downsampler interface {
+	add(point sampledPoint)
+	finish() []sampledPoint
+}
+
+// newDownsampler creates a downsampler for points between first and last
+func newDownsampler(mode string, points int, first, last int64) (downsampler, error) {
+	switch mode {
+	case "lttb":
+		if points < 3 {
+			return nil, fmt.Errorf("lttb needs at least 3 points")
+		}
+		return &lttbSampler{first: first, last: last, buckets: points - 2}, nil
+	case "minmax":
+		if points < 2 {
+			return nil, fmt.Errorf("minmax needs at least 2 points")
+		}
+		return &minMaxSampler{first: first, last: last, buckets: points / 2}, nil
+	}
+	return nil, fmt.Errorf("unknown downsample mode '%s'", mode)
+}
+
+// bucketIndex maps a timestamp to one of n equal time spans between first and last
+func bucketIndex(ts, first, last int64, n int) int {
+	if last <= first {
+		return 0
+	}
+	index := int(float64(ts-first) / float64(last-first) * float64(n))
+	return min(max(index, 0), n-1)
+}
+
+// lttbSampler implements Largest-Triangle-Three-Buckets over time buckets.
+// Only the bucket being decided and the one after it are held in memory.
+type lttbSampler struct {
+	first   int64
+	last    int64
+	buckets int
+
+	started      bool
+	selected     sampledPoint // Last point kept
+	current      []sampledPoint
+	currentIndex int
+	next         []sampledPoint
+	nextIndex    int
+	lastPoint    *sampledPoint
+	result       []sampledPoint
+}
+
+func (s *lttbSampler) add(point sampledPoint) {
+	// The first and last points are always kept
+	if !s.started {
+		s.started = true
+		s.selected = point
+		s.result = append(s.result, point)
+		return
+	}
+	if point.Time == s.last {
+		s.lastPoint = &point
+		return
+	}
+
+	index := bucketIndex(point.Time, s.first, s.last, s.buckets)
+	switch {
+	case len(s.current) == 0 || index == s.currentIndex:
+		s.current = append(s.current, point)
+		s.currentIndex = index
+	case len(s.next) == 0 || index == s.nextIndex:
+		s.next = append(s.next, point)
+		s.nextIndex = index
+	default:
+		// Both buckets are complete, so the current one can be decided
+		s.choose(s.current, average(s.next))
+		s.current, s.currentIndex = s.next, s.nextIndex
+		s.next, s.nextIndex = []sampledPoint{point}, index
+	}
+}
+
+func (s *lttbSampler) finish() []sampledPoint {
+	end := s.selected
+	if s.lastPoint != nil {
+		end = *s.lastPoint
+	}
+
+	if len(s.next) > 0 {
+		s.choose(s.current, average(s.next))
+		s.choose(s.next, end)
+	} else if len(s.current) > 0 {
+		s.choose(s.current, end)
+	}
+
+	if s.lastPoint != nil {
+		s.result = append(s.result, *s.lastPoint)
+	}
+	return s.result
+}
+
+// choose keeps the point of a bucket forming the largest triangle with the previously
+// kept point and the target
+func (s *lttbSampler) choose(bucket []sampledPoint, target sampledPoint) {
+	best, bestArea := 0, -1.0
+	for i, point := range bucket {
+		area := math.Abs(float64(s.selected.Time-target.Time)*(point.Value-s.selected.Value)-
+			float64(s.selected.Time-point.Time)*(target.Value-s.selected.Value)) / 2
+		if area > bestArea {
+			best, bestArea = i, area
+		}
+	}
+	s.selected = bucket[best]
+	s.result = append(s.result, bucket[best])
+}
+
+// average returns the mean time and value of a bucket
+func average(bucket []sampledPoint) sampledPoint {
+	sumTime, sumValue := 0.0, 0.0
+	for _, point := range bucket {
+		sumTime += float64(point.Time)
+		sumValue += point.Value
+	}
+	n := float64(len(bucket))
+	return sampledPoint{Time: int64(sumTime / n), Value: sumValue / n}
+}
+
+// minMaxSampler keeps the lowest and highest point of each time bucket ("pixel")
+type minMaxSampler struct {
+	first   int64
+	last    int64
+	buckets int
+
+	index  int
+	low    *sampledPoint
+	high   *sampledPoint
+	result []sampledPoint
+}
+
+func (s *minMaxSampler) add(point sampledPoint) {
+	index := bucketIndex(point.Time, s.first, s.last, s.buckets)
+	if s.low != nil && index != s.index {
+		s.flush()
+	}
+
+	s.index = index
+	if s.low == nil || point.Value < s.low.Value {
+		s.low = &point
+	}
+	if s.high == nil || point.Value > s.high.Value {
+		s.high = &point
+	}
+}
+
+// flush emits the extremes of the current bucket in time order
+func (s *minMaxSampler) flush() {
+	switch {
+	case s.low.Time == s.high.Time:
+		s.result = append(s.result, *s.low)
+	case s.low.Time < s.high.Time:
+		s.result = append(s.result, *s.low, *s.high)
+	default:
+		s.result = append(s.result, *s.high, *s.low)
+	}
+	s.low, s.high = nil, nil
+}
+
+func (s *minMaxSampler) finish() []sampledPoint {
+	if s.low != nil {
+		s.flush()
+	}
+	return s.result
+}
+
+// downsampleRange streams the numeric field of every series through its own downsampler,
+// so each series keeps up to points points, and merges the selections by time
+func downsampleRange(list []seriesInfo, start, end int64, mode string, points int, path []string, fields [][]string) ([]map[string]interface{}, error) {
+	selected := []sampledPoint{}
+	for _, series := range list {
+		first, last, found, err := seriesBounds([]seriesInfo{series}, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+
+		sampler, err := newDownsampler(mode, points, first, last)
+		if err != nil {
+			return nil, err
+		}
+
+		err = scanSeries([]seriesInfo{series}, start, end, func(series seriesInfo, point dataPoint) error {
+			data := decodeData(point.Data)
+			if value, ok := numericValue(data, path); ok {
+				sampler.add(sampledPoint{Time: point.Time, Seq: point.Seq, Value: value, Data: data, Series: series})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, sampler.finish()...)
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Time < selected[j].Time
+	})
+
+	result := []map[string]interface{}{}
+	for _, point := range selected {
+		stored := dataPoint{Time: point.Time, Seq: point.Seq}
+		result = append(result, seriesPoint(point.Series, stored, projectFields(point.Data, fields)))
+	}
+	return result, nil
+}
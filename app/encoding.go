@@ -0,0 +1,299 @@
+package app
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// binaryMarker starts a stored value that holds opaque bytes instead of JSON. Like
+// appendMarker it cannot begin a JSON document.
+const binaryMarker = 0x1f
+
+// binaryValue is data written as raw bytes, kept with the content type it was sent with
+type binaryValue struct {
+	ContentType string
+	Bytes       []byte
+}
+
+// encodeBinary stores the content type length, the content type and the bytes
+func encodeBinary(value binaryValue) []byte {
+	encoded := make([]byte, 0, 1+binary.MaxVarintLen64+len(value.ContentType)+len(value.Bytes))
+	encoded = append(encoded, binaryMarker)
+	encoded = binary.AppendUvarint(encoded, uint64(len(value.ContentType)))
+	encoded = append(encoded, value.ContentType...)
+	return append(encoded, value.Bytes...)
+}
+
+// decodeBinary reads a value stored by encodeBinary
+func decodeBinary(data []byte) (binaryValue, bool) {
+	if len(data) == 0 || data[0] != binaryMarker {
+		return binaryValue{}, false
+	}
+	length, n := binary.Uvarint(data[1:])
+	if n <= 0 || length > uint64(len(data)-1-n) {
+		return binaryValue{}, false
+	}
+	start := 1 + n
+	return binaryValue{
+		ContentType: string(data[start : start+int(length)]),
+		Bytes:       data[start+int(length):],
+	}, true
+}
+
+// Request and response encodings besides JSON and CSV
+var (
+	msgpackTypes  = []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}
+	cborTypes     = []string{"application/cbor"}
+	protobufTypes = []string{"application/x-protobuf", "application/protobuf"}
+)
+
+// bodyFormat names the encoding of a write request from its Content-Type: msgpack, cbor,
+// protobuf, binary or json
+func bodyFormat(contentType string) string {
+	for _, t := range msgpackTypes {
+		if contentType == t {
+			return "msgpack"
+		}
+	}
+	for _, t := range cborTypes {
+		if contentType == t {
+			return "cbor"
+		}
+	}
+	for _, t := range protobufTypes {
+		if contentType == t {
+			return "protobuf"
+		}
+	}
+	if contentType == "application/octet-stream" {
+		return "binary"
+	}
+	return "json"
+}
+
+// acceptFormat picks msgpack, cbor or protobuf when the Accept header asks for them, json
+// otherwise
+func acceptFormat(c *gin.Context) string {
+	for _, accepted := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if format := bodyFormat(mediaType); format == "msgpack" || format == "cbor" || format == "protobuf" {
+			return format
+		}
+	}
+	return "json"
+}
+
+// respondData writes a response body as JSON, MessagePack or CBOR. Only lists of points
+// have a protobuf form, written by respondPoints, so other bodies fall back to JSON.
+func respondData(c *gin.Context, format string, code int, body interface{}) {
+	switch format {
+	case "msgpack":
+		c.Data(code, msgpackTypes[0], encodeMsgpack(body))
+	case "cbor":
+		c.Data(code, cborTypes[0], encodeCBOR(body))
+	default:
+		c.JSON(code, body)
+	}
+}
+
+// decodeItems reads the items of a MessagePack, CBOR or protobuf write request
+func decodeItems(format string, body []byte) ([]ingestItem, error) {
+	if format == "protobuf" {
+		return decodePoints(body)
+	}
+
+	var value interface{}
+	var err error
+	if format == "cbor" {
+		value, err = decodeCBOR(body)
+	} else {
+		value, err = decodeMsgpack(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return itemsFromValue(value)
+}
+
+// decodePoints reads the items of a Points message of proto/sandb.proto
+func decodePoints(body []byte) ([]ingestItem, error) {
+	items := []ingestItem{}
+	err := readFields(body, func(field, wireType int, r *protoReader) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		encoded, err := r.bytes()
+		if err != nil {
+			return true, err
+		}
+		item, err := decodePoint(encoded)
+		items = append(items, item)
+		return true, err
+	})
+	return items, err
+}
+
+// respondPoints writes response points as a Points message. Numbers are sent as doubles
+// and other data as JSON, like the Query call of the gRPC API.
+func respondPoints(c *gin.Context, points []map[string]interface{}) {
+	w := &protoWriter{}
+	for _, point := range points {
+		ts, _ := point["time"].(int64)
+		tags, _ := point["tags"].(map[string]string)
+		seq, hasSeq := point["seq"].(int)
+		encoded, err := encodePoint(ts, tags, point["data"], seq, hasSeq)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to encode points: %v", err)})
+			return
+		}
+		w.bytes(1, encoded)
+	}
+	c.Data(200, protobufTypes[0], w.buf)
+}
+
+// itemsFromValue turns a decoded array of {time, data, tags} maps into items. Binary data
+// is kept as raw bytes rather than re-encoded as JSON.
+func itemsFromValue(value interface{}) ([]ingestItem, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an array of items")
+	}
+
+	items := make([]ingestItem, len(list))
+	for i, entry := range list {
+		object, ok := entry.(map[string]interface{})
+		if !ok {
+			items[i].errors = []string{"item: expected a map"}
+			continue
+		}
+		item := &items[i]
+
+		// Integers are marshalled exactly, so nanosecond timestamps survive
+		if raw, ok := object["time"]; ok {
+			switch raw.(type) {
+			case int64, uint64, float64, string:
+				item.Time, _ = json.Marshal(raw)
+			default:
+				item.errors = append(item.errors, "time: expected a number or a string")
+			}
+		}
+
+		if raw, ok := object["tags"]; ok && raw != nil {
+			tags, ok := raw.(map[string]interface{})
+			if !ok {
+				item.errors = append(item.errors, "tags: expected a map")
+			}
+			item.Tags = map[string]string{}
+			for key, tag := range tags {
+				text, ok := tag.(string)
+				if !ok {
+					item.errors = append(item.errors, fmt.Sprintf("tags: value of %q must be a string", key))
+					continue
+				}
+				item.Tags[key] = text
+			}
+		}
+
+		if raw, ok := object["data"].([]byte); ok {
+			item.Data = binaryValue{ContentType: "application/octet-stream", Bytes: raw}
+		} else {
+			item.Data = jsonValue(object["data"])
+		}
+	}
+	return items, nil
+}
+
+// jsonValue converts decoded integers to float64, as encoding/json would have read them
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = jsonValue(v[key])
+		}
+	}
+	return value
+}
+
+// plainValue reduces a response value to nil, bool, int64, uint64, float64, string,
+// []byte, []interface{} and map[string]interface{} for the binary encoders
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, int64, uint64, float64, string:
+		return v
+	case json.RawMessage:
+		var decoded interface{}
+		if json.Unmarshal(v, &decoded) != nil {
+			return string(v)
+		}
+		return plainValue(decoded)
+	case []byte:
+		return v
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = plainValue(v[i])
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[key] = plainValue(item)
+		}
+		return object
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return plainValue(rv.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = plainValue(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			object := make(map[string]interface{}, rv.Len())
+			iter := rv.MapRange()
+			for iter.Next() {
+				object[iter.Key().String()] = plainValue(iter.Value().Interface())
+			}
+			return object
+		}
+	}
+
+	// Structs and anything else take the shape of their JSON encoding
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return plainValue(json.RawMessage(encoded))
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pointsMessage wraps encoded points in a Points message
+func pointsMessage(points ...[]byte) []byte {
+	w := &protoWriter{}
+	for _, point := range points {
+		w.bytes(1, point)
+	}
+	return w.buf
+}
+
+func TestDecodeProtobufItems(t *testing.T) {
+	number, _ := encodePoint(1000, map[string]string{"room": "a"}, 21.5, 0, false)
+	object, _ := encodePoint(2000, nil, map[string]interface{}{"on": true}, 0, false)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []ingestItem
+		wantErr bool
+	}{
+		{
+			name:  "points",
+			input: pointsMessage(number, object),
+			want: []ingestItem{
+				{Time: []byte("1000"), Data: 21.5, Tags: map[string]string{"room": "a"}},
+				{Time: []byte("2000"), Data: map[string]interface{}{"on": true}},
+			},
+		},
+		{name: "empty message", input: []byte{}, want: []ingestItem{}},
+		{name: "unknown fields are skipped", input: append([]byte{0x10, 0x01}, pointsMessage(number)...), want: []ingestItem{
+			{Time: []byte("1000"), Data: 21.5, Tags: map[string]string{"room": "a"}},
+		}},
+		{name: "truncated message", input: pointsMessage(number)[:6], wantErr: true},
+		{name: "broken point", input: pointsMessage([]byte{0x22, 0x05}), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeItems("protobuf", test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+			for i := range got {
+				if string(got[i].Time) != string(test.want[i].Time) || !reflect.DeepEqual(got[i].Data, test.want[i].Data) ||
+					len(got[i].errors) > 0 || (len(test.want[i].Tags) > 0 && !reflect.DeepEqual(got[i].Tags, test.want[i].Tags)) {
+					t.Fatalf("got %+v, want %+v", got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRespondPoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+
+	respondPoints(c, []map[string]interface{}{
+		{"time": int64(1000), "data": 21.5, "tags": map[string]string{"room": "a"}},
+		{"time": int64(2000), "data": "text", "seq": 3},
+	})
+
+	if got := recorder.Header().Get("Content-Type"); got != "application/x-protobuf" {
+		t.Fatalf("got content type %q", got)
+	}
+	number, _ := encodePoint(1000, map[string]string{"room": "a"}, 21.5, 0, false)
+	text, _ := encodePoint(2000, nil, "text", 3, true)
+	if want := pointsMessage(number, text); !reflect.DeepEqual(recorder.Body.Bytes(), want) {
+		t.Fatalf("got % x, want % x", recorder.Body.Bytes(), want)
+	}
+}
+
+func TestBodyFormat(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{contentType: "application/msgpack", want: "msgpack"},
+		{contentType: "application/x-msgpack", want: "msgpack"},
+		{contentType: "application/cbor", want: "cbor"},
+		{contentType: "application/x-protobuf", want: "protobuf"},
+		{contentType: "application/protobuf", want: "protobuf"},
+		{contentType: "application/octet-stream", want: "binary"},
+		{contentType: "application/json", want: "json"},
+		{contentType: "", want: "json"},
+	}
+
+	for _, test := range tests {
+		if got := bodyFormat(test.contentType); got != test.want {
+			t.Errorf("bodyFormat(%q) = %q, want %q", test.contentType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,681 @@
+package app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcAlreadyExists     = 6
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+const (
+	grpcMaxMessage = 16 * 1024 * 1024 // Largest request message
+	grpcFlushEvery = 1000             // Streamed messages between flushes
+)
+
+// grpcError is a failed call with its status code
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// grpcStream reads the request messages and writes the response messages of a call
+type grpcStream struct {
+	reader     *bufio.Reader
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+	sent       int
+}
+
+// recv reads the next request message, or returns io.EOF once the client is done
+func (s *grpcStream) recv() ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, grpcErrorf(grpcInvalidArgument, "Failed to read message: %v", err)
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "Compressed messages are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "Message of %d bytes exceeds the limit of %d", length, grpcMaxMessage)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, message); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "Failed to read message: %v", err)
+	}
+	return message, nil
+}
+
+// recvOne reads the single request message of a unary or server-streaming call
+func (s *grpcStream) recvOne() ([]byte, error) {
+	message, err := s.recv()
+	if err == io.EOF {
+		return nil, grpcErrorf(grpcInvalidArgument, "Missing request message")
+	}
+	return message, err
+}
+
+func (s *grpcStream) send(message []byte) error {
+	// The status follows the messages as trailers
+	if s.sent == 0 {
+		s.writer.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	}
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	if _, err := s.writer.Write(append(frame, message...)); err != nil {
+		return err
+	}
+
+	// Streamed messages reach the client in batches
+	s.sent++
+	if s.sent%grpcFlushEvery == 0 {
+		return s.controller.Flush()
+	}
+	return nil
+}
+
+// grpcMethods maps the full method names of proto/sandb.proto to their handlers
+var grpcMethods = map[string]func(stream *grpcStream) error{
+	"/sandb.v1.SanDB/ListCollections":  grpc_list_collections,
+	"/sandb.v1.SanDB/GetCollection":    grpc_get_collection,
+	"/sandb.v1.SanDB/CreateCollection": grpc_create_collection,
+	"/sandb.v1.SanDB/DeleteCollection": grpc_delete_collection,
+	"/sandb.v1.SanDB/Write":            grpc_write,
+	"/sandb.v1.SanDB/Query":            grpc_query,
+	"/sandb.v1.SanDB/Aggregate":        grpc_aggregate,
+}
+
+// newGRPCServer serves the gRPC API over cleartext HTTP/2. Streams can run for long, so
+// only idle connections time out.
+func newGRPCServer(addr string) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Addr:        addr,
+		Handler:     http.HandlerFunc(serveGRPC),
+		Protocols:   protocols,
+		IdleTimeout: time.Duration(AppConfig.Server.Timeout.IdleTimeout) * time.Second,
+	}
+}
+
+// serveGRPC dispatches a gRPC call and reports its status in the trailers, or in the
+// headers of a call that sent no message
+func serveGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	stream := &grpcStream{reader: bufio.NewReader(r.Body), writer: w, controller: http.NewResponseController(w)}
+
+	err := func() error {
+		// Same token as the HTTP API
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != AppConfig.Server.Token {
+			return grpcErrorf(grpcUnauthenticated, "Unauthorized")
+		}
+
+		method, exists := grpcMethods[r.URL.Path]
+		if !exists {
+			return grpcErrorf(grpcUnimplemented, "Unknown method %s", r.URL.Path)
+		}
+		return method(stream)
+	}()
+
+	status, message := grpcOK, ""
+	if err != nil {
+		status, message = grpcInternal, err.Error()
+		var callErr *grpcError
+		if errors.As(err, &callErr) {
+			status = callErr.code
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(message))
+	}
+}
+
+// grpcEscape percent-encodes a status message as the gRPC protocol requires
+func grpcEscape(message string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(message); i++ {
+		if ch := message[i]; ch < 0x20 || ch > 0x7e || ch == '%' {
+			fmt.Fprintf(&escaped, "%%%02X", ch)
+		} else {
+			escaped.WriteByte(ch)
+		}
+	}
+	return escaped.String()
+}
+
+// grpcCollection checks that a collection named in a request exists and loads its settings
+func grpcCollection(collectionName string) (string, collectionManifest, error) {
+	dataPath := "./data" // Base directory for data
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+
+	if !validCollectionName(collectionName) {
+		return "", collectionManifest{}, grpcErrorf(grpcInvalidArgument, "Invalid collection name '%s'", collectionName)
+	}
+	if info, err := os.Stat(collectionDir); err != nil || !info.IsDir() {
+		return "", collectionManifest{}, grpcErrorf(grpcNotFound, "Collection '%s' does not exist", collectionName)
+	}
+	manifest, err := loadManifest(collectionDir)
+	return collectionDir, manifest, err
+}
+
+// decodeName reads the name field of the collection requests
+func decodeName(buf []byte) (string, error) {
+	name := ""
+	err := readFields(buf, func(field, wireType int, r *protoReader) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		text, err := r.bytes()
+		name = string(text)
+		return true, err
+	})
+	return name, err
+}
+
+func encodeCollection(collectionName string, manifest collectionManifest) []byte {
+	w := &protoWriter{}
+	w.bytes(1, []byte(collectionName))
+	w.bytes(2, []byte(manifest.WriteMode))
+	w.bytes(3, []byte(manifest.Precision))
+	return w.buf
+}
+
+// decodePoint reads a Point into an item for ingestion. Problems with the data are
+// reported with the item, like the rows of a CSV import.
+func decodePoint(buf []byte) (ingestItem, error) {
+	item := ingestItem{Time: []byte("0")}
+	err := readFields(buf, func(field, wireType int, r *protoReader) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoVarint:
+			ts, err := r.varint()
+			item.Time = []byte(strconv.FormatInt(int64(ts), 10))
+			return true, err
+
+		case field == 2 && wireType == protoBytes:
+			entry, err := r.bytes()
+			if err != nil {
+				return true, err
+			}
+			key, value, err := decodeLabel(entry)
+			if item.Tags == nil {
+				item.Tags = map[string]string{}
+			}
+			item.Tags[key] = value
+			return true, err
+
+		case field == 3 && wireType == protoFixed64:
+			value, err := r.double()
+			item.Data = value
+			return true, err
+
+		case field == 4 && wireType == protoBytes:
+			raw, err := r.bytes()
+			if err == nil && json.Unmarshal(raw, &item.Data) != nil {
+				item.errors = append(item.errors, "data: invalid JSON")
+			}
+			return true, err
+		}
+		return false, nil
+	})
+	return item, err
+}
+
+// encodePoint writes a Point; numbers are sent as doubles and other values as JSON
+func encodePoint(ts int64, tags map[string]string, data interface{}, seq int, hasSeq bool) ([]byte, error) {
+	w := &protoWriter{}
+	w.varint(1, uint64(ts))
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := &protoWriter{}
+		entry.bytes(1, []byte(key))
+		entry.bytes(2, []byte(tags[key]))
+		w.bytes(2, entry.buf)
+	}
+
+	if number, ok := data.(float64); ok {
+		w.double(3, number)
+	} else {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		w.bytes(4, raw)
+	}
+
+	if hasSeq {
+		w.varint(5, uint64(seq))
+	}
+	return w.buf, nil
+}
+
+// grpcRange holds the fields shared by QueryRequest and AggregateRequest
+type grpcRange struct {
+	Collection string
+	Start      string
+	End        string
+	Tags       map[string]string
+}
+
+// read handles the QueryRequest and AggregateRequest fields 1 to 4
+func (q *grpcRange) read(field, wireType int, r *protoReader) (bool, error) {
+	if field < 1 || field > 4 || wireType != protoBytes {
+		return false, nil
+	}
+	text, err := r.bytes()
+	if err != nil {
+		return true, err
+	}
+	switch field {
+	case 1:
+		q.Collection = string(text)
+	case 2:
+		q.Start = string(text)
+	case 3:
+		q.End = string(text)
+	case 4:
+		key, value, err := decodeLabel(text)
+		if q.Tags == nil {
+			q.Tags = map[string]string{}
+		}
+		q.Tags[key] = value
+		return true, err
+	}
+	return true, nil
+}
+
+// resolve checks the collection of a range and parses its bounds in the collection precision
+func (q *grpcRange) resolve() (string, collectionManifest, int64, int64, error) {
+	collectionDir, manifest, err := grpcCollection(q.Collection)
+	if err != nil {
+		return "", manifest, 0, 0, err
+	}
+
+	start, err := parseTimestamp(q.Start, manifest.Precision)
+	if err != nil {
+		return "", manifest, 0, 0, grpcErrorf(grpcInvalidArgument, "Invalid start: %v", err)
+	}
+
+	// Without an end the range runs up to now
+	if q.End == "" {
+		q.End = "now"
+	}
+	end, err := parseTimestamp(q.End, manifest.Precision)
+	if err != nil {
+		return "", manifest, 0, 0, grpcErrorf(grpcInvalidArgument, "Invalid end: %v", err)
+	}
+
+	if err := validateTags(q.Tags); err != nil {
+		return "", manifest, 0, 0, grpcErrorf(grpcInvalidArgument, "Invalid tags: %v", err)
+	}
+	return collectionDir, manifest, start, end, nil
+}
+
+func grpc_list_collections(stream *grpcStream) error {
+	if _, err := stream.recvOne(); err != nil {
+		return err
+	}
+
+	collections, err := listCollections()
+	if err != nil {
+		return fmt.Errorf("Failed to read data directory: %v", err)
+	}
+
+	w := &protoWriter{}
+	for _, collectionName := range collections {
+		w.bytes(1, []byte(collectionName))
+	}
+	return stream.send(w.buf)
+}
+
+func grpc_get_collection(stream *grpcStream) error {
+	message, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+	collectionName, err := decodeName(message)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Invalid request: %v", err)
+	}
+
+	_, manifest, err := grpcCollection(collectionName)
+	if err != nil {
+		return err
+	}
+	return stream.send(encodeCollection(collectionName, manifest))
+}
+
+func grpc_create_collection(stream *grpcStream) error {
+	message, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+
+	collectionName := ""
+	manifest := collectionManifest{}
+	err = readFields(message, func(field, wireType int, r *protoReader) (bool, error) {
+		if field < 1 || field > 3 || wireType != protoBytes {
+			return false, nil
+		}
+		text, err := r.bytes()
+		switch field {
+		case 1:
+			collectionName = string(text)
+		case 2:
+			manifest.WriteMode = string(text)
+		case 3:
+			manifest.Precision = string(text)
+		}
+		return true, err
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Invalid request: %v", err)
+	}
+
+	if !validCollectionName(collectionName) {
+		return grpcErrorf(grpcInvalidArgument, "Invalid collection name '%s'", collectionName)
+	}
+	if err := validateManifest(&manifest); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	created, err := createCollection(collectionName, manifest)
+	if err != nil {
+		return err
+	}
+
+	// An existing collection keeps its own settings
+	_, manifest, err = grpcCollection(collectionName)
+	if err != nil {
+		return err
+	}
+
+	w := &protoWriter{}
+	w.bytes(1, encodeCollection(collectionName, manifest))
+	if created {
+		w.varint(2, 1)
+	}
+	return stream.send(w.buf)
+}
+
+func grpc_delete_collection(stream *grpcStream) error {
+	message, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+	collectionName, err := decodeName(message)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Invalid request: %v", err)
+	}
+
+	if _, _, err := grpcCollection(collectionName); err != nil {
+		return err
+	}
+	if err := removeCollection(collectionName); err != nil {
+		return err
+	}
+	return stream.send(nil)
+}
+
+// grpc_write ingests every message of the stream as it arrives, as one batch. Without
+// partial a rejected point fails the call, leaving its message unwritten and the earlier
+// messages written.
+func grpc_write(stream *grpcStream) error {
+	collectionName := ""
+	accepted, total := 0, 0
+	failures := &protoWriter{} // PointErrors of partial messages
+	rejected := 0
+
+	for number := 1; ; number++ {
+		message, err := stream.recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		items := []ingestItem{}
+		partial := false
+		err = readFields(message, func(field, wireType int, r *protoReader) (bool, error) {
+			switch {
+			case field == 1 && wireType == protoBytes:
+				text, err := r.bytes()
+				if len(text) > 0 {
+					collectionName = string(text)
+				}
+				return true, err
+
+			case field == 2 && wireType == protoBytes:
+				encoded, err := r.bytes()
+				if err != nil {
+					return true, err
+				}
+				item, err := decodePoint(encoded)
+				items = append(items, item)
+				return true, err
+
+			case field == 3 && wireType == protoVarint:
+				value, err := r.varint()
+				partial = value != 0
+				return true, err
+			}
+			return false, nil
+		})
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "Invalid message %d: %v", number, err)
+		}
+
+		if collectionName == "" {
+			return grpcErrorf(grpcInvalidArgument, "The first message must name a collection")
+		}
+		if _, _, err := grpcCollection(collectionName); err != nil {
+			return err
+		}
+
+		result, err := ingest(collectionName, items, partial)
+		if err != nil {
+			return err
+		}
+
+		if len(result.Failures) > 0 && !partial {
+			code := grpcInvalidArgument
+			if result.Conflict {
+				code = grpcAlreadyExists
+			}
+			failure := result.Failures[0]
+			return grpcErrorf(code, "Message %d: %d point(s) were rejected, nothing of it was written; point %d: %s",
+				number, len(result.Failures), failure.Index, strings.Join(failure.Errors, "; "))
+		}
+
+		for _, failure := range result.Failures {
+			entry := &protoWriter{}
+			entry.varint(1, uint64(total+failure.Index))
+			entry.bytes(2, []byte(collectionName))
+			for _, problem := range failure.Errors {
+				entry.bytes(3, []byte(problem))
+			}
+			failures.bytes(3, entry.buf)
+		}
+		accepted += len(result.Accepted)
+		rejected += len(result.Failures)
+		total += len(items)
+	}
+
+	w := &protoWriter{}
+	w.varint(1, uint64(accepted))
+	w.varint(2, uint64(rejected))
+	return stream.send(append(w.buf, failures.buf...))
+}
+
+// grpc_query streams the points of a range in time order without holding it in memory
+func grpc_query(stream *grpcStream) error {
+	message, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+
+	request := grpcRange{}
+	fieldList := []string{}
+	limit := int64(0)
+	err = readFields(message, func(field, wireType int, r *protoReader) (bool, error) {
+		switch {
+		case field == 5 && wireType == protoBytes:
+			text, err := r.bytes()
+			fieldList = append(fieldList, string(text))
+			return true, err
+		case field == 6 && wireType == protoVarint:
+			value, err := r.varint()
+			limit = int64(value)
+			return true, err
+		}
+		return request.read(field, wireType, r)
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Invalid request: %v", err)
+	}
+
+	collectionDir, _, start, end, err := request.resolve()
+	if err != nil {
+		return err
+	}
+
+	list, err := findSeries(collectionDir, request.Tags)
+	if err != nil {
+		return fmt.Errorf("Failed to read series index: %v", err)
+	}
+
+	fields := parseFields(strings.Join(fieldList, ","))
+	sent := int64(0)
+	err = scanSeries(list, start, end, func(series seriesInfo, point dataPoint) error {
+		if limit > 0 && sent >= limit {
+			return errStopScan
+		}
+		encoded, err := encodePoint(point.Time, series.Tags, projectFields(decodeData(point.Data), fields), point.Seq, series.Append)
+		if err != nil {
+			return err
+		}
+		sent++
+		return stream.send(encoded)
+	})
+	if err != nil && err != errStopScan {
+		return err
+	}
+	return nil
+}
+
+// grpc_aggregate buckets a numeric field like the resample parameter of GET /data
+func grpc_aggregate(stream *grpcStream) error {
+	message, err := stream.recvOne()
+	if err != nil {
+		return err
+	}
+
+	request := grpcRange{}
+	spec := aggregateSpec{}
+	err = readFields(message, func(field, wireType int, r *protoReader) (bool, error) {
+		switch {
+		case field >= 5 && field <= 8 && wireType == protoBytes:
+			text, err := r.bytes()
+			switch field {
+			case 5:
+				spec.Function = string(text)
+			case 6:
+				spec.Field = string(text)
+			case 7:
+				spec.Interval = string(text)
+			case 8:
+				spec.Fill = string(text)
+			}
+			return true, err
+		case field == 9 && wireType == protoFixed64:
+			value, err := r.double()
+			spec.Percentile = value
+			return true, err
+		case field == 10:
+			values, err := r.doubles(wireType, spec.Buckets)
+			spec.Buckets = values
+			return true, err
+		}
+		return request.read(field, wireType, r)
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Invalid request: %v", err)
+	}
+
+	collectionDir, manifest, start, end, err := request.resolve()
+	if err != nil {
+		return err
+	}
+	if err := validateAggregate(spec, manifest.Precision, start, end); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Invalid aggregate: %v", err)
+	}
+
+	// The whole collection may be answered from a rollup
+	var result []map[string]interface{}
+	if len(request.Tags) == 0 {
+		result, err = aggregateRange(collectionDir, start, end, spec)
+	} else {
+		var list []seriesInfo
+		if list, err = findSeries(collectionDir, request.Tags); err == nil {
+			result, err = aggregateSeries(list, manifest.Precision, start, end, spec)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to aggregate data: %v", err)
+	}
+
+	w := &protoWriter{}
+	for _, bucket := range result {
+		ts, _ := bucket["time"].(int64)
+		encoded, err := encodePoint(ts, nil, bucket["data"], 0, false)
+		if err != nil {
+			return err
+		}
+		w.bytes(1, encoded)
+	}
+	return stream.send(w.buf)
+}
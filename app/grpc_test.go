@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// grpcFrame prefixes a message with the uncompressed flag and its length
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// grpcFrames splits a response body into its messages
+func grpcFrames(t *testing.T, body []byte) [][]byte {
+	t.Helper()
+	messages := [][]byte{}
+	for len(body) > 0 {
+		if len(body) < 5 || body[0] != 0 {
+			t.Fatalf("invalid frame header % x", body)
+		}
+		length := int(binary.BigEndian.Uint32(body[1:5]))
+		if len(body) < 5+length {
+			t.Fatalf("truncated frame of %d bytes", length)
+		}
+		messages = append(messages, body[5:5+length])
+		body = body[5+length:]
+	}
+	return messages
+}
+
+// grpcResponse is a finished call: its messages and the status from the trailers, or from
+// the headers when no message was sent
+type grpcResponse struct {
+	messages [][]byte
+	status   string
+	message  string
+	trailers bool // The status came in trailers
+}
+
+// callGRPC makes a call over cleartext HTTP/2 with the configured token
+func callGRPC(t *testing.T, server *httptest.Server, method string, body []byte, token string) grpcResponse {
+	t.Helper()
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	request, err := http.NewRequest("POST", server.URL+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Fatalf("got HTTP/%d, want HTTP/2", response.ProtoMajor)
+	}
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := grpcResponse{messages: grpcFrames(t, content)}
+	if status := response.Trailer.Get("Grpc-Status"); status != "" {
+		result.status, result.message, result.trailers = status, response.Trailer.Get("Grpc-Message"), true
+		if response.Header.Get("Grpc-Status") != "" {
+			t.Fatalf("status sent in both headers and trailers")
+		}
+	} else {
+		result.status, result.message = response.Header.Get("Grpc-Status"), response.Header.Get("Grpc-Message")
+	}
+	return result
+}
+
+func newTestGRPCServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(serveGRPC))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// nameRequest encodes the requests carrying only a collection name
+func nameRequest(name string) []byte {
+	w := &protoWriter{}
+	w.bytes(1, []byte(name))
+	return w.buf
+}
+
+func TestGRPCStatus(t *testing.T) {
+	useDataDir(t)
+	server := newTestGRPCServer(t)
+	token := AppConfig.Server.Token
+
+	oversized := make([]byte, 5)
+	binary.BigEndian.PutUint32(oversized[1:], grpcMaxMessage+1)
+
+	tests := []struct {
+		name     string
+		method   string
+		body     []byte
+		token    string
+		messages int
+		status   string
+		message  string
+		trailers bool
+	}{
+		{name: "unary call", method: "/sandb.v1.SanDB/ListCollections", body: grpcFrame(nil), token: token, messages: 1, status: "0", trailers: true},
+		{name: "wrong token", method: "/sandb.v1.SanDB/ListCollections", body: grpcFrame(nil), token: "wrong", status: "16", message: "Unauthorized"},
+		{name: "unknown method", method: "/sandb.v1.SanDB/Drop", body: grpcFrame(nil), token: token, status: "12", message: "Unknown method /sandb.v1.SanDB/Drop"},
+		{name: "missing message", method: "/sandb.v1.SanDB/ListCollections", token: token, status: "3", message: "Missing request message"},
+		{name: "compressed message", method: "/sandb.v1.SanDB/ListCollections", body: []byte{1, 0, 0, 0, 0}, token: token, status: "12", message: "Compressed messages are not supported"},
+		{name: "oversized message", method: "/sandb.v1.SanDB/ListCollections", body: oversized, token: token, status: "8"},
+		{name: "truncated message", method: "/sandb.v1.SanDB/GetCollection", body: grpcFrame(nameRequest("sensors"))[:8], token: token, status: "3"},
+		{name: "missing collection", method: "/sandb.v1.SanDB/GetCollection", body: grpcFrame(nameRequest("sensors")), token: token, status: "5", message: "Collection 'sensors' does not exist"},
+		{name: "escaped message", method: "/sandb.v1.SanDB/GetCollection", body: grpcFrame(nameRequest("100%é")), token: token, status: "5", message: "Collection '100%25%C3%A9' does not exist"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := callGRPC(t, server, test.method, test.body, test.token)
+			if len(got.messages) != test.messages || got.status != test.status || got.trailers != test.trailers {
+				t.Fatalf("got %d message(s), status %s (trailers %v), want %d, %s (trailers %v)",
+					len(got.messages), got.status, got.trailers, test.messages, test.status, test.trailers)
+			}
+			if test.message != "" && got.message != test.message {
+				t.Fatalf("got message %q, want %q", got.message, test.message)
+			}
+		})
+	}
+}
+
+func TestGRPCWriteAndQuery(t *testing.T) {
+	useDataDir(t)
+	server := newTestGRPCServer(t)
+	token := AppConfig.Server.Token
+
+	create := &protoWriter{}
+	create.bytes(1, []byte("sensors"))
+	create.bytes(3, []byte("s"))
+	if got := callGRPC(t, server, "/sandb.v1.SanDB/CreateCollection", grpcFrame(create.buf), token); got.status != "0" {
+		t.Fatalf("create failed with status %s: %s", got.status, got.message)
+	}
+
+	// A stream of two messages; only the first names the collection
+	stream := []byte{}
+	for i, data := range []interface{}{21.5, map[string]interface{}{"on": true}} {
+		point, err := encodePoint(int64(100+i), map[string]string{"room": "a"}, data, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := &protoWriter{}
+		if i == 0 {
+			message.bytes(1, []byte("sensors"))
+		}
+		message.bytes(2, point)
+		stream = append(stream, grpcFrame(message.buf)...)
+	}
+
+	got := callGRPC(t, server, "/sandb.v1.SanDB/Write", stream, token)
+	if got.status != "0" || len(got.messages) != 1 {
+		t.Fatalf("write failed with status %s: %s", got.status, got.message)
+	}
+	response := &protoWriter{}
+	response.varint(1, 2)
+	response.varint(2, 0)
+	if !bytes.Equal(got.messages[0], response.buf) {
+		t.Fatalf("got write response % x, want % x", got.messages[0], response.buf)
+	}
+
+	query := &protoWriter{}
+	query.bytes(1, []byte("sensors"))
+	query.bytes(2, []byte("0"))
+	query.bytes(3, []byte("1000"))
+	got = callGRPC(t, server, "/sandb.v1.SanDB/Query", grpcFrame(query.buf), token)
+	if got.status != "0" || !got.trailers {
+		t.Fatalf("query failed with status %s: %s", got.status, got.message)
+	}
+
+	want := [][]byte{}
+	for i, data := range []interface{}{21.5, map[string]interface{}{"on": true}} {
+		point, _ := encodePoint(int64(100+i), map[string]string{"room": "a"}, data, 0, false)
+		want = append(want, point)
+	}
+	if !reflect.DeepEqual(got.messages, want) {
+		t.Fatalf("got points % x, want % x", got.messages, want)
+	}
+
+	// A stream without a collection fails before anything is written
+	message := &protoWriter{}
+	point, _ := encodePoint(200, nil, 1.0, 0, false)
+	message.bytes(2, point)
+	if got := callGRPC(t, server, "/sandb.v1.SanDB/Write", grpcFrame(message.buf), token); got.status != "3" {
+		t.Fatalf("got status %s, want 3", got.status)
+	}
+}
+
+func TestDecodePoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    interface{}
+		tags    map[string]string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "number", data: 1.5, want: 1.5},
+		{name: "object", data: map[string]interface{}{"a": "b"}, tags: map[string]string{"x": "y"}, want: map[string]interface{}{"a": "b"}},
+		{name: "string", data: "text", want: "text"},
+		{name: "null", data: nil, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := encodePoint(42, test.tags, test.data, 0, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			item, err := decodePoint(encoded)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(item.Time) != "42" || !reflect.DeepEqual(item.Data, test.want) || len(item.errors) > 0 {
+				t.Fatalf("got %+v", item)
+			}
+			if len(test.tags) > 0 && !reflect.DeepEqual(item.Tags, test.tags) {
+				t.Fatalf("got tags %v, want %v", item.Tags, test.tags)
+			}
+		})
+	}
+
+	// Invalid JSON data is reported with the point, a broken message fails
+	invalid := &protoWriter{}
+	invalid.bytes(4, []byte("{"))
+	if item, err := decodePoint(invalid.buf); err != nil || len(item.errors) != 1 {
+		t.Fatalf("got %+v, %v", item, err)
+	}
+	if _, err := decodePoint([]byte{0x22, 0x05, 'x'}); err == nil {
+		t.Fatalf("expected an error for a truncated point")
+	}
+}
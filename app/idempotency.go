@@ -0,0 +1,231 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotentResponse is the response remembered for an Idempotency-Key
+type idempotentResponse struct {
+	Fingerprint string          `json:"fingerprint"` // Hash of the request the key was first used with
+	Status      int             `json:"status"`
+	Body        json.RawMessage `json:"body"`
+	Expires     int64           `json:"expires"` // Unix seconds
+}
+
+// idempotencyRecord is one line of the key log
+type idempotencyRecord struct {
+	ID string `json:"id"` // Collection and key
+	idempotentResponse
+}
+
+var (
+	idempotencyKeys    map[string]idempotentResponse // Collection and key -> response, loaded on first use
+	idempotencyPending = map[string]bool{}           // Keys of requests still being applied
+	idempotencyLog     *os.File                      // Log the keys are appended to, open once loaded
+	idempotencyRecords int                           // Records in the log, including replaced and expired ones
+	idempotencyMutex   sync.Mutex                    // Guards the keys and their log
+)
+
+const idempotencyFile = "./data/.idempotency.log"
+
+// idempotencyWindow is how long a key is remembered, a day unless configured
+func idempotencyWindow() time.Duration {
+	if AppConfig.Idempotency.Window > 0 {
+		return time.Duration(AppConfig.Idempotency.Window) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+// loadIdempotencyLocked reads the live keys from the log and opens it for appending
+func loadIdempotencyLocked() error {
+	if idempotencyKeys != nil {
+		return nil
+	}
+
+	keys := map[string]idempotentResponse{}
+	records := 0
+	file, err := os.Open(idempotencyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read idempotency keys: %w", err)
+	}
+	if err == nil {
+		defer file.Close()
+		now := time.Now().Unix()
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				records++
+				// A record cut short by a crash is skipped, its write was never acknowledged
+				var record idempotencyRecord
+				if json.Unmarshal(line, &record) == nil && record.Expires > now {
+					keys[record.ID] = record.idempotentResponse
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read idempotency keys: %w", err)
+			}
+		}
+	}
+
+	log, err := os.OpenFile(idempotencyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open idempotency keys: %w", err)
+	}
+	idempotencyKeys, idempotencyLog, idempotencyRecords = keys, log, records
+	return nil
+}
+
+// appendIdempotencyLocked remembers the response of a key and appends it to the log
+func appendIdempotencyLocked(id string, response idempotentResponse) error {
+	idempotencyKeys[id] = response
+
+	line, err := json.Marshal(idempotencyRecord{ID: id, idempotentResponse: response})
+	if err != nil {
+		return fmt.Errorf("failed to encode idempotency key: %w", err)
+	}
+	if _, err := idempotencyLog.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to save idempotency key: %w", err)
+	}
+	idempotencyRecords++
+	return nil
+}
+
+// StartIdempotencyExpiry forgets expired keys every minute
+func StartIdempotencyExpiry() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := expireIdempotencyKeys(); err != nil {
+			fmt.Printf("Failed to expire idempotency keys: %v\n", err)
+		}
+	}
+}
+
+// expireIdempotencyKeys drops the expired keys, and rewrites the log with the live ones once
+// most of its records are stale
+func expireIdempotencyKeys() error {
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	if idempotencyKeys == nil {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	for id, response := range idempotencyKeys {
+		if response.Expires <= now {
+			delete(idempotencyKeys, id)
+		}
+	}
+	if idempotencyRecords <= 2*len(idempotencyKeys) {
+		return nil
+	}
+
+	content := []byte{}
+	for id, response := range idempotencyKeys {
+		line, err := json.Marshal(idempotencyRecord{ID: id, idempotentResponse: response})
+		if err != nil {
+			return fmt.Errorf("failed to encode idempotency key: %w", err)
+		}
+		content = append(append(content, line...), '\n')
+	}
+	if err := os.WriteFile(idempotencyFile+".tmp", content, 0644); err != nil {
+		return fmt.Errorf("failed to compact idempotency keys: %w", err)
+	}
+	if err := os.Rename(idempotencyFile+".tmp", idempotencyFile); err != nil {
+		return fmt.Errorf("failed to compact idempotency keys: %w", err)
+	}
+
+	// Later records go to the new file
+	log, err := os.OpenFile(idempotencyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open idempotency keys: %w", err)
+	}
+	idempotencyLog.Close()
+	idempotencyLog, idempotencyRecords = log, len(idempotencyKeys)
+	return nil
+}
+
+// idempotent runs a write once per Idempotency-Key header. A retry with the same key and
+// request gets the original response replayed; without the header the write always runs.
+// Server errors are not remembered, so they can be retried.
+func idempotent(c *gin.Context, collectionName string, request []byte, apply func() (int, interface{})) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		code, body := apply()
+		c.JSON(code, body)
+		return
+	}
+	if len(key) > 255 {
+		c.JSON(400, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+		return
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "?" + c.Request.URL.RawQuery + "\n"))
+	hash.Write(request)
+	fingerprint := hex.EncodeToString(hash.Sum(nil))
+	id := collectionName + "/" + key
+
+	idempotencyMutex.Lock()
+	if err := loadIdempotencyLocked(); err != nil {
+		idempotencyMutex.Unlock()
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if response, exists := idempotencyKeys[id]; exists && response.Expires > time.Now().Unix() {
+		idempotencyMutex.Unlock()
+		if response.Fingerprint != fingerprint {
+			c.JSON(422, gin.H{"error": "Idempotency-Key was already used with a different request"})
+			return
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(response.Status, "application/json; charset=utf-8", response.Body)
+		return
+	}
+	if idempotencyPending[id] {
+		idempotencyMutex.Unlock()
+		c.JSON(409, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+		return
+	}
+	idempotencyPending[id] = true
+	idempotencyMutex.Unlock()
+
+	code, body := apply()
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		code, encoded = 500, []byte(`{"error":"Failed to encode response"}`)
+	}
+
+	idempotencyMutex.Lock()
+	delete(idempotencyPending, id)
+	if code < 500 {
+		response := idempotentResponse{
+			Fingerprint: fingerprint,
+			Status:      code,
+			Body:        encoded,
+			Expires:     time.Now().Add(idempotencyWindow()).Unix(),
+		}
+		if err := appendIdempotencyLocked(id, response); err != nil {
+			fmt.Printf("Failed to save idempotency key: %v\n", err)
+		}
+	}
+	idempotencyMutex.Unlock()
+
+	c.Data(code, "application/json; charset=utf-8", encoded)
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeIdempotent runs a write through idempotent, counting how often it is applied
+func writeIdempotent(t *testing.T, key, body string, applied *int) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/write/cpu", nil)
+	c.Request.Header.Set("Idempotency-Key", key)
+	idempotent(c, "cpu", []byte(body), func() (int, interface{}) {
+		*applied++
+		return 201, gin.H{"message": "written"}
+	})
+	return recorder
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	useDataDir(t)
+	applied := 0
+
+	if recorder := writeIdempotent(t, "a", "body", &applied); recorder.Code != 201 || applied != 1 {
+		t.Fatalf("got %d applied %d times", recorder.Code, applied)
+	}
+	writeIdempotent(t, "b", "body", &applied)
+
+	// The keys are read back from the log after a restart
+	idempotencyMutex.Lock()
+	idempotencyLog.Close()
+	idempotencyKeys, idempotencyLog = nil, nil
+	idempotencyMutex.Unlock()
+
+	recorder := writeIdempotent(t, "a", "body", &applied)
+	if recorder.Code != 201 || applied != 2 || recorder.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("got %d applied %d times, want a replay", recorder.Code, applied)
+	}
+	if recorder := writeIdempotent(t, "a", "other body", &applied); recorder.Code != 422 || applied != 2 {
+		t.Fatalf("got %d applied %d times, want 422", recorder.Code, applied)
+	}
+
+	// Each write appended one record
+	content, err := os.ReadFile(idempotencyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(content, []byte("\n")); lines != 2 {
+		t.Fatalf("got %d records in the log, want 2", lines)
+	}
+}
+
+func TestExpireIdempotencyKeys(t *testing.T) {
+	useDataDir(t)
+	now := time.Now().Unix()
+
+	idempotencyMutex.Lock()
+	if err := loadIdempotencyLocked(); err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]int64{"cpu/old": now - 1, "cpu/older": now - 60, "cpu/live": now + 60}
+	for id, expires := range records {
+		if err := appendIdempotencyLocked(id, idempotentResponse{Status: 201, Body: []byte("{}"), Expires: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idempotencyMutex.Unlock()
+
+	if err := expireIdempotencyKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the live key is left, in memory and in the compacted log
+	content, err := os.ReadFile(idempotencyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idempotencyKeys) != 1 || bytes.Count(content, []byte("\n")) != 1 || !bytes.Contains(content, []byte("cpu/live")) {
+		t.Fatalf("got keys %v and log %s", idempotencyKeys, content)
+	}
+
+	// Records appended after the compaction go to the new log
+	idempotencyMutex.Lock()
+	err = appendIdempotencyLocked("cpu/new", idempotentResponse{Status: 201, Body: []byte("{}"), Expires: now + 60})
+	idempotencyMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(idempotencyFile)
+	if !bytes.Contains(content, []byte("cpu/new")) {
+		t.Fatalf("got log %s", content)
+	}
+}
@@ -0,0 +1,367 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ingestItem is one point of a write request
+type ingestItem struct {
+	Time json.RawMessage   `json:"time"` // Timestamp in the collection precision or RFC3339
+	Data interface{}       `json:"data"` // Data can be any JSON type
+	Tags map[string]string `json:"tags"` // Optional series tags such as {"device": "a1"}
+
+	errors []string // Problems found while decoding the item from another format, such as CSV
+}
+
+// ingestResult reports which items of a batch were written
+type ingestResult struct {
+	Accepted []int        // Indexes of the written items
+	Failures []itemErrors // Why the other items were rejected
+	Conflict bool         // A failure is a point already stored at its time by a reject collection
+}
+
+// itemReport is the outcome of one item in a partial write
+type itemReport struct {
+	Index  int      `json:"index"`
+	Status string   `json:"status"` // accepted or rejected
+	Errors []string `json:"errors,omitempty"`
+}
+
+// report lists the outcome of every item in index order
+func (result ingestResult) report(total int) []itemReport {
+	reports := make([]itemReport, total)
+	for i := range reports {
+		reports[i] = itemReport{Index: i, Status: "accepted"}
+	}
+	for _, failure := range result.Failures {
+		reports[failure.Index] = itemReport{Index: failure.Index, Status: "rejected", Errors: failure.Errors}
+	}
+	return reports
+}
+
+// preparedPoint is an item that passed validation, ready to be stored
+type preparedPoint struct {
+	index     int
+	tags      map[string]string
+	seriesDir string
+	time      int64
+	value     []byte
+	blob      string // Blob file created for the point, removed if it is not stored
+}
+
+// segmentChanges holds changes to segments until they are applied together
+type segmentChanges struct {
+	values  map[string]map[int64][]byte // Segment path -> new values
+	deleted map[string]map[int64]bool   // Segment path -> removed timestamps
+}
+
+func newSegmentChanges() *segmentChanges {
+	return &segmentChanges{values: map[string]map[int64][]byte{}, deleted: map[string]map[int64]bool{}}
+}
+
+// lookupLocked returns the value a timestamp will hold once the changes are applied.
+// The caller must hold the write lock on dataMutex.
+func (changes *segmentChanges) lookupLocked(filePath string, ts int64) ([]byte, bool, error) {
+	if value, exists := changes.values[filePath][ts]; exists {
+		return value, true, nil
+	}
+	if changes.deleted[filePath][ts] {
+		return nil, false, nil
+	}
+
+	// Segments not yet on disk must not be cached by a lookup, their directory may not exist
+	if _, cached := inMemoryData[filePath]; !cached {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			return nil, false, nil
+		}
+	}
+
+	fileData, err := loadSegmentLocked(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	value, exists := fileData[ts]
+	return value, exists, nil
+}
+
+func (changes *segmentChanges) set(filePath string, ts int64, value []byte) {
+	if changes.values[filePath] == nil {
+		changes.values[filePath] = map[int64][]byte{}
+	}
+	changes.values[filePath][ts] = value
+}
+
+// deleteRangeLocked removes the points of a segment between start and end
+func (changes *segmentChanges) deleteRangeLocked(filePath string, start, end int64) error {
+	fileData, err := loadSegmentLocked(filePath)
+	if err != nil {
+		return err
+	}
+
+	if changes.deleted[filePath] == nil {
+		changes.deleted[filePath] = map[int64]bool{}
+	}
+	for ts := range fileData {
+		if ts >= start && ts <= end {
+			changes.deleted[filePath][ts] = true
+		}
+	}
+	for ts := range changes.values[filePath] {
+		if ts >= start && ts <= end {
+			delete(changes.values[filePath], ts)
+		}
+	}
+	return nil
+}
+
+// imagesLocked returns the full content of every changed segment once the changes are applied
+func (changes *segmentChanges) imagesLocked() (map[string]map[int64][]byte, error) {
+	images := map[string]map[int64][]byte{}
+	for filePath := range changes.deleted {
+		images[filePath] = nil
+	}
+	for filePath := range changes.values {
+		images[filePath] = nil
+	}
+
+	for filePath := range images {
+		fileData, err := loadSegmentLocked(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		image := make(map[int64][]byte, len(fileData))
+		for ts, value := range fileData {
+			if !changes.deleted[filePath][ts] {
+				image[ts] = value
+			}
+		}
+		for ts, value := range changes.values[filePath] {
+			image[ts] = value
+		}
+		images[filePath] = image
+	}
+	return images, nil
+}
+
+// applyLocked writes new values into the cached segments, leaving them for save_to_disk
+func (changes *segmentChanges) applyLocked(nowTime int64) error {
+	for filePath, values := range changes.values {
+		fileData, err := loadSegmentLocked(filePath)
+		if err != nil {
+			return err
+		}
+		for ts, value := range values {
+			releaseBlob(filePath, fileData[ts], value)
+			fileData[ts] = value
+		}
+		lastAccessTimestamps[filePath] = nowTime
+	}
+	return nil
+}
+
+// preparePoints validates the items written to a collection, collecting every error of each item
+func preparePoints(collectionDir string, manifest collectionManifest, items []ingestItem) ([]preparedPoint, []itemErrors, error) {
+	schema, err := loadSchema(collectionDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prepared := []preparedPoint{}
+	failures := []itemErrors{}
+	for i, item := range items {
+		if len(item.errors) > 0 {
+			failures = append(failures, itemErrors{Index: i, Errors: item.errors})
+			continue
+		}
+		itemErrs := []string{}
+
+		timestamp, err := decodeTimestamp(item.Time, manifest.Precision)
+		if err != nil {
+			itemErrs = append(itemErrs, fmt.Sprintf("time: %v", err))
+		} else if timestamp <= 0 {
+			itemErrs = append(itemErrs, "time: must be positive")
+		}
+
+		if err := validateTags(item.Tags); err != nil {
+			itemErrs = append(itemErrs, fmt.Sprintf("tags: %v", err))
+		}
+
+		data := item.Data
+		binary, isBinary := data.(binaryValue)
+		if isBinary && schema != nil {
+			itemErrs = append(itemErrs, "data: binary values cannot be checked against the collection schema")
+		} else if isBinary && manifest.WriteMode == "append" {
+			itemErrs = append(itemErrs, "data: binary values cannot be appended")
+		} else if schema != nil {
+			var schemaErrs []string
+			data, schemaErrs = schema.compiled.validate(data, "data", schema.Coerce)
+			itemErrs = append(itemErrs, schemaErrs...)
+		}
+
+		if len(itemErrs) > 0 {
+			failures = append(failures, itemErrors{Index: i, Errors: itemErrs})
+			continue
+		}
+
+		// Binary data is stored as sent, everything else as JSON
+		var value []byte
+		if isBinary {
+			value = encodeBinary(binary)
+		} else if value, err = json.Marshal(data); err != nil {
+			return nil, nil, fmt.Errorf("failed to process data: %w", err)
+		}
+		prepared = append(prepared, preparedPoint{index: i, tags: item.Tags, time: timestamp, value: value})
+	}
+	return prepared, failures, nil
+}
+
+// locatePoints sets the series directory of prepared points without registering their series
+func locatePoints(collectionDir string, prepared []preparedPoint) {
+	for i := range prepared {
+		prepared[i].seriesDir = seriesPath(collectionDir, prepared[i].tags)
+	}
+}
+
+// registerPoints registers the series of prepared points and creates their segment directories
+func registerPoints(collectionDir string, manifest collectionManifest, prepared []preparedPoint) error {
+	for i := range prepared {
+		// Tagged points are stored in the directory of their series
+		dir, err := seriesDir(collectionDir, prepared[i].tags)
+		if err != nil {
+			return fmt.Errorf("failed to register series: %w", err)
+		}
+		prepared[i].seriesDir = dir
+
+		segmentDir, _ := segmentPath(dir, manifest.Precision, prepared[i].time)
+		if err := os.MkdirAll(segmentDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+
+		// Large binary values get their own file and the segment keeps a reference
+		if value, ok := decodeBinary(prepared[i].value); ok && len(value.Bytes) > blobThreshold() {
+			ref, path, err := storeBlob(segmentDir, prepared[i].time, value)
+			if err != nil {
+				return err
+			}
+			prepared[i].blob = path
+			prepared[i].value = encodeBlobRef(ref)
+		}
+	}
+	return nil
+}
+
+// stagePointsLocked adds prepared points to changes according to the write mode of the
+// collection. Earlier points of the batch count as stored, and points refused by a reject
+// collection are added to the failures of result. It returns the times of the staged points.
+func stagePointsLocked(changes *segmentChanges, manifest collectionManifest, prepared []preparedPoint, result *ingestResult) ([]int64, error) {
+	times := []int64{}
+	for _, point := range prepared {
+		_, sanFilePath := segmentPath(point.seriesDir, manifest.Precision, point.time)
+
+		existing, exists, err := changes.lookupLocked(sanFilePath, point.time)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := writeValue(manifest.WriteMode, existing, exists, point.value)
+		if errors.Is(err, errDuplicatePoint) {
+			result.Conflict = true
+			result.Failures = append(result.Failures, itemErrors{
+				Index:  point.index,
+				Errors: []string{fmt.Sprintf("time: a point already exists at time %d", point.time)},
+			})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to process data: %w", err)
+		}
+
+		changes.set(sanFilePath, point.time, value)
+		result.Accepted = append(result.Accepted, point.index)
+		times = append(times, point.time)
+	}
+	return times, nil
+}
+
+// ingest validates a batch and writes it to a collection. Every item is checked before
+// anything is stored, and the batch is applied under a single lock, so either all items
+// are written or none are. In partial mode the valid items are written and the others
+// reported.
+func ingest(collectionName string, items []ingestItem, partial bool) (ingestResult, error) {
+	dataPath := "./data" // Base directory for data
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+	result := ingestResult{Accepted: []int{}, Failures: []itemErrors{}}
+
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		return result, err
+	}
+
+	prepared, failures, err := preparePoints(collectionDir, manifest, items)
+	if err != nil {
+		return result, err
+	}
+	result.Failures = failures
+	if len(result.Failures) > 0 && !partial {
+		return result, nil
+	}
+
+	// Look for conflicts before any series is registered, so a rejected write leaves nothing behind
+	if !partial {
+		locatePoints(collectionDir, prepared)
+		dataMutex.Lock()
+		_, err := stagePointsLocked(newSegmentChanges(), manifest, prepared, &result)
+		dataMutex.Unlock()
+		result.Accepted = []int{}
+		if err != nil || result.Conflict {
+			return result, err
+		}
+	}
+
+	if err := registerPoints(collectionDir, manifest, prepared); err != nil {
+		return result, err
+	}
+
+	nowTime := time.Now().Unix()
+
+	// Stage the new values first, so a conflict leaves the segments untouched
+	dataMutex.Lock()
+	changes := newSegmentChanges()
+	times, err := stagePointsLocked(changes, manifest, prepared, &result)
+	if err != nil {
+		dataMutex.Unlock()
+		discardBlobs(prepared, nil)
+		return result, err
+	}
+
+	if result.Conflict && !partial {
+		dataMutex.Unlock()
+		result.Accepted = []int{}
+		discardBlobs(prepared, nil)
+		return result, nil
+	}
+	discardBlobs(prepared, result.Accepted)
+
+	err = changes.applyLocked(nowTime)
+	dataMutex.Unlock()
+	if err != nil {
+		return result, err
+	}
+
+	if len(times) == 0 {
+		return result, nil
+	}
+
+	go save_to_disk(nowTime)
+
+	// Recompute the rollup buckets touched by the batch
+	if err := updateRollups(collectionName, times); err != nil {
+		return result, fmt.Errorf("failed to update rollups: %w", err)
+	}
+	return result, nil
+}
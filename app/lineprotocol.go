@@ -0,0 +1,314 @@
+package app
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// linePoint is one line of InfluxDB line protocol
+type linePoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        int64 // In the precision of the write
+	HasTime     bool
+}
+
+// linePrecisions maps the precision parameter of a write to nanoseconds and to the
+// precision of the collections it creates
+var linePrecisions = map[string]struct {
+	unit      int64
+	precision string
+}{
+	"n":  {1, "ns"},
+	"ns": {1, "ns"},
+	"u":  {int64(time.Microsecond), "us"},
+	"us": {int64(time.Microsecond), "us"},
+	"ms": {int64(time.Millisecond), "ms"},
+	"s":  {int64(time.Second), "s"},
+	"m":  {int64(time.Minute), "s"},
+	"h":  {int64(time.Hour), "s"},
+}
+
+// readToken reads s from i up to the first unescaped stop character. A backslash before
+// a stop character or another backslash escapes it.
+func readToken(s string, i int, stops string) (string, int) {
+	var token strings.Builder
+	for i < len(s) {
+		ch := s[i]
+		if ch == '\\' && i+1 < len(s) && (s[i+1] == '\\' || strings.IndexByte(stops, s[i+1]) >= 0) {
+			token.WriteByte(s[i+1])
+			i += 2
+			continue
+		}
+		if strings.IndexByte(stops, ch) >= 0 {
+			break
+		}
+		token.WriteByte(ch)
+		i++
+	}
+	return token.String(), i
+}
+
+// parseFieldValue reads a field value: a float, an integer such as 5i or 5u, a boolean or
+// a double-quoted string. Numbers become float64, as they would from JSON.
+func parseFieldValue(s string, i int) (interface{}, int, error) {
+	if i < len(s) && s[i] == '"' {
+		var value strings.Builder
+		for i++; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				value.WriteByte(s[i+1])
+				i++
+				continue
+			}
+			if s[i] == '"' {
+				return value.String(), i + 1, nil
+			}
+			value.WriteByte(s[i])
+		}
+		return nil, i, fmt.Errorf("unterminated string")
+	}
+
+	token, next := readToken(s, i, ", ")
+	switch token {
+	case "t", "T", "true", "True", "TRUE":
+		return true, next, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, next, nil
+	case "":
+		return nil, next, fmt.Errorf("missing field value")
+	}
+
+	switch token[len(token)-1] {
+	case 'i':
+		number, err := strconv.ParseInt(token[:len(token)-1], 10, 64)
+		if err != nil {
+			return nil, next, fmt.Errorf("invalid integer '%s'", token)
+		}
+		return float64(number), next, nil
+	case 'u':
+		number, err := strconv.ParseUint(token[:len(token)-1], 10, 64)
+		if err != nil {
+			return nil, next, fmt.Errorf("invalid unsigned integer '%s'", token)
+		}
+		return float64(number), next, nil
+	}
+
+	number, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, next, fmt.Errorf("invalid field value '%s'", token)
+	}
+	return number, next, nil
+}
+
+// parseLine parses "measurement,tag=value field=value,field=value timestamp"
+func parseLine(line string) (linePoint, error) {
+	point := linePoint{Tags: map[string]string{}, Fields: map[string]interface{}{}}
+
+	measurement, i := readToken(line, 0, ", ")
+	if measurement == "" {
+		return point, fmt.Errorf("missing measurement")
+	}
+	point.Measurement = measurement
+
+	// Tags run until the first unescaped space
+	for i < len(line) && line[i] == ',' {
+		key, next := readToken(line, i+1, ",= ")
+		if next >= len(line) || line[next] != '=' || key == "" {
+			return point, fmt.Errorf("invalid tag after '%s'", line[:i])
+		}
+		value, next := readToken(line, next+1, ",= ")
+		if value == "" {
+			return point, fmt.Errorf("missing value of tag '%s'", key)
+		}
+		point.Tags[key] = value
+		i = next
+	}
+
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+
+	for {
+		key, next := readToken(line, i, ",= ")
+		if next >= len(line) || line[next] != '=' || key == "" {
+			return point, fmt.Errorf("invalid field after '%s'", line[:i])
+		}
+		value, next, err := parseFieldValue(line, next+1)
+		if err != nil {
+			return point, fmt.Errorf("field '%s': %v", key, err)
+		}
+		point.Fields[key] = value
+
+		i = next
+		if i < len(line) && line[i] == ',' {
+			i++
+			continue
+		}
+		break
+	}
+
+	if rest := strings.TrimSpace(line[i:]); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("invalid timestamp '%s'", rest)
+		}
+		point.Time, point.HasTime = ts, true
+	}
+	return point, nil
+}
+
+// write_line_protocol accepts InfluxDB line protocol, so agents such as Telegraf can write
+// without changes. Each measurement is stored in the collection of the same name, created
+// on first use, and its fields become the data of the point.
+func write_line_protocol(c *gin.Context) {
+	dataPath := "./data" // Base directory for data
+
+	// The database only matters to InfluxDB clients, which always send it
+	if c.Query("db") == "" {
+		c.JSON(400, gin.H{"error": "Missing db parameter"})
+		return
+	}
+
+	precision, exists := linePrecisions[c.DefaultQuery("precision", "ns")]
+	if !exists {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid precision '%s'", c.Query("precision"))})
+		return
+	}
+
+	// Tags become series tags, or with tags=payload fields of the data
+	tagsAsFields := c.Query("tags") == "payload"
+
+	var body io.Reader = c.Request.Body
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid gzip body: %v", err)})
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+
+	// Parse the whole body before writing anything
+	points := map[string][]linePoint{} // Collection -> points
+	failures := []lineErrors{}
+	now := time.Now()
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), streamMaxLine)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		point, err := parseLine(line)
+		if err == nil && !validCollectionName(point.Measurement) {
+			err = fmt.Errorf("invalid measurement name '%s'", point.Measurement)
+		}
+		if err != nil {
+			failures = append(failures, lineErrors{Line: number, Errors: []string{err.Error()}})
+			continue
+		}
+		points[point.Measurement] = append(points[point.Measurement], point)
+	}
+	if err := scanner.Err(); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to read body: %v", err)})
+		return
+	}
+	if len(failures) > 0 {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Unable to parse %d line(s), nothing was written", len(failures)), "lines": failures})
+		return
+	}
+
+	collections := make([]string, 0, len(points))
+	for collection := range points {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	// Check the points of every measurement before writing any of them
+	items := map[string][]ingestItem{}
+	rejected := map[string][]itemErrors{}
+	for _, collection := range collections {
+		collectionDir := fmt.Sprintf("%s/%s", dataPath, collection)
+
+		// New collections will keep the precision of the write
+		manifest := collectionManifest{WriteMode: "overwrite", Precision: precision.precision}
+		if _, err := os.Stat(collectionDir); err == nil {
+			if manifest, err = loadManifest(collectionDir); err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		for _, point := range points[collection] {
+			ts := timestampOf(now, manifest.Precision)
+			if point.HasTime {
+				ts = point.Time * precision.unit / precisionUnit(manifest.Precision)
+			}
+
+			item := ingestItem{Time: []byte(strconv.FormatInt(ts, 10)), Data: point.Fields}
+			if tagsAsFields {
+				for key, value := range point.Tags {
+					point.Fields[key] = value
+				}
+			} else if len(point.Tags) > 0 {
+				item.Tags = point.Tags
+			}
+			items[collection] = append(items[collection], item)
+		}
+
+		_, failures, err := preparePoints(collectionDir, manifest, items[collection])
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if len(failures) > 0 {
+			rejected[collection] = failures
+		}
+	}
+	if len(rejected) > 0 {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Points of %d measurement(s) were rejected, nothing was written", len(rejected)), "collections": rejected})
+		return
+	}
+
+	// A write can still fail on conflicts found under the lock, after other measurements were stored
+	written := []string{}
+	for _, collection := range collections {
+		collectionDir := fmt.Sprintf("%s/%s", dataPath, collection)
+		if err := ensureCollection(collectionDir, precision.precision); err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create collection '%s': %v", collection, err), "written": written})
+			return
+		}
+
+		result, err := ingest(collection, items[collection], false)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error(), "written": written})
+			return
+		}
+		if len(result.Failures) > 0 {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Partial write: %d point(s) of '%s' were rejected", len(result.Failures), collection), "items": result.Failures, "written": written})
+			return
+		}
+		written = append(written, collection)
+	}
+
+	c.Status(204)
+}
+
+// ping answers the health check of InfluxDB clients
+func ping(c *gin.Context) {
+	c.Header("X-Influxdb-Version", "1.8-sandb")
+	c.Status(204)
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeLines posts a line protocol body to write_line_protocol
+func writeLines(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/write?db=telegraf&precision=s", strings.NewReader(body))
+	write_line_protocol(c)
+	c.Writer.WriteHeaderNow()
+	return recorder
+}
+
+func TestWriteLineProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T)
+		body    string
+		code    int
+		written []string // Collections holding points afterwards
+		missing []string // Collections that must not exist afterwards
+	}{
+		{
+			name:    "several measurements",
+			body:    "cpu,host=a usage=1 1700000000\nmem free=2i 1700000000\n",
+			code:    204,
+			written: []string{"cpu", "mem"},
+		},
+		{
+			name:    "unparsable line",
+			body:    "cpu usage=1 1700000000\nmem free=\n",
+			code:    400,
+			missing: []string{"cpu", "mem"},
+		},
+		{
+			// mem sorts after cpu, so cpu would have been stored before mem was checked
+			name: "rejected by a schema",
+			setup: func(t *testing.T) {
+				if err := ensureCollection("./data/mem", "s"); err != nil {
+					t.Fatal(err)
+				}
+				schema := `{"schema": {"type": "object", "properties": {"free": {"type": "string"}}}}`
+				if err := os.WriteFile("./data/mem/schema.json", []byte(schema), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			body:    "cpu usage=1 1700000000\nmem free=2i 1700000000\n",
+			code:    400,
+			missing: []string{"cpu"},
+		},
+		{
+			name:    "invalid time",
+			body:    "cpu usage=1 1700000000\nmem free=2i -5\n",
+			code:    400,
+			missing: []string{"cpu"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useDataDir(t)
+			if test.setup != nil {
+				test.setup(t)
+			}
+
+			recorder := writeLines(t, test.body)
+			if recorder.Code != test.code {
+				t.Fatalf("got %d %s, want %d", recorder.Code, recorder.Body, test.code)
+			}
+			if test.code == 400 && !strings.Contains(recorder.Body.String(), "nothing was written") {
+				t.Fatalf("got %s", recorder.Body)
+			}
+
+			for _, collection := range test.written {
+				series, err := findSeries("./data/"+collection, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				count := 0
+				err = scanSeries(series, 1700000000, 1700000000, func(seriesInfo, dataPoint) error {
+					count++
+					return nil
+				})
+				if err != nil || count != 1 {
+					t.Fatalf("got %d point(s) in %s, want 1 (%v)", count, collection, err)
+				}
+			}
+			for _, collection := range test.missing {
+				if _, err := os.Stat("./data/" + collection); !os.IsNotExist(err) {
+					t.Fatalf("collection %s was created", collection)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,615 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	listenerBatchSize     = 5000        // Points written by one ingest call
+	listenerFlushInterval = time.Second // Longest a point waits before it is written
+	listenerMaxDatagram   = 64 * 1024   // Largest UDP packet read
+	listenerMaxLine       = 1024 * 1024 // Longest line accepted over TCP
+)
+
+// listenerPoint is a parsed point waiting to be written, with its time in nanoseconds
+type listenerPoint struct {
+	Collection string
+	Tags       map[string]string
+	Time       int64
+	Data       interface{}
+}
+
+// graphiteTemplate maps the dot-separated parts of a metric path. Each template part is
+// "measurement", "measurement*", "field", "field*", a tag key, or empty to skip the path part.
+type graphiteTemplate struct {
+	filter []string          // Glob per leading path part; empty matches every path
+	parts  []string          // Template parts
+	tags   map[string]string // Extra tags of the matching points
+}
+
+// parseGraphiteTemplate parses "[filter] template [tag=value,...]", e.g.
+// "servers.* .host.measurement* dc=north"
+func parseGraphiteTemplate(spec string) (graphiteTemplate, error) {
+	template := graphiteTemplate{tags: map[string]string{}}
+	fields := strings.Fields(spec)
+	if len(fields) > 1 && strings.Contains(fields[len(fields)-1], "=") {
+		for _, pair := range strings.Split(fields[len(fields)-1], ",") {
+			key, value, found := strings.Cut(pair, "=")
+			if !found || key == "" || value == "" {
+				return template, fmt.Errorf("invalid tag '%s' in template '%s'", pair, spec)
+			}
+			template.tags[key] = value
+		}
+		fields = fields[:len(fields)-1]
+	}
+
+	switch len(fields) {
+	case 1:
+		template.parts = strings.Split(fields[0], ".")
+	case 2:
+		template.filter = strings.Split(fields[0], ".")
+		template.parts = strings.Split(fields[1], ".")
+	default:
+		return template, fmt.Errorf("invalid template '%s'", spec)
+	}
+
+	measurement := false
+	for _, part := range template.parts {
+		if part == "measurement" || part == "measurement*" {
+			measurement = true
+		}
+		if strings.HasSuffix(part, "*") && part != "measurement*" && part != "field*" {
+			return template, fmt.Errorf("invalid part '%s' in template '%s'", part, spec)
+		}
+	}
+	if !measurement {
+		return template, fmt.Errorf("template '%s' has no measurement", spec)
+	}
+	for _, pattern := range template.filter {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return template, fmt.Errorf("invalid filter in template '%s'", spec)
+		}
+	}
+	return template, nil
+}
+
+// matches checks the filter against the leading parts of a metric path
+func (t graphiteTemplate) matches(parts []string) bool {
+	if len(t.filter) > len(parts) {
+		return false
+	}
+	for i, pattern := range t.filter {
+		if matched, _ := path.Match(pattern, parts[i]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the collection, field and tags a template gives a metric path
+func (t graphiteTemplate) apply(parts []string) (string, string, map[string]string) {
+	measurement, field := []string{}, []string{}
+	tags := map[string]string{}
+	for key, value := range t.tags {
+		tags[key] = value
+	}
+
+	for i, part := range t.parts {
+		if i >= len(parts) {
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		case "field":
+			field = append(field, parts[i])
+		case "field*":
+			field = append(field, parts[i:]...)
+		default:
+			tags[part] = parts[i]
+		}
+		if strings.HasSuffix(part, "*") {
+			break
+		}
+	}
+	return strings.Join(measurement, "."), strings.Join(field, "."), tags
+}
+
+// listener accepts Graphite plaintext or OpenTSDB telnet lines over TCP or UDP and writes
+// them in batches through the normal ingestion path
+type listener struct {
+	config    ListenerConfig
+	templates []graphiteTemplate
+	points    chan listenerPoint
+	socket    io.Closer
+
+	mutex       sync.Mutex
+	connections map[net.Conn]bool // Open TCP connections, closed on shutdown
+	lastError   string
+	readers     sync.WaitGroup
+	done        chan struct{}
+
+	stats struct {
+		connections atomic.Int64 // Open TCP connections
+		lines       atomic.Int64 // Lines received
+		invalid     atomic.Int64 // Lines that could not be parsed
+		accepted    atomic.Int64 // Points written
+		rejected    atomic.Int64 // Points refused by ingestion, e.g. by a schema
+	}
+}
+
+// listenerStatus is the configuration and traffic of a listener
+type listenerStatus struct {
+	Name        string `json:"name"`
+	Format      string `json:"format"`
+	Protocol    string `json:"protocol"`
+	Address     string `json:"address"`
+	Connections int64  `json:"connections"`
+	Lines       int64  `json:"lines"`
+	Invalid     int64  `json:"invalid"`
+	Accepted    int64  `json:"accepted"`
+	Rejected    int64  `json:"rejected"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+var (
+	listeners      []*listener // Running listeners
+	listenersMutex sync.Mutex  // Guards listeners
+)
+
+// newListener validates a listener configuration and fills in its defaults
+func newListener(config ListenerConfig) (*listener, error) {
+	if config.Protocol == "" {
+		config.Protocol = "tcp"
+	}
+	if config.Name == "" {
+		config.Name = config.Format + "-" + config.Protocol
+	}
+	switch config.Format {
+	case "graphite":
+		if config.Precision == "" {
+			config.Precision = "s"
+		}
+	case "opentsdb":
+		if config.Precision == "" {
+			config.Precision = "ms"
+		}
+	default:
+		return nil, fmt.Errorf("listener '%s': unknown format '%s'", config.Name, config.Format)
+	}
+	if config.Protocol != "tcp" && config.Protocol != "udp" {
+		return nil, fmt.Errorf("listener '%s': unknown protocol '%s'", config.Name, config.Protocol)
+	}
+	if _, exists := precisionUnits[config.Precision]; !exists {
+		return nil, fmt.Errorf("listener '%s': unknown precision '%s'", config.Name, config.Precision)
+	}
+
+	l := &listener{
+		config:      config,
+		points:      make(chan listenerPoint, listenerBatchSize),
+		connections: map[net.Conn]bool{},
+		done:        make(chan struct{}),
+	}
+	for _, spec := range config.Templates {
+		template, err := parseGraphiteTemplate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("listener '%s': %v", config.Name, err)
+		}
+		l.templates = append(l.templates, template)
+	}
+	return l, nil
+}
+
+// startListeners opens the listeners of the configuration
+func startListeners() error {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	for _, config := range AppConfig.Server.Listeners {
+		l, err := newListener(config)
+		if err != nil {
+			return err
+		}
+
+		if l.config.Protocol == "tcp" {
+			socket, err := net.Listen("tcp", l.config.Address)
+			if err != nil {
+				return fmt.Errorf("listener '%s': %w", l.config.Name, err)
+			}
+			l.socket = socket
+			l.readers.Add(1)
+			go l.serveTCP(socket)
+		} else {
+			socket, err := net.ListenPacket("udp", l.config.Address)
+			if err != nil {
+				return fmt.Errorf("listener '%s': %w", l.config.Name, err)
+			}
+			l.socket = socket
+			l.readers.Add(1)
+			go l.serveUDP(socket)
+		}
+
+		go l.run()
+		listeners = append(listeners, l)
+		fmt.Printf("Listening for %s over %s on %s...\n", l.config.Format, l.config.Protocol, l.config.Address)
+	}
+	return nil
+}
+
+// stopListeners closes the listeners and writes the points they still hold
+func stopListeners() {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	for _, l := range listeners {
+		l.socket.Close()
+		l.mutex.Lock()
+		for conn := range l.connections {
+			conn.Close()
+		}
+		l.mutex.Unlock()
+
+		l.readers.Wait()
+		close(l.points)
+		<-l.done
+	}
+	if len(listeners) == 0 {
+		return
+	}
+	listeners = nil
+
+	// Ingestion saves segments in the background, which would race the exit
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+	for filePath, fileData := range inMemoryData {
+		if err := writeSegmentLocked(filePath, fileData); err != nil {
+			fmt.Printf("Failed to save %s: %v\n", filePath, err)
+		}
+	}
+}
+
+func (l *listener) setError(err string) {
+	l.mutex.Lock()
+	l.lastError = err
+	l.mutex.Unlock()
+}
+
+func (l *listener) serveTCP(socket net.Listener) {
+	defer l.readers.Done()
+	for {
+		conn, err := socket.Accept()
+		if err != nil {
+			return // Closed on shutdown
+		}
+
+		l.mutex.Lock()
+		l.connections[conn] = true
+		l.mutex.Unlock()
+		l.stats.connections.Add(1)
+
+		l.readers.Add(1)
+		go func() {
+			defer l.readers.Done()
+			l.handleConnection(conn)
+
+			l.mutex.Lock()
+			delete(l.connections, conn)
+			l.mutex.Unlock()
+			l.stats.connections.Add(-1)
+			conn.Close()
+		}()
+	}
+}
+
+func (l *listener) handleConnection(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), listenerMaxLine)
+	for scanner.Scan() {
+		reply, err := l.handleLine(scanner.Text())
+
+		// OpenTSDB answers commands and reports bad lines on the connection
+		if l.config.Format == "opentsdb" {
+			if err != nil {
+				reply = fmt.Sprintf("put: illegal argument: %v\n", err)
+			}
+			if reply != "" {
+				conn.Write([]byte(reply))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		l.setError(fmt.Sprintf("connection from %s: %v", conn.RemoteAddr(), err))
+	}
+}
+
+func (l *listener) serveUDP(socket net.PacketConn) {
+	defer l.readers.Done()
+	buf := make([]byte, listenerMaxDatagram)
+	for {
+		n, _, err := socket.ReadFrom(buf)
+		if err != nil {
+			return // Closed on shutdown
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.handleLine(line)
+		}
+	}
+}
+
+// handleLine parses a line and queues its point. It returns the reply to a command.
+func (l *listener) handleLine(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", nil
+	}
+	l.stats.lines.Add(1)
+
+	var point listenerPoint
+	var err error
+	if l.config.Format == "graphite" {
+		point, err = l.parseGraphite(line)
+	} else {
+		switch strings.SplitN(line, " ", 2)[0] {
+		case "version":
+			return "sanDB\n", nil
+		case "put":
+			point, err = l.parseOpenTSDB(line)
+		default:
+			err = fmt.Errorf("unknown command '%s'", strings.SplitN(line, " ", 2)[0])
+		}
+	}
+
+	if err == nil && !validCollectionName(point.Collection) {
+		err = fmt.Errorf("invalid metric name '%s'", point.Collection)
+	}
+	if err != nil {
+		l.stats.invalid.Add(1)
+		l.setError(fmt.Sprintf("%v: %s", err, line))
+		return "", err
+	}
+
+	l.points <- point
+	return "", nil
+}
+
+// mapMetric applies the first template matching a metric path. Without one the whole
+// path names the collection.
+func (l *listener) mapMetric(metric string) (string, string, map[string]string) {
+	parts := strings.Split(metric, ".")
+	for _, template := range l.templates {
+		if template.matches(parts) {
+			collection, field, tags := template.apply(parts)
+			if collection != "" {
+				return collection, field, tags
+			}
+		}
+	}
+	return metric, "", map[string]string{}
+}
+
+func listenerValue(text string) (float64, error) {
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid value '%s'", text)
+	}
+	return value, nil
+}
+
+func listenerData(field string, value float64) interface{} {
+	if field == "" {
+		return value
+	}
+	return map[string]interface{}{field: value}
+}
+
+// parseGraphite parses "path value [timestamp]", where the timestamp is in Unix seconds
+// and -1 or a missing timestamp means now. Graphite 1.1 tags such as "path;tag=value" are
+// kept as series tags.
+func (l *listener) parseGraphite(line string) (listenerPoint, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return listenerPoint{}, fmt.Errorf("expected 'path value timestamp'")
+	}
+
+	pathTags := strings.Split(fields[0], ";")
+	collection, field, tags := l.mapMetric(pathTags[0])
+	for _, pair := range pathTags[1:] {
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return listenerPoint{}, fmt.Errorf("invalid tag '%s'", pair)
+		}
+		tags[key] = value
+	}
+
+	value, err := listenerValue(fields[1])
+	if err != nil {
+		return listenerPoint{}, err
+	}
+
+	ts := time.Now().UnixNano()
+	if len(fields) == 3 && fields[2] != "-1" && fields[2] != "N" {
+		seconds, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return listenerPoint{}, fmt.Errorf("invalid timestamp '%s'", fields[2])
+		}
+		ts = int64(seconds * float64(time.Second))
+	}
+
+	return listenerPoint{Collection: collection, Tags: tags, Time: ts, Data: listenerData(field, value)}, nil
+}
+
+// parseOpenTSDB parses "put metric timestamp value tag=value ...", where the timestamp is
+// in Unix seconds, or milliseconds when it has 13 digits
+func (l *listener) parseOpenTSDB(line string) (listenerPoint, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return listenerPoint{}, fmt.Errorf("expected 'put metric timestamp value tags'")
+	}
+
+	collection, field, tags := l.mapMetric(fields[1])
+
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || ts < 0 {
+		return listenerPoint{}, fmt.Errorf("invalid timestamp '%s'", fields[2])
+	}
+	if len(fields[2]) > 10 {
+		ts *= int64(time.Millisecond)
+	} else {
+		ts *= int64(time.Second)
+	}
+
+	value, err := listenerValue(fields[3])
+	if err != nil {
+		return listenerPoint{}, err
+	}
+
+	for _, pair := range fields[4:] {
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return listenerPoint{}, fmt.Errorf("invalid tag '%s'", pair)
+		}
+		tags[key] = value
+	}
+
+	return listenerPoint{Collection: collection, Tags: tags, Time: ts, Data: listenerData(field, value)}, nil
+}
+
+// run writes the queued points when a batch fills up or at every flush interval
+func (l *listener) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(listenerFlushInterval)
+	defer ticker.Stop()
+
+	batch := []listenerPoint{}
+	for {
+		select {
+		case point, ok := <-l.points:
+			if !ok {
+				l.flush(batch)
+				return
+			}
+			batch = append(batch, point)
+			if len(batch) >= listenerBatchSize {
+				l.flush(batch)
+				batch = []listenerPoint{}
+			}
+		case <-ticker.C:
+			l.flush(batch)
+			batch = []listenerPoint{}
+		}
+	}
+}
+
+// flush writes a batch, one ingest call per collection. Fields of the same series and
+// time, such as Graphite paths ending in a field template, are merged into one point.
+func (l *listener) flush(batch []listenerPoint) {
+	dataPath := "./data" // Base directory for data
+	if len(batch) == 0 {
+		return
+	}
+
+	points := map[string][]listenerPoint{} // Collection -> points
+	positions := map[string]int{}          // Collection, series and time -> position in points
+	for _, point := range batch {
+		key := fmt.Sprintf("%s\x00%s\x00%d", point.Collection, seriesKey(point.Tags), point.Time)
+		if position, exists := positions[key]; exists {
+			existing, isObject := points[point.Collection][position].Data.(map[string]interface{})
+			fields, hasFields := point.Data.(map[string]interface{})
+			if isObject && hasFields {
+				for field, value := range fields {
+					existing[field] = value
+				}
+				continue
+			}
+		}
+		positions[key] = len(points[point.Collection])
+		points[point.Collection] = append(points[point.Collection], point)
+	}
+
+	collections := make([]string, 0, len(points))
+	for collection := range points {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	for _, collection := range collections {
+		list := points[collection]
+		collectionDir := fmt.Sprintf("%s/%s", dataPath, collection)
+		if err := ensureCollection(collectionDir, l.config.Precision); err != nil {
+			l.stats.rejected.Add(int64(len(list)))
+			l.setError(fmt.Sprintf("failed to create collection '%s': %v", collection, err))
+			continue
+		}
+
+		target := collectionPrecision(collection)
+		items := make([]ingestItem, 0, len(list))
+		for _, point := range list {
+			item := ingestItem{Time: []byte(strconv.FormatInt(point.Time/precisionUnit(target), 10)), Data: point.Data}
+			if len(point.Tags) > 0 {
+				item.Tags = point.Tags
+			}
+			items = append(items, item)
+		}
+
+		result, err := ingest(collection, items, true)
+		if err != nil {
+			l.stats.rejected.Add(int64(len(list)))
+			l.setError(fmt.Sprintf("failed to write to '%s': %v", collection, err))
+			continue
+		}
+		l.stats.accepted.Add(int64(len(result.Accepted)))
+		l.stats.rejected.Add(int64(len(result.Failures)))
+		if len(result.Failures) > 0 {
+			failure := result.Failures[0]
+			l.setError(fmt.Sprintf("point of '%s' rejected: %s", collection, strings.Join(failure.Errors, "; ")))
+		}
+	}
+}
+
+// status reports the configuration and counters of a listener
+func (l *listener) status() listenerStatus {
+	l.mutex.Lock()
+	lastError := l.lastError
+	l.mutex.Unlock()
+
+	return listenerStatus{
+		Name:        l.config.Name,
+		Format:      l.config.Format,
+		Protocol:    l.config.Protocol,
+		Address:     l.config.Address,
+		Connections: l.stats.connections.Load(),
+		Lines:       l.stats.lines.Load(),
+		Invalid:     l.stats.invalid.Load(),
+		Accepted:    l.stats.accepted.Load(),
+		Rejected:    l.stats.rejected.Load(),
+		LastError:   lastError,
+	}
+}
+
+// listener_stats lists the configured listeners with their traffic counters
+func listener_stats(c *gin.Context) {
+	listenersMutex.Lock()
+	statuses := make([]listenerStatus, 0, len(listeners))
+	for _, l := range listeners {
+		statuses = append(statuses, l.status())
+	}
+	listenersMutex.Unlock()
+
+	c.JSON(200, gin.H{"listeners": statuses})
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ListenerConfig
+		want    ListenerConfig
+		wantErr string
+	}{
+		{
+			name:   "graphite defaults",
+			config: ListenerConfig{Format: "graphite", Address: ":2003"},
+			want:   ListenerConfig{Name: "graphite-tcp", Format: "graphite", Protocol: "tcp", Address: ":2003", Precision: "s"},
+		},
+		{
+			name:   "opentsdb over udp",
+			config: ListenerConfig{Format: "opentsdb", Protocol: "udp", Address: ":4242"},
+			want:   ListenerConfig{Name: "opentsdb-udp", Format: "opentsdb", Protocol: "udp", Address: ":4242", Precision: "ms"},
+		},
+		{
+			name:   "configured values are kept",
+			config: ListenerConfig{Name: "carbon", Format: "graphite", Protocol: "udp", Precision: "ms"},
+			want:   ListenerConfig{Name: "carbon", Format: "graphite", Protocol: "udp", Precision: "ms"},
+		},
+		{name: "unknown format", config: ListenerConfig{Format: "statsd"}, wantErr: "listener 'statsd-tcp': unknown format 'statsd'"},
+		{name: "unknown protocol", config: ListenerConfig{Format: "graphite", Protocol: "http"}, wantErr: "listener 'graphite-http': unknown protocol 'http'"},
+		{name: "unknown precision", config: ListenerConfig{Format: "graphite", Precision: "m"}, wantErr: "listener 'graphite-tcp': unknown precision 'm'"},
+		{
+			name:    "invalid template",
+			config:  ListenerConfig{Name: "carbon", Format: "graphite", Templates: []string{"host.field"}},
+			wantErr: "listener 'carbon': template 'host.field' has no measurement",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := newListener(test.config)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.config, test.want) {
+				t.Fatalf("got %+v, want %+v", got.config, test.want)
+			}
+		})
+	}
+}
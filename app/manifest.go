@@ -0,0 +1,231 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// collectionManifest holds the settings of a collection
+type collectionManifest struct {
+	WriteMode string `json:"write_mode"` // overwrite, reject, append or merge
+	Precision string `json:"precision"`  // s, ms, us or ns, fixed when the collection is created
+}
+
+var writeModes = map[string]bool{
+	"overwrite": true, // Replace the point at the timestamp
+	"reject":    true, // Refuse a second point at the timestamp
+	"append":    true, // Keep every value under the timestamp with a sequence number
+	"merge":     true, // Deep-merge JSON objects written at the same timestamp
+}
+
+// errDuplicatePoint is returned when a reject collection already holds a timestamp
+var errDuplicatePoint = errors.New("a point already exists at this time")
+
+// appendMarker starts the stored value of an append collection. It cannot begin a JSON
+// document, so such values are recognised without reading the manifest.
+const appendMarker = 0x1e
+
+// appendedValue is one of the values stored under a timestamp by an append collection
+type appendedValue struct {
+	Seq  int             `json:"seq"`
+	Data json.RawMessage `json:"data"`
+}
+
+// loadManifest reads the settings of a collection, defaulting to overwrite and milliseconds
+func loadManifest(collectionDir string) (collectionManifest, error) {
+	manifest := collectionManifest{WriteMode: "overwrite", Precision: "ms"}
+
+	content, err := os.ReadFile(collectionDir + "/collection.json")
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read collection manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to decode collection manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+func saveManifest(collectionDir string, manifest collectionManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode collection manifest: %w", err)
+	}
+	if err := os.WriteFile(collectionDir+"/collection.json", content, 0644); err != nil {
+		return fmt.Errorf("failed to save collection manifest: %w", err)
+	}
+	return nil
+}
+
+// ensureCollection creates a collection with the default write mode and a precision,
+// unless it already exists
+func ensureCollection(collectionDir, precision string) error {
+	if _, err := os.Stat(collectionDir); !os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Mkdir(collectionDir, os.ModePerm); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to create collection: %w", err)
+	}
+	return saveManifest(collectionDir, collectionManifest{WriteMode: "overwrite", Precision: precision})
+}
+
+// appendedValues decodes the values stored under a timestamp by an append collection
+func appendedValues(data []byte) ([]appendedValue, bool) {
+	if len(data) == 0 || data[0] != appendMarker {
+		return nil, false
+	}
+
+	var values []appendedValue
+	if err := json.Unmarshal(data[1:], &values); err != nil {
+		return nil, false
+	}
+	return values, true
+}
+
+func encodeAppended(values []appendedValue) ([]byte, error) {
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode appended values: %w", err)
+	}
+	return append([]byte{appendMarker}, encoded...), nil
+}
+
+// writeValue combines a new value with the one already stored at its timestamp
+func writeValue(mode string, existing []byte, exists bool, value []byte) ([]byte, error) {
+	switch mode {
+	case "reject":
+		if exists {
+			return nil, errDuplicatePoint
+		}
+
+	case "append":
+		values := []appendedValue{}
+		if exists {
+			values, _ = appendedValues(existing)
+		}
+		seq := 0
+		if len(values) > 0 {
+			seq = values[len(values)-1].Seq + 1
+		}
+		return encodeAppended(append(values, appendedValue{Seq: seq, Data: value}))
+
+	case "merge":
+		// Binary values cannot be merged and replace the stored one
+		if exists && !isBinaryValue(existing) && !isBinaryValue(value) {
+			merged, err := json.Marshal(mergeJSON(decodeData(existing), decodeData(value)))
+			if err != nil {
+				return nil, fmt.Errorf("failed to merge data: %w", err)
+			}
+			return merged, nil
+		}
+	}
+	return value, nil
+}
+
+// mergeJSON deep-merges patch into base. Anything but two objects is replaced by patch.
+func mergeJSON(base, patch interface{}) interface{} {
+	baseObject, baseIsObject := base.(map[string]interface{})
+	patchObject, patchIsObject := patch.(map[string]interface{})
+	if !baseIsObject || !patchIsObject {
+		return patch
+	}
+
+	for key, value := range patchObject {
+		baseObject[key] = mergeJSON(baseObject[key], value)
+	}
+	return baseObject
+}
+
+// splitValues returns every value stored under a timestamp
+func splitValues(data []byte) [][]byte {
+	values, ok := appendedValues(data)
+	if !ok {
+		return [][]byte{data}
+	}
+
+	split := make([][]byte, 0, len(values))
+	for _, value := range values {
+		split = append(split, value.Data)
+	}
+	return split
+}
+
+// expandPoints turns the appended values of each timestamp into separate points
+func expandPoints(points []dataPoint) []dataPoint {
+	expanded := make([]dataPoint, 0, len(points))
+	for _, point := range points {
+		values, ok := appendedValues(point.Data)
+		if !ok {
+			expanded = append(expanded, point)
+			continue
+		}
+		for _, value := range values {
+			expanded = append(expanded, dataPoint{Time: point.Time, Data: value.Data, Seq: value.Seq})
+		}
+	}
+	return expanded
+}
+
+// deleteSequence removes the appended value with a sequence number from every timestamp
+// of a series between start and end
+func deleteSequence(series seriesInfo, start, end int64, seq int) error {
+	files, err := segmentFiles(series.Dir, series.Precision, start, end)
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range files {
+		dataMutex.Lock()
+		fileData, err := loadSegmentLocked(filePath)
+		if err != nil {
+			dataMutex.Unlock()
+			return err
+		}
+
+		removed := false
+		for ts, data := range fileData {
+			values, ok := appendedValues(data)
+			if ts < start || ts > end || !ok {
+				continue
+			}
+
+			kept := values[:0]
+			for _, value := range values {
+				if value.Seq != seq {
+					kept = append(kept, value)
+				}
+			}
+			if len(kept) == len(values) {
+				continue
+			}
+
+			removed = true
+			if len(kept) == 0 {
+				delete(fileData, ts)
+				continue
+			}
+			if fileData[ts], err = encodeAppended(kept); err != nil {
+				break
+			}
+		}
+
+		if err == nil && removed {
+			err = writeSegmentLocked(filePath, fileData)
+		}
+		dataMutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
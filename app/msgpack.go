@@ -0,0 +1,265 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// maxDecodeDepth bounds the nesting of MessagePack and CBOR documents
+const maxDecodeDepth = 512
+
+// msgpackDecoder reads a MessagePack document into the same generic values as
+// encoding/json, except that integers are int64 or uint64 and binary is []byte
+type msgpackDecoder struct {
+	buf []byte
+}
+
+// decodeMsgpack decodes a single MessagePack document
+func decodeMsgpack(buf []byte) (interface{}, error) {
+	d := &msgpackDecoder{buf: buf}
+	value, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.buf) > 0 {
+		return nil, fmt.Errorf("unexpected data after the document")
+	}
+	return value, nil
+}
+
+func (d *msgpackDecoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, fmt.Errorf("truncated document")
+	}
+	taken := d.buf[:n]
+	d.buf = d.buf[n:]
+	return taken, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	raw, err := d.take(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	value := uint64(0)
+	for _, b := range raw {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, fmt.Errorf("document nested too deeply")
+	}
+	head, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	b := head[0]
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.mapping(uint64(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return d.array(uint64(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		raw, err := d.take(uint64(b & 0x1f))
+		return string(raw), err
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		length, err := d.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.take(length)
+		return append([]byte{}, raw...), err
+
+	case 0xca:
+		bits, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := d.uint(8)
+		return math.Float64frombits(bits), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8 to 64
+		value, err := d.uint(1 << (b - 0xcc))
+		if value <= math.MaxInt64 {
+			return int64(value), err
+		}
+		return value, err
+
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8 to 64
+		size := 1 << (b - 0xd0)
+		value, err := d.uint(size)
+		shift := 64 - 8*size
+		return int64(value<<shift) >> shift, err
+
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		length, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.take(length)
+		return string(raw), err
+
+	case 0xdc, 0xdd: // array 16, 32
+		length, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(length, depth)
+
+	case 0xde, 0xdf: // map 16, 32
+		length, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(length, depth)
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", b)
+}
+
+func (d *msgpackDecoder) array(length uint64, depth int) (interface{}, error) {
+	// Every element takes at least a byte
+	if length > uint64(len(d.buf)) {
+		return nil, fmt.Errorf("truncated document")
+	}
+	list := make([]interface{}, 0, length)
+	for i := uint64(0); i < length; i++ {
+		value, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+func (d *msgpackDecoder) mapping(length uint64, depth int) (interface{}, error) {
+	if length > uint64(len(d.buf))/2 {
+		return nil, fmt.Errorf("truncated document")
+	}
+	object := make(map[string]interface{}, length)
+	for i := uint64(0); i < length; i++ {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		object[mapKey(key)] = value
+	}
+	return object, nil
+}
+
+// mapKey turns a MessagePack or CBOR map key into a JSON object key
+func mapKey(key interface{}) string {
+	if text, ok := key.(string); ok {
+		return text
+	}
+	return fmt.Sprint(key)
+}
+
+// encodeMsgpack encodes a value after plainValue has reduced it to basic types
+func encodeMsgpack(value interface{}) []byte {
+	return appendMsgpack(nil, plainValue(value))
+}
+
+// msgpackFormats lists the fix format and the 8, 16 and 32-bit length formats of the
+// string, binary, array and map types; 0 where a format does not exist
+var msgpackFormats = map[string][4]byte{
+	"str":   {0xa0, 0xd9, 0xda, 0xdb},
+	"bin":   {0, 0xc4, 0xc5, 0xc6},
+	"array": {0x90, 0, 0xdc, 0xdd},
+	"map":   {0x80, 0, 0xde, 0xdf},
+}
+
+// appendMsgpackHeader writes the type and length of a string, binary, array or map
+func appendMsgpackHeader(buf []byte, kind string, length int) []byte {
+	formats := msgpackFormats[kind]
+	fixMax := 15
+	if kind == "str" {
+		fixMax = 31
+	}
+
+	switch {
+	case formats[0] != 0 && length <= fixMax:
+		return append(buf, formats[0]|byte(length))
+	case formats[1] != 0 && length <= math.MaxUint8:
+		return append(buf, formats[1], byte(length))
+	case length <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, formats[2]), uint16(length))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, formats[3]), uint32(length))
+}
+
+func appendMsgpack(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0xc0)
+	case bool:
+		if v {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case int64:
+		switch {
+		case v >= 0 && v <= 0x7f, v < 0 && v >= -32:
+			return append(buf, byte(v))
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(v))
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(v))
+	case uint64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), v)
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(v))
+	case string:
+		return append(appendMsgpackHeader(buf, "str", len(v)), v...)
+	case []byte:
+		return append(appendMsgpackHeader(buf, "bin", len(v)), v...)
+	case []interface{}:
+		buf = appendMsgpackHeader(buf, "array", len(v))
+		for _, item := range v {
+			buf = appendMsgpack(buf, item)
+		}
+		return buf
+	case map[string]interface{}:
+		buf = appendMsgpackHeader(buf, "map", len(v))
+		for _, key := range sortedKeys(v) {
+			buf = appendMsgpack(buf, key)
+			buf = appendMsgpack(buf, v[key])
+		}
+		return buf
+	}
+	return append(buf, 0xc0)
+}
+
+// sortedKeys returns the keys of an object in order, so encodings are deterministic
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
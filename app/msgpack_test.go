@@ -0,0 +1,85 @@
+package app
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "nil", value: nil},
+		{name: "bool", value: true},
+		{name: "fixint", value: int64(5)},
+		{name: "negative fixint", value: int64(-32)},
+		{name: "int32", value: int64(-100000)},
+		{name: "int64", value: int64(1700000000000000000)},
+		{name: "uint64", value: uint64(math.MaxUint64)},
+		{name: "float", value: 20.25},
+		{name: "fixstr", value: "temp"},
+		{name: "str 8", value: strings.Repeat("a", 40)},
+		{name: "str 16", value: strings.Repeat("a", 300)},
+		{name: "binary", value: []byte{0, 1, 2}},
+		{name: "array", value: []interface{}{int64(1), "a", nil}},
+		{name: "array 16", value: make([]interface{}, 20)},
+		{name: "map", value: map[string]interface{}{"reading": map[string]interface{}{"temp": 21.5}, "ok": false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeMsgpack(encodeMsgpack(test.value))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.value) {
+				t.Fatalf("got %#v, want %#v", got, test.value)
+			}
+		})
+	}
+}
+
+func TestDecodeMsgpack(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "uint8", input: []byte{0xcc, 0xff}, want: int64(255)},
+		{name: "int8", input: []byte{0xd0, 0xfe}, want: int64(-2)},
+		{name: "float32", input: []byte{0xca, 0x3f, 0xc0, 0, 0}, want: 1.5},
+		{name: "integer map key", input: []byte{0x81, 0x01, 0xa1, 'x'}, want: map[string]interface{}{"1": "x"}},
+
+		{name: "empty", input: []byte{}, wantErr: true},
+		{name: "truncated string", input: []byte{0xa3, 'a', 'b'}, wantErr: true},
+		{name: "truncated float", input: []byte{0xcb, 0, 0}, wantErr: true},
+		{name: "truncated array", input: []byte{0x92, 0x01}, wantErr: true},
+		{name: "truncated map", input: []byte{0x81, 0xa1, 'x'}, wantErr: true},
+		{name: "truncated length", input: []byte{0xdc, 0x00}, wantErr: true},
+		{name: "huge array length", input: []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "trailing data", input: []byte{0x01, 0x02}, wantErr: true},
+		{name: "unsupported type", input: []byte{0xc1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeMsgpack(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,576 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sqlPlan is a statement compiled into a segment scan over one collection
+type sqlPlan struct {
+	Statement     *sqlStatement
+	CollectionDir string
+	Precision     string
+	Start         int64
+	End           int64
+	Segments      []string
+}
+
+// isTimeRef reports whether an expression references the point timestamp
+func isTimeRef(expr sqlExpr) bool {
+	ref, ok := expr.(*sqlRef)
+	return ok && len(ref.Path) == 1 && strings.EqualFold(ref.Path[0], "time")
+}
+
+// resolveTimeLiterals converts strings compared with `time`, such as RFC3339 times or
+// 'now-1d/d', to ticks of a precision
+func resolveTimeLiterals(expr sqlExpr, precision string, now time.Time) error {
+	switch e := expr.(type) {
+	case *sqlNot:
+		return resolveTimeLiterals(e.Expr, precision, now)
+	case *sqlBinary:
+		if e.Op == "AND" || e.Op == "OR" {
+			if err := resolveTimeLiterals(e.Left, precision, now); err != nil {
+				return err
+			}
+			return resolveTimeLiterals(e.Right, precision, now)
+		}
+
+		for _, pair := range [][2]sqlExpr{{e.Left, e.Right}, {e.Right, e.Left}} {
+			literal, ok := pair[1].(*sqlLiteral)
+			if !isTimeRef(pair[0]) || !ok {
+				continue
+			}
+			if value, ok := literal.Value.(string); ok {
+				ts, err := parseTimestampAt(value, precision, now)
+				if err != nil {
+					return err
+				}
+				literal.Value = ts
+			}
+		}
+	}
+	return nil
+}
+
+// timeBounds narrows start and end using the time comparisons joined by top-level ANDs
+func timeBounds(expr sqlExpr, start, end int64) (int64, int64) {
+	binary, ok := expr.(*sqlBinary)
+	if !ok {
+		return start, end
+	}
+
+	if binary.Op == "AND" {
+		start, end = timeBounds(binary.Left, start, end)
+		return timeBounds(binary.Right, start, end)
+	}
+
+	op, left, right := binary.Op, binary.Left, binary.Right
+	if isTimeRef(right) {
+		// Flip `5 < time` into `time > 5`
+		flipped := map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<=", "=": "=", "!=": "!="}
+		op, left, right = flipped[op], right, left
+	}
+
+	literal, ok := right.(*sqlLiteral)
+	if !isTimeRef(left) || !ok {
+		return start, end
+	}
+	// low and high are the first time at or above the literal and the last time at or below it,
+	// so `time < 5.5` keeps t=5 and `time = 5.5` matches nothing
+	var low, high int64
+	switch number := literal.Value.(type) {
+	case int64:
+		low, high = number, number
+	case float64:
+		if math.IsNaN(number) {
+			return start, end
+		}
+		bound := float64(int64(1) << 62) // Far beyond any time, and safe to step past
+		low = int64(math.Max(-bound, math.Min(bound, math.Ceil(number))))
+		high = int64(math.Max(-bound, math.Min(bound, math.Floor(number))))
+	default:
+		return start, end
+	}
+
+	switch op {
+	case ">":
+		if high < math.MaxInt64 {
+			start = max(start, high+1)
+		}
+	case ">=":
+		start = max(start, low)
+	case "<":
+		if low > math.MinInt64 {
+			end = min(end, low-1)
+		}
+	case "<=":
+		end = min(end, high)
+	case "=":
+		start, end = max(start, low), min(end, high)
+	}
+	return start, end
+}
+
+// sqlValue resolves an operand against a point
+func sqlValue(expr sqlExpr, ts int64, data interface{}) (interface{}, bool) {
+	switch e := expr.(type) {
+	case *sqlLiteral:
+		return e.Value, true
+	case *sqlRef:
+		if isTimeRef(e) {
+			return ts, true
+		}
+		return lookupPath(data, e.Path)
+	}
+	return nil, false
+}
+
+// evalSQL evaluates a WHERE expression against a point
+func evalSQL(expr sqlExpr, ts int64, data interface{}) bool {
+	switch e := expr.(type) {
+	case nil:
+		return true
+	case *sqlNot:
+		return !evalSQL(e.Expr, ts, data)
+	case *sqlBinary:
+		switch e.Op {
+		case "AND":
+			return evalSQL(e.Left, ts, data) && evalSQL(e.Right, ts, data)
+		case "OR":
+			return evalSQL(e.Left, ts, data) || evalSQL(e.Right, ts, data)
+		}
+
+		left, ok := sqlValue(e.Left, ts, data)
+		if !ok {
+			return false
+		}
+		right, ok := sqlValue(e.Right, ts, data)
+		if !ok {
+			return false
+		}
+		return compareSQL(e.Op, left, right)
+	}
+	return false
+}
+
+// compareNumbers orders two int64 or float64 values. Integers are compared exactly, so
+// nanosecond times are not rounded to float64.
+func compareNumbers(left, right interface{}) (int, bool) {
+	switch l := left.(type) {
+	case int64:
+		switch r := right.(type) {
+		case int64:
+			switch {
+			case l < r:
+				return -1, true
+			case l > r:
+				return 1, true
+			}
+			return 0, true
+		case float64:
+			cmp, ok := compareNumbers(r, l)
+			return -cmp, ok
+		}
+	case float64:
+		if math.IsNaN(l) {
+			return 0, false
+		}
+		switch r := right.(type) {
+		case float64:
+			switch {
+			case l < r:
+				return -1, true
+			case l > r:
+				return 1, true
+			}
+			return 0, !math.IsNaN(r)
+		case int64:
+			// Compare the integer part exactly, then the fraction
+			floor := math.Floor(l)
+			switch {
+			case floor >= math.MaxInt64:
+				return 1, true
+			case floor < math.MinInt64:
+				return -1, true
+			case int64(floor) < r:
+				return -1, true
+			case int64(floor) > r || l != floor:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// compareSQL compares two values of the same type; mismatched types never match
+func compareSQL(op string, left, right interface{}) bool {
+	cmp := 0
+	switch l := left.(type) {
+	case int64, float64:
+		var ok bool
+		if cmp, ok = compareNumbers(l, right); !ok {
+			return false
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	case bool:
+		r, ok := right.(bool)
+		if !ok || (op != "=" && op != "!=") {
+			return false
+		}
+		if l != r {
+			cmp = 1
+		}
+	default:
+		return false
+	}
+
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// formatSQLExpr renders a WHERE expression for EXPLAIN output
+func formatSQLExpr(expr sqlExpr) string {
+	switch e := expr.(type) {
+	case *sqlNot:
+		return fmt.Sprintf("NOT (%s)", formatSQLExpr(e.Expr))
+	case *sqlBinary:
+		if e.Op == "OR" {
+			return fmt.Sprintf("(%s OR %s)", formatSQLExpr(e.Left), formatSQLExpr(e.Right))
+		}
+		return fmt.Sprintf("%s %s %s", formatSQLExpr(e.Left), e.Op, formatSQLExpr(e.Right))
+	case *sqlRef:
+		return strings.Join(e.Path, ".")
+	case *sqlLiteral:
+		switch v := e.Value.(type) {
+		case string:
+			return fmt.Sprintf("'%s'", strings.ReplaceAll(v, "'", "\\'"))
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case int64:
+			return strconv.FormatInt(v, 10)
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// spec converts an aggregate SELECT item to the aggregation it runs
+func (field sqlField) spec(interval int64, precision, fill string) aggregateSpec {
+	spec := aggregateSpec{Function: field.Function, Field: field.Path, Fill: fill}
+	if interval > 0 {
+		spec.Interval = fmt.Sprintf("%d%s", interval, precision)
+	}
+
+	switch field.Function {
+	case "percentile":
+		if len(field.Args) > 0 {
+			spec.Percentile = field.Args[0]
+		}
+	case "histogram":
+		spec.Buckets = field.Args
+	}
+	return spec
+}
+
+// columnNames returns the output name of each SELECT item
+func columnNames(fields []sqlField) []string {
+	names := []string{}
+	used := map[string]int{}
+	for _, field := range fields {
+		name := field.Alias
+		if name == "" {
+			name = field.Function
+		}
+		if name == "" {
+			name = field.Path
+		}
+
+		// Repeated names get a numeric suffix, e.g. mean and mean_1
+		if count := used[name]; count > 0 {
+			used[name] = count + 1
+			name = fmt.Sprintf("%s_%d", name, count)
+		} else {
+			used[name] = 1
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// planSQL validates a statement and resolves the segments it will read
+func planSQL(stmt *sqlStatement, now time.Time) (*sqlPlan, error) {
+	dataPath := "./data" // Base directory for data
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, stmt.Collection)
+
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+
+	aggregates := 0
+	for _, field := range stmt.Fields {
+		if field.Function != "" {
+			aggregates++
+		}
+	}
+	if aggregates > 0 && aggregates != len(stmt.Fields) {
+		return nil, fmt.Errorf("mixing aggregate functions and raw fields is not supported")
+	}
+	if aggregates == 0 && (stmt.Interval > 0 || stmt.Fill != "") {
+		return nil, fmt.Errorf("GROUP BY time and FILL require aggregate functions")
+	}
+	if stmt.Fill != "" && stmt.Interval == 0 {
+		return nil, fmt.Errorf("FILL requires GROUP BY time(...)")
+	}
+
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveTimeLiterals(stmt.Where, manifest.Precision, now); err != nil {
+		return nil, err
+	}
+
+	// Without an upper time bound the scan stops at now
+	start, end := timeBounds(stmt.Where, 0, math.MaxInt64)
+	if end == math.MaxInt64 {
+		end = timestampOf(now, manifest.Precision)
+	}
+	for _, field := range stmt.Fields {
+		if field.Function == "" {
+			continue
+		}
+		if err := validateAggregate(field.spec(stmt.Interval, manifest.Precision, stmt.Fill), manifest.Precision, start, end); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &sqlPlan{
+		Statement:     stmt,
+		CollectionDir: collectionDir,
+		Precision:     manifest.Precision,
+		Start:         start,
+		End:           end,
+		Segments:      []string{},
+	}
+	if start > end {
+		return plan, nil
+	}
+
+	list, err := findSeries(collectionDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := seriesSegmentFiles(list, start, end)
+	if err != nil {
+		return nil, err
+	}
+	plan.Segments = segments
+	return plan, nil
+}
+
+// explain describes the work a plan would do
+func (plan *sqlPlan) explain() gin.H {
+	stmt := plan.Statement
+
+	segments := []string{}
+	for _, segment := range plan.Segments {
+		segments = append(segments, strings.TrimPrefix(segment, plan.CollectionDir+"/"))
+	}
+
+	selects := []string{}
+	for _, field := range stmt.Fields {
+		if field.Function != "" {
+			selects = append(selects, fmt.Sprintf("%s(%s)", field.Function, field.Path))
+		} else {
+			selects = append(selects, field.Path)
+		}
+	}
+	if len(selects) == 0 {
+		selects = append(selects, "*")
+	}
+
+	explain := gin.H{
+		"collection": stmt.Collection,
+		"start":      plan.Start,
+		"end":        plan.End,
+		"select":     selects,
+		"segments":   segments,
+	}
+	if stmt.Where != nil {
+		explain["filter"] = formatSQLExpr(stmt.Where)
+	}
+	if stmt.Interval > 0 {
+		explain["interval"] = stmt.Interval
+	}
+	if stmt.Fill != "" {
+		explain["fill"] = stmt.Fill
+	}
+	return explain
+}
+
+// execute runs the segment scan and aggregations of a plan
+func (plan *sqlPlan) execute() ([]map[string]interface{}, error) {
+	stmt := plan.Statement
+	result := []map[string]interface{}{}
+	if plan.Start > plan.End {
+		return result, nil
+	}
+
+	aggregated := len(stmt.Fields) > 0 && stmt.Fields[0].Function != ""
+	names := columnNames(stmt.Fields)
+
+	paths := make([][]string, len(stmt.Fields))
+	aggregators := make([]*aggregator, len(stmt.Fields))
+	for i, field := range stmt.Fields {
+		if field.Path != "" {
+			paths[i] = strings.Split(field.Path, ".")
+		}
+		aggregators[i] = newAggregator(field.spec(stmt.Interval, plan.Precision, stmt.Fill), plan.Start, stmt.Interval)
+	}
+
+	err := scanRange(plan.CollectionDir, plan.Start, plan.End, func(point dataPoint) error {
+		data := decodeData(point.Data)
+		if !evalSQL(stmt.Where, point.Time, data) {
+			return nil
+		}
+
+		if aggregated {
+			for i, field := range stmt.Fields {
+				if value, ok := aggregateValue(field.Function, data, paths[i]); ok {
+					aggregators[i].add(point.Time, value)
+				}
+			}
+			return nil
+		}
+
+		if len(stmt.Fields) > 0 {
+			row := map[string]interface{}{}
+			for i := range stmt.Fields {
+				if value, ok := lookupPath(data, paths[i]); ok {
+					row[names[i]] = value
+				}
+			}
+			data = row
+		}
+		result = append(result, map[string]interface{}{"time": point.Time, "data": data})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if aggregated {
+		// Join the series of every SELECT item on their bucket time
+		rows := map[int64]map[string]interface{}{}
+		times := []int64{}
+		for i := range stmt.Fields {
+			series, err := fillBuckets(aggregators[i].series(), plan.Start, plan.End, stmt.Interval, stmt.Fill)
+			if err != nil {
+				return nil, err
+			}
+			for _, point := range series {
+				ts := point["time"].(int64)
+				row, exists := rows[ts]
+				if !exists {
+					row = map[string]interface{}{}
+					for _, name := range names {
+						row[name] = nil
+					}
+					rows[ts] = row
+					times = append(times, ts)
+				}
+				row[names[i]] = point["data"]
+			}
+		}
+
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		for _, ts := range times {
+			result = append(result, map[string]interface{}{"time": ts, "data": rows[ts]})
+		}
+	}
+
+	if stmt.Descending {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+
+	// Apply offset and limit
+	if stmt.Offset >= len(result) {
+		result = result[:0]
+	} else {
+		result = result[stmt.Offset:]
+	}
+	if stmt.Limit > 0 && stmt.Limit < len(result) {
+		result = result[:stmt.Limit]
+	}
+
+	return result, nil
+}
+
+func sql_query(c *gin.Context) {
+	var request struct {
+		Query string `json:"query"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.Query == "" {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	now := time.Now()
+	stmt, err := parseSQL(request.Query, now, collectionPrecision)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid query: %v", err)})
+		return
+	}
+
+	plan, err := planSQL(stmt, now)
+	if os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", stmt.Collection)})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid query: %v", err)})
+		return
+	}
+
+	if stmt.Explain {
+		c.JSON(200, gin.H{"plan": plan.explain()})
+		return
+	}
+
+	result, err := plan.execute()
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to execute query: %v", err)})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": result})
+}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// precisionUnits maps a timestamp precision to the nanoseconds in one of its ticks
+var precisionUnits = map[string]int64{
+	"s":  int64(time.Second),
+	"ms": int64(time.Millisecond),
+	"us": int64(time.Microsecond),
+	"ns": 1,
+}
+
+// precisionUnit returns the nanoseconds in one tick, treating an unset precision as milliseconds
+func precisionUnit(precision string) int64 {
+	if unit, exists := precisionUnits[precision]; exists {
+		return unit
+	}
+	return int64(time.Millisecond)
+}
+
+// unixTime converts a timestamp in ticks of a precision to a time
+func unixTime(ts int64, precision string) time.Time {
+	switch precision {
+	case "s":
+		return time.Unix(ts, 0)
+	case "us":
+		return time.UnixMicro(ts)
+	case "ns":
+		return time.Unix(0, ts)
+	}
+	return time.UnixMilli(ts)
+}
+
+// timestampOf converts a time to ticks of a precision, truncating finer digits
+func timestampOf(t time.Time, precision string) int64 {
+	switch precision {
+	case "s":
+		return t.Unix()
+	case "us":
+		return t.UnixMicro()
+	case "ns":
+		return t.UnixNano()
+	}
+	return t.UnixMilli()
+}
+
+// parseTimestamp reads an integer in ticks of a precision, an RFC3339 time or a relative
+// expression such as "now-15m", "now-1d/d" or "-7d"
+func parseTimestamp(value, precision string) (int64, error) {
+	return parseTimestampAt(value, precision, time.Now())
+}
+
+// parseTimestampAt is parseTimestamp with relative expressions evaluated against now
+func parseTimestampAt(value, precision string, now time.Time) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("missing time")
+	}
+
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestampOf(t, precision), nil
+	}
+
+	t, err := relativeTime(value, now)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s': %v", value, err)
+	}
+	return timestampOf(t, precision), nil
+}
+
+// relativeTime evaluates "now" followed by offsets such as "-15m" or "+1h" and an optional
+// rounding such as "/d". A leading offset like "-7d" is relative to now.
+func relativeTime(expr string, now time.Time) (time.Time, error) {
+	rest := strings.TrimPrefix(expr, "now")
+	if rest == expr && !strings.HasPrefix(expr, "-") && !strings.HasPrefix(expr, "+") {
+		return time.Time{}, fmt.Errorf("expected a timestamp, an RFC3339 time or an expression such as 'now-15m'")
+	}
+
+	rounding := ""
+	if slash := strings.Index(rest, "/"); slash >= 0 {
+		rest, rounding = rest[:slash], rest[slash+1:]
+	}
+
+	t := now
+	for rest != "" {
+		sign := rest[0]
+		if sign != '+' && sign != '-' {
+			return time.Time{}, fmt.Errorf("expected '+' or '-' before '%s'", rest)
+		}
+
+		// The offset runs until the next sign
+		term := rest[1:]
+		rest = ""
+		if next := strings.IndexAny(term, "+-"); next >= 0 {
+			term, rest = term[:next], term[next:]
+		}
+
+		offset, err := parseInterval(term, "ns")
+		if err != nil {
+			return time.Time{}, err
+		}
+		if sign == '-' {
+			offset = -offset
+		}
+		t = t.Add(time.Duration(offset))
+	}
+
+	if rounding == "" {
+		return t, nil
+	}
+	return roundTime(t, rounding)
+}
+
+// roundTime rounds a time down to the start of its second, minute, hour, day, week
+// (from Monday), month or year in local time
+func roundTime(t time.Time, unit string) (time.Time, error) {
+	year, month, day := t.Date()
+	hour, minute, second := t.Clock()
+
+	switch unit {
+	case "s":
+		return time.Date(year, month, day, hour, minute, second, 0, t.Location()), nil
+	case "m":
+		return time.Date(year, month, day, hour, minute, 0, 0, t.Location()), nil
+	case "h":
+		return time.Date(year, month, day, hour, 0, 0, 0, t.Location()), nil
+	case "d":
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location()), nil
+	case "w":
+		sinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-sinceMonday, 0, 0, 0, 0, t.Location()), nil
+	case "M":
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location()), nil
+	case "y":
+		return time.Date(year, 1, 1, 0, 0, 0, 0, t.Location()), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown rounding unit '%s'", unit)
+}
+
+// decodeTimestamp reads a JSON number in ticks of a precision or a string accepted by parseTimestamp
+func decodeTimestamp(raw json.RawMessage, precision string) (int64, error) {
+	return decodeTimestampAt(raw, precision, time.Now())
+}
+
+// decodeTimestampAt is decodeTimestamp with relative expressions evaluated against now
+func decodeTimestampAt(raw json.RawMessage, precision string, now time.Time) (int64, error) {
+	value := strings.TrimSpace(string(raw))
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return 0, fmt.Errorf("invalid timestamp %s", raw)
+		}
+	}
+	return parseTimestampAt(value, precision, now)
+}
+
+// collectionPrecision returns the timestamp precision of a collection, milliseconds if it has none
+func collectionPrecision(collectionName string) string {
+	dataPath := "./data" // Base directory for data
+
+	manifest, err := loadManifest(fmt.Sprintf("%s/%s", dataPath, collectionName))
+	if err != nil {
+		return "ms"
+	}
+	return manifest.Precision
+}
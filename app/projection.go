@@ -0,0 +1,67 @@
+package app
+
+import (
+	"strings"
+)
+
+// parseFields splits a `fields` query value like "temp,meta.location" into dotted paths.
+func parseFields(param string) [][]string {
+	if param == "" {
+		return nil
+	}
+
+	paths := [][]string{}
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		paths = append(paths, strings.Split(field, "."))
+	}
+	return paths
+}
+
+// projectFields keeps only the selected JSON paths of a decoded payload.
+// Paths that do not exist in the payload are left out of the result.
+func projectFields(data interface{}, paths [][]string) interface{} {
+	if len(paths) == 0 {
+		return data
+	}
+
+	result := map[string]interface{}{}
+	for _, path := range paths {
+		value, ok := lookupPath(data, path)
+		if !ok {
+			continue
+		}
+
+		// Rebuild the nested objects leading to the selected value
+		node := result
+		for _, key := range path[:len(path)-1] {
+			child, ok := node[key].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[key] = child
+			}
+			node = child
+		}
+		node[path[len(path)-1]] = value
+	}
+	return result
+}
+
+// lookupPath walks a decoded JSON value following the given object keys.
+func lookupPath(data interface{}, path []string) (interface{}, bool) {
+	current := data
+	for _, key := range path {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
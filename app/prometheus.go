@@ -0,0 +1,591 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// promSeries is a time series of the Prometheus remote protocols
+type promSeries struct {
+	Labels  map[string]string
+	Samples []promSample
+}
+
+// promSample is a value at a time in milliseconds
+type promSample struct {
+	Value float64
+	Time  int64
+}
+
+// decodeWriteRequest reads the series of a prometheus.WriteRequest. Metadata, exemplars
+// and native histograms are skipped.
+func decodeWriteRequest(buf []byte) ([]promSeries, error) {
+	list := []promSeries{}
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return list, nil
+		}
+		if field != 1 || wireType != protoBytes {
+			if err := reader.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		message, err := reader.bytes()
+		if err != nil {
+			return nil, err
+		}
+		series, err := decodeTimeSeries(message)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, series)
+	}
+}
+
+// decodeTimeSeries reads the labels and samples of a prometheus.TimeSeries
+func decodeTimeSeries(buf []byte) (promSeries, error) {
+	series := promSeries{Labels: map[string]string{}}
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil {
+			return series, err
+		}
+		if !ok {
+			return series, nil
+		}
+		if (field != 1 && field != 2) || wireType != protoBytes {
+			if err := reader.skip(wireType); err != nil {
+				return series, err
+			}
+			continue
+		}
+
+		message, err := reader.bytes()
+		if err != nil {
+			return series, err
+		}
+		if field == 1 {
+			name, value, err := decodeLabel(message)
+			if err != nil {
+				return series, err
+			}
+			series.Labels[name] = value
+		} else {
+			sample, err := decodeSample(message)
+			if err != nil {
+				return series, err
+			}
+			series.Samples = append(series.Samples, sample)
+		}
+	}
+}
+
+func decodeLabel(buf []byte) (string, string, error) {
+	name, value := "", ""
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil || !ok {
+			return name, value, err
+		}
+		if (field != 1 && field != 2) || wireType != protoBytes {
+			if err := reader.skip(wireType); err != nil {
+				return name, value, err
+			}
+			continue
+		}
+
+		text, err := reader.bytes()
+		if err != nil {
+			return name, value, err
+		}
+		if field == 1 {
+			name = string(text)
+		} else {
+			value = string(text)
+		}
+	}
+}
+
+func decodeSample(buf []byte) (promSample, error) {
+	sample := promSample{}
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil || !ok {
+			return sample, err
+		}
+		switch {
+		case field == 1 && wireType == protoFixed64:
+			sample.Value, err = reader.double()
+		case field == 2 && wireType == protoVarint:
+			var ts uint64
+			ts, err = reader.varint()
+			sample.Time = int64(ts)
+		default:
+			err = reader.skip(wireType)
+		}
+		if err != nil {
+			return sample, err
+		}
+	}
+}
+
+// remote_write receives Prometheus remote_write requests. The samples of each metric go to
+// the collection named after it, created with millisecond precision on first use, and its
+// other labels become series tags. The value of a sample is the data of its point.
+func remote_write(c *gin.Context) {
+	dataPath := "./data" // Base directory for data
+
+	if strings.Contains(c.GetHeader("Content-Type"), "io.prometheus.write.v2") {
+		c.JSON(415, gin.H{"error": "Only remote write 1.0 is supported"})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if c.GetHeader("Content-Encoding") == "snappy" {
+		if body, err = snappyDecode(body); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid snappy body: %v", err)})
+			return
+		}
+	}
+
+	list, err := decodeWriteRequest(body)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid write request: %v", err)})
+		return
+	}
+
+	// Group the samples by metric, checking every series first
+	items := map[string][]ingestItem{} // Collection -> points
+	for _, series := range list {
+		name := series.Labels["__name__"]
+		if !validCollectionName(name) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid metric name '%s'", name)})
+			return
+		}
+
+		// An empty label is the same as a missing one
+		tags := map[string]string{}
+		for key, value := range series.Labels {
+			if key != "__name__" && value != "" {
+				tags[key] = value
+			}
+		}
+		if err := validateTags(tags); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid labels of '%s': %v", name, err)})
+			return
+		}
+
+		for _, sample := range series.Samples {
+			// Staleness markers are NaN, which JSON cannot hold
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+			items[name] = append(items[name], ingestItem{
+				Time: []byte(strconv.FormatInt(sample.Time, 10)),
+				Data: sample.Value,
+				Tags: tags,
+			})
+		}
+	}
+
+	collections := make([]string, 0, len(items))
+	for collection := range items {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	for _, collection := range collections {
+		collectionDir := fmt.Sprintf("%s/%s", dataPath, collection)
+		if err := ensureCollection(collectionDir, "ms"); err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create collection '%s': %v", collection, err)})
+			return
+		}
+
+		// Collections created otherwise may use another precision
+		precision := collectionPrecision(collection)
+		if precision != "ms" {
+			for i, item := range items[collection] {
+				ts, _ := strconv.ParseInt(string(item.Time), 10, 64)
+				ts = ts * int64(time.Millisecond) / precisionUnit(precision)
+				items[collection][i].Time = []byte(strconv.FormatInt(ts, 10))
+			}
+		}
+
+		result, err := ingest(collection, items[collection], false)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if len(result.Failures) > 0 {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("%d sample(s) of '%s' were rejected", len(result.Failures), collection), "items": result.Failures})
+			return
+		}
+	}
+
+	c.Status(204)
+}
+
+// promMatcherTypes are the label matcher types of the remote read protocol, by number
+var promMatcherTypes = []string{"=", "!=", "=~", "!~"}
+
+// promQuery is a query of a prometheus.ReadRequest, with times in milliseconds
+type promQuery struct {
+	Start    int64
+	End      int64
+	Matchers []promMatcher
+}
+
+// decodeReadRequest reads the queries of a prometheus.ReadRequest. Hints are skipped.
+func decodeReadRequest(buf []byte) ([]promQuery, error) {
+	queries := []promQuery{}
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return queries, nil
+		}
+		if field != 1 || wireType != protoBytes {
+			if err := reader.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		message, err := reader.bytes()
+		if err != nil {
+			return nil, err
+		}
+		query, err := decodeQuery(message)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+}
+
+func decodeQuery(buf []byte) (promQuery, error) {
+	query := promQuery{}
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil || !ok {
+			return query, err
+		}
+		switch {
+		case (field == 1 || field == 2) && wireType == protoVarint:
+			var ts uint64
+			ts, err = reader.varint()
+			if field == 1 {
+				query.Start = int64(ts)
+			} else {
+				query.End = int64(ts)
+			}
+		case field == 3 && wireType == protoBytes:
+			var message []byte
+			if message, err = reader.bytes(); err == nil {
+				var matcher promMatcher
+				if matcher, err = decodeLabelMatcher(message); err == nil {
+					query.Matchers = append(query.Matchers, matcher)
+				}
+			}
+		default:
+			err = reader.skip(wireType)
+		}
+		if err != nil {
+			return query, err
+		}
+	}
+}
+
+func decodeLabelMatcher(buf []byte) (promMatcher, error) {
+	kind, name, value := uint64(0), "", ""
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil {
+			return promMatcher{}, err
+		}
+		if !ok {
+			break
+		}
+		switch {
+		case field == 1 && wireType == protoVarint:
+			kind, err = reader.varint()
+		case (field == 2 || field == 3) && wireType == protoBytes:
+			var text []byte
+			text, err = reader.bytes()
+			if field == 2 {
+				name = string(text)
+			} else {
+				value = string(text)
+			}
+		default:
+			err = reader.skip(wireType)
+		}
+		if err != nil {
+			return promMatcher{}, err
+		}
+	}
+
+	if kind >= uint64(len(promMatcherTypes)) {
+		return promMatcher{}, fmt.Errorf("invalid matcher type %d", kind)
+	}
+	return newPromMatcher(name, promMatcherTypes[kind], value)
+}
+
+// encodeQueryResult writes the series of a prometheus.QueryResult, with sorted labels
+func encodeQueryResult(list []promSeries) []byte {
+	result := &protoWriter{}
+	for _, series := range list {
+		names := make([]string, 0, len(series.Labels))
+		for name := range series.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		message := &protoWriter{}
+		for _, name := range names {
+			label := &protoWriter{}
+			label.bytes(1, []byte(name))
+			label.bytes(2, []byte(series.Labels[name]))
+			message.bytes(1, label.buf)
+		}
+		for _, sample := range series.Samples {
+			encoded := &protoWriter{}
+			encoded.double(1, sample.Value)
+			encoded.varint(2, uint64(sample.Time))
+			message.bytes(2, encoded.buf)
+		}
+		result.bytes(1, message.buf)
+	}
+	return result.buf
+}
+
+// remote_read answers Prometheus remote_read requests with the numeric points of the
+// series matching each query. Responses always use the sampled format.
+func remote_read(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if c.GetHeader("Content-Encoding") == "snappy" {
+		if body, err = snappyDecode(body); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid snappy body: %v", err)})
+			return
+		}
+	}
+
+	queries, err := decodeReadRequest(body)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid read request: %v", err)})
+		return
+	}
+
+	response := &protoWriter{}
+	for _, query := range queries {
+		selected, err := selectPromSeries(query.Matchers)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		list := []promSeries{}
+		for _, series := range selected {
+			samples, err := promSamples(series.Series, query.Start, query.End)
+			if err != nil {
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to read series: %v", err)})
+				return
+			}
+			if len(samples) > 0 {
+				list = append(list, promSeries{Labels: series.Labels, Samples: samples})
+			}
+		}
+		response.bytes(1, encodeQueryResult(list))
+	}
+
+	c.Header("Content-Encoding", "snappy")
+	c.Data(200, "application/x-protobuf", snappyEncode(response.buf))
+}
+
+// promMaxPoints bounds the steps of a range query, as Prometheus does
+const promMaxPoints = 11000
+
+// promParam reads a parameter of the HTTP API from the URL or a form body
+func promParam(c *gin.Context, name string) string {
+	if value := c.Query(name); value != "" {
+		return value
+	}
+	return c.PostForm(name)
+}
+
+// parsePromTime reads an RFC 3339 time or Unix seconds as milliseconds
+func parsePromTime(value string) (int64, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return int64(math.Round(seconds * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s'", value)
+	}
+	return t.UnixMilli(), nil
+}
+
+// parsePromDuration reads a duration such as 15s or a number of seconds as milliseconds.
+// Durations shorter than half a millisecond round to zero and are rejected.
+func parsePromDuration(value string) (int64, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		milliseconds := math.Round(seconds * 1000)
+		if milliseconds <= 0 || milliseconds > math.MaxInt64/2 || math.IsNaN(milliseconds) {
+			return 0, fmt.Errorf("invalid duration '%s', must be at least 1ms", value)
+		}
+		return int64(milliseconds), nil
+	}
+	duration, err := parseInterval(value, "ms")
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%s'", value)
+	}
+	return duration, nil
+}
+
+// promValue formats a value the way the Prometheus HTTP API does
+func promValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func promError(c *gin.Context, code int, errorType string, err error) {
+	c.JSON(code, gin.H{"status": "error", "errorType": errorType, "error": err.Error()})
+}
+
+// evaluatePromQL parses and evaluates a query, sorting the result by labels
+func evaluatePromQL(query string, evaluator *promEvaluator) (promExpr, []promResult, int, string, error) {
+	expr, err := parsePromQL(query)
+	if err != nil {
+		return nil, nil, 400, "bad_data", fmt.Errorf("invalid query: %v", err)
+	}
+	results, err := evaluator.eval(expr)
+	if err != nil {
+		return nil, nil, 422, "execution", err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return seriesKey(results[i].Labels) < seriesKey(results[j].Labels)
+	})
+	return expr, results, 0, "", nil
+}
+
+// query_range evaluates a PromQL query at every step of a range, like the Prometheus
+// HTTP API, so dashboards built for Prometheus can read sanDB collections
+func query_range(c *gin.Context) {
+	start, err := parsePromTime(promParam(c, "start"))
+	if err != nil {
+		promError(c, 400, "bad_data", fmt.Errorf("invalid parameter 'start': %v", err))
+		return
+	}
+	end, err := parsePromTime(promParam(c, "end"))
+	if err != nil {
+		promError(c, 400, "bad_data", fmt.Errorf("invalid parameter 'end': %v", err))
+		return
+	}
+	step, err := parsePromDuration(promParam(c, "step"))
+	if err != nil {
+		promError(c, 400, "bad_data", fmt.Errorf("invalid parameter 'step': %v", err))
+		return
+	}
+	if end < start {
+		promError(c, 400, "bad_data", fmt.Errorf("end timestamp must not be before start time"))
+		return
+	}
+	if (end-start)/step >= promMaxPoints {
+		promError(c, 400, "bad_data", fmt.Errorf("exceeded maximum resolution of %d points per timeseries", promMaxPoints))
+		return
+	}
+
+	evaluator := newPromEvaluator(start, end, step)
+	_, results, code, errorType, err := evaluatePromQL(promParam(c, "query"), evaluator)
+	if err != nil {
+		promError(c, code, errorType, err)
+		return
+	}
+
+	matrix := []gin.H{}
+	for _, result := range results {
+		values := [][]interface{}{}
+		for i, present := range result.Present {
+			if present {
+				values = append(values, []interface{}{float64(evaluator.at(i)) / 1000, promValue(result.Values[i])})
+			}
+		}
+		if len(values) > 0 {
+			matrix = append(matrix, gin.H{"metric": result.Labels, "values": values})
+		}
+	}
+
+	c.JSON(200, gin.H{"status": "success", "data": gin.H{"resultType": "matrix", "result": matrix}})
+}
+
+// query_instant evaluates a PromQL query at a single time, by default now
+func query_instant(c *gin.Context) {
+	at := time.Now().UnixMilli()
+	if value := promParam(c, "time"); value != "" {
+		parsed, err := parsePromTime(value)
+		if err != nil {
+			promError(c, 400, "bad_data", fmt.Errorf("invalid parameter 'time': %v", err))
+			return
+		}
+		at = parsed
+	}
+
+	evaluator := newPromEvaluator(at, at, 1)
+	expr, results, code, errorType, err := evaluatePromQL(promParam(c, "query"), evaluator)
+	if err != nil {
+		promError(c, code, errorType, err)
+		return
+	}
+
+	sample := func(value float64) []interface{} {
+		return []interface{}{float64(at) / 1000, promValue(value)}
+	}
+	if _, ok := expr.(promNumber); ok {
+		c.JSON(200, gin.H{"status": "success", "data": gin.H{"resultType": "scalar", "result": sample(results[0].Values[0])}})
+		return
+	}
+
+	vector := []gin.H{}
+	for _, result := range results {
+		if result.Present[0] {
+			vector = append(vector, gin.H{"metric": result.Labels, "value": sample(result.Values[0])})
+		}
+	}
+	c.JSON(200, gin.H{"status": "success", "data": gin.H{"resultType": "vector", "result": vector}})
+}
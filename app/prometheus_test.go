@@ -0,0 +1,237 @@
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unhex decodes a fixture written as hex
+func unhex(t *testing.T, text string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	// up{job="node"} 1.5 @1000, -2 @2000 and temp 20.25 @1700000000000, followed by the
+	// metadata of up, which is skipped
+	fixture := "0a390a0e0a085f5f6e616d655f5f120275700a0b0a036a6f6212046e6f6465120c09000000000000f83f10e807" +
+		"120c0900000000000000c010d00f0a240a100a085f5f6e616d655f5f120474656d7012100900000000004034401080d095ffbc31" +
+		"1a06080112027570"
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []promSeries
+		wantErr bool
+	}{
+		{
+			name:  "series and metadata",
+			input: unhex(t, fixture),
+			want: []promSeries{
+				{
+					Labels:  map[string]string{"__name__": "up", "job": "node"},
+					Samples: []promSample{{Value: 1.5, Time: 1000}, {Value: -2, Time: 2000}},
+				},
+				{
+					Labels:  map[string]string{"__name__": "temp"},
+					Samples: []promSample{{Value: 20.25, Time: 1700000000000}},
+				},
+			},
+		},
+		{name: "empty request", input: []byte{}, want: []promSeries{}},
+		{name: "truncated series", input: unhex(t, fixture)[:20], wantErr: true},
+		{name: "truncated sample", input: unhex(t, "0a0612040900000000"), wantErr: true},
+		{name: "invalid varint", input: []byte{0x0a, 0xff}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeWriteRequest(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteBody(t *testing.T) {
+	// remote_write bodies are snappy blocks around the WriteRequest
+	fixture := unhex(t, "0a1b0a0e0a085f5f6e616d655f5f12027570120909000000000000f03f")
+	decoded, err := snappyDecode(snappyEncode(fixture))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := decodeWriteRequest(decoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []promSeries{{Labels: map[string]string{"__name__": "up"}, Samples: []promSample{{Value: 1}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeReadRequest(t *testing.T) {
+	// One query from 1000 to 2000 for up{job=~"n.*"} with hints, accepting sampled responses
+	fixture := "0a2908e80710d00f1a0e12085f5f6e616d655f5f1a0275701a0c080212036a6f621a036e2e2a2203089875120100"
+
+	tests := []struct {
+		name     string
+		input    []byte
+		start    int64
+		end      int64
+		matchers []string
+		wantErr  bool
+	}{
+		{
+			name:     "query with matchers and hints",
+			input:    unhex(t, fixture),
+			start:    1000,
+			end:      2000,
+			matchers: []string{`__name__="up"`, `job=~"n.*"`},
+		},
+		{name: "truncated query", input: unhex(t, fixture)[:12], wantErr: true},
+		{name: "unknown matcher type", input: unhex(t, "0a071a050807120178"), wantErr: true},
+		{name: "invalid regular expression", input: unhex(t, "0a0d1a0b080212036a6f621a02282a"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeReadRequest(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != 1 || got[0].Start != test.start || got[0].End != test.end {
+				t.Fatalf("got %+v, want one query from %d to %d", got, test.start, test.end)
+			}
+
+			matchers := []string{}
+			for _, matcher := range got[0].Matchers {
+				matchers = append(matchers, fmt.Sprintf("%s%s%q", matcher.Name, matcher.Type, matcher.Value))
+			}
+			if !reflect.DeepEqual(matchers, test.matchers) {
+				t.Fatalf("got matchers %v, want %v", matchers, test.matchers)
+			}
+		})
+	}
+}
+
+func TestEncodeQueryResult(t *testing.T) {
+	list := []promSeries{{
+		Labels:  map[string]string{"job": "node", "__name__": "up"},
+		Samples: []promSample{{Value: 1, Time: 1000}},
+	}}
+
+	// Labels are written sorted by name
+	want := "0a2b0a0e0a085f5f6e616d655f5f120275700a0b0a036a6f6212046e6f6465120c09000000000000f03f10e807"
+	if got := hex.EncodeToString(encodeQueryResult(list)); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestParsePromDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "15s", want: 15000},
+		{input: "1m", want: 60000},
+		{input: "30", want: 30000},
+		{input: "0.5", want: 500},
+		{input: "0.001", want: 1},
+		{input: "0.0001", wantErr: true},
+		{input: "0", wantErr: true},
+		{input: "-5", wantErr: true},
+		{input: "NaN", wantErr: true},
+		{input: "1e300", wantErr: true},
+		{input: "soon", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := parsePromDuration(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Fatalf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteLabelCommas(t *testing.T) {
+	useDataDir(t)
+
+	// up{instance="a,b"} 1 and up{instance="a"} 2, both @1700000000000
+	fixture := unhex(t, "0a330a0e0a085f5f6e616d655f5f120275700a0f0a08696e7374616e63651203612c62121009000000000000f03f1080d095ffbc31"+
+		"0a310a0e0a085f5f6e616d655f5f120275700a0d0a08696e7374616e636512016112100900000000000000401080d095ffbc31")
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappyEncode(fixture)))
+	c.Request.Header.Set("Content-Encoding", "snappy")
+	remote_write(c)
+	c.Writer.WriteHeaderNow()
+	if recorder.Code != 204 {
+		t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Each label set is its own series, read back with its value intact
+	for value, want := range map[string]float64{"a,b": 1, "a": 2} {
+		list, err := findSeries("./data/up", map[string]string{"instance": value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Tags["instance"] != value {
+			t.Fatalf("got series %+v for instance %q", list, value)
+		}
+
+		points := []float64{}
+		err = scanRange(list[0].Dir, 1700000000000, 1700000000000, func(point dataPoint) error {
+			number, _ := decodeData(point.Data).(float64)
+			points = append(points, number)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(points, []float64{want}) {
+			t.Fatalf("got %v for instance %q, want %v", points, value, want)
+		}
+	}
+}
@@ -0,0 +1,836 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// promLookback is how far back an instant selector looks for the latest sample, in milliseconds
+const promLookback = int64(5 * time.Minute / time.Millisecond)
+
+// promMatcher is a label matcher of a selector
+type promMatcher struct {
+	Name  string
+	Type  string // =, !=, =~ or !~
+	Value string
+
+	re *regexp.Regexp
+}
+
+func newPromMatcher(name, kind, value string) (promMatcher, error) {
+	matcher := promMatcher{Name: name, Type: kind, Value: value}
+	if kind == "=~" || kind == "!~" {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return matcher, fmt.Errorf("invalid regular expression '%s': %v", value, err)
+		}
+		matcher.re = re
+	}
+	return matcher, nil
+}
+
+// matches checks a label value; a missing label has the empty value
+func (m promMatcher) matches(value string) bool {
+	switch m.Type {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	}
+	return !m.re.MatchString(value)
+}
+
+// promSelected is a stored series matching a selector
+type promSelected struct {
+	Labels map[string]string // Series tags and __name__
+	Series seriesInfo
+}
+
+// selectPromSeries returns the series matching label matchers. The __name__ matcher picks
+// the collections and the others are checked against the series tags.
+func selectPromSeries(matchers []promMatcher) ([]promSelected, error) {
+	dataPath := "./data" // Base directory for data
+
+	var nameMatcher *promMatcher
+	for i := range matchers {
+		if matchers[i].Name == "__name__" {
+			nameMatcher = &matchers[i]
+			break
+		}
+	}
+	if nameMatcher == nil {
+		return nil, fmt.Errorf("a selector must match a metric name")
+	}
+
+	names := []string{}
+	if nameMatcher.Type == "=" {
+		if _, err := os.Stat(fmt.Sprintf("%s/%s", dataPath, nameMatcher.Value)); err == nil && validCollectionName(nameMatcher.Value) {
+			names = append(names, nameMatcher.Value)
+		}
+	} else {
+		files, err := os.ReadDir(dataPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read data directory: %w", err)
+		}
+		for _, file := range files {
+			if file.IsDir() && validCollectionName(file.Name()) && nameMatcher.matches(file.Name()) {
+				names = append(names, file.Name())
+			}
+		}
+	}
+
+	selected := []promSelected{}
+	for _, name := range names {
+		list, err := findSeries(fmt.Sprintf("%s/%s", dataPath, name), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, series := range list {
+			labels := map[string]string{"__name__": name}
+			for key, value := range series.Tags {
+				labels[key] = value
+			}
+
+			matched := true
+			for _, matcher := range matchers {
+				if !matcher.matches(labels[matcher.Name]) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				selected = append(selected, promSelected{Labels: labels, Series: series})
+			}
+		}
+	}
+	return selected, nil
+}
+
+// promSamples reads the numeric samples of a series between start and end in milliseconds
+func promSamples(series seriesInfo, start, end int64) ([]promSample, error) {
+	unit := precisionUnit(series.Precision)
+	from := start * int64(time.Millisecond) / unit
+	to := end * int64(time.Millisecond) / unit
+
+	samples := []promSample{}
+	err := scanSeries([]seriesInfo{series}, from, to, func(_ seriesInfo, point dataPoint) error {
+		value, ok := numericValue(decodeData(point.Data), nil)
+		if ok {
+			samples = append(samples, promSample{Value: value, Time: unixTime(point.Time, series.Precision).UnixMilli()})
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// PromQL expressions
+type (
+	promExpr interface{}
+
+	promNumber struct {
+		Value float64
+	}
+
+	promSelector struct {
+		Matchers []promMatcher
+		Range    int64 // Milliseconds of a range selector such as [5m], 0 for an instant selector
+	}
+
+	promCall struct {
+		Func string
+		Args []promExpr
+	}
+
+	promAggregate struct {
+		Op       string
+		Grouping []string
+		Without  bool
+		Expr     promExpr
+	}
+)
+
+// promRangeFunctions take a range selector and reduce each window to a value
+var promRangeFunctions = map[string]bool{
+	"rate":            true,
+	"increase":        true,
+	"avg_over_time":   true,
+	"sum_over_time":   true,
+	"min_over_time":   true,
+	"max_over_time":   true,
+	"count_over_time": true,
+}
+
+var promAggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+
+type promToken struct {
+	kind string // ident, number, string, duration, op or eof
+	text string
+}
+
+func lexPromQL(input string) ([]promToken, error) {
+	tokens := []promToken{}
+	isIdent := func(ch byte, first bool) bool {
+		return ch == '_' || ch == ':' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (!first && ch >= '0' && ch <= '9')
+	}
+
+	for i := 0; i < len(input); {
+		ch := input[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+
+		case isIdent(ch, true):
+			start := i
+			for i < len(input) && isIdent(input[i], false) {
+				i++
+			}
+			tokens = append(tokens, promToken{"ident", input[start:i]})
+
+		case (ch >= '0' && ch <= '9') || ch == '.':
+			start := i
+			for i < len(input) && (strings.IndexByte("0123456789.eE", input[i]) >= 0 ||
+				((input[i] == '+' || input[i] == '-') && (input[i-1] == 'e' || input[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, promToken{"number", input[start:i]})
+
+		case ch == '"' || ch == '\'':
+			var text strings.Builder
+			i++
+			for i < len(input) && input[i] != ch {
+				if input[i] == '\\' && i+1 < len(input) {
+					i++
+				}
+				text.WriteByte(input[i])
+				i++
+			}
+			if i >= len(input) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			i++
+			tokens = append(tokens, promToken{"string", text.String()})
+
+		case ch == '[':
+			end := strings.IndexByte(input[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated range")
+			}
+			tokens = append(tokens, promToken{"duration", strings.TrimSpace(input[i+1 : i+end])})
+			i += end + 1
+
+		default:
+			op := string(ch)
+			if i+1 < len(input) && (input[i:i+2] == "!=" || input[i:i+2] == "=~" || input[i:i+2] == "!~") {
+				op = input[i : i+2]
+			}
+			if strings.IndexByte("(){},=", ch) < 0 && len(op) == 1 {
+				return nil, fmt.Errorf("unexpected character '%c'", ch)
+			}
+			tokens = append(tokens, promToken{"op", op})
+			i += len(op)
+		}
+	}
+	return append(tokens, promToken{kind: "eof"}), nil
+}
+
+type promParser struct {
+	tokens []promToken
+	pos    int
+}
+
+// parsePromQL parses the supported subset of PromQL: selectors, the range functions,
+// histogram_quantile and the sum, avg, min, max and count aggregations with by or without
+func parsePromQL(input string) (promExpr, error) {
+	tokens, err := lexPromQL(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &promParser{tokens: tokens}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != "eof" {
+		return nil, fmt.Errorf("unexpected '%s'", p.peek().text)
+	}
+	return expr, nil
+}
+
+func (p *promParser) peek() promToken {
+	return p.tokens[p.pos]
+}
+
+func (p *promParser) next() promToken {
+	token := p.tokens[p.pos]
+	if token.kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+func (p *promParser) expect(op string) error {
+	if token := p.next(); token.kind != "op" || token.text != op {
+		return fmt.Errorf("expected '%s', found '%s'", op, token.text)
+	}
+	return nil
+}
+
+func (p *promParser) expr() (promExpr, error) {
+	token := p.peek()
+	switch {
+	case token.kind == "number":
+		p.next()
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", token.text)
+		}
+		return promNumber{Value: value}, nil
+
+	case token.kind == "op" && token.text == "(":
+		p.next()
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+
+	case token.kind == "op" && token.text == "{":
+		return p.selector("")
+
+	case token.kind == "ident" && promAggregations[token.text]:
+		return p.aggregate()
+
+	case token.kind == "ident" && p.tokens[p.pos+1].kind == "op" && p.tokens[p.pos+1].text == "(":
+		return p.call()
+
+	case token.kind == "ident":
+		p.next()
+		return p.selector(token.text)
+	}
+	return nil, fmt.Errorf("unexpected '%s'", token.text)
+}
+
+func (p *promParser) selector(name string) (promExpr, error) {
+	selector := promSelector{}
+	if name != "" {
+		matcher, _ := newPromMatcher("__name__", "=", name)
+		selector.Matchers = append(selector.Matchers, matcher)
+	}
+
+	if token := p.peek(); token.kind == "op" && token.text == "{" {
+		p.next()
+		for {
+			if token := p.peek(); token.kind == "op" && token.text == "}" {
+				p.next()
+				break
+			}
+
+			label := p.next()
+			kind := p.next()
+			value := p.next()
+			if label.kind != "ident" || kind.kind != "op" || value.kind != "string" {
+				return nil, fmt.Errorf("invalid label matcher near '%s'", label.text)
+			}
+			if kind.text != "=" && kind.text != "!=" && kind.text != "=~" && kind.text != "!~" {
+				return nil, fmt.Errorf("invalid label matcher operator '%s'", kind.text)
+			}
+			matcher, err := newPromMatcher(label.text, kind.text, value.text)
+			if err != nil {
+				return nil, err
+			}
+			selector.Matchers = append(selector.Matchers, matcher)
+
+			if token := p.peek(); token.kind == "op" && token.text == "," {
+				p.next()
+			}
+		}
+	}
+
+	if token := p.peek(); token.kind == "duration" {
+		p.next()
+		duration, err := parseInterval(token.text, "ms")
+		if err != nil {
+			return nil, fmt.Errorf("invalid range '%s': %v", token.text, err)
+		}
+		selector.Range = duration
+	}
+	return selector, nil
+}
+
+func (p *promParser) grouping(aggregate *promAggregate) error {
+	token := p.peek()
+	if token.kind != "ident" || (token.text != "by" && token.text != "without") {
+		return nil
+	}
+	p.next()
+	aggregate.Without = token.text == "without"
+
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for {
+		token := p.next()
+		if token.kind == "op" && token.text == ")" {
+			return nil
+		}
+		if token.kind == "op" && token.text == "," {
+			continue
+		}
+		if token.kind != "ident" {
+			return fmt.Errorf("invalid label '%s' in %s", token.text, aggregate.Op)
+		}
+		aggregate.Grouping = append(aggregate.Grouping, token.text)
+	}
+}
+
+func (p *promParser) aggregate() (promExpr, error) {
+	aggregate := promAggregate{Op: p.next().text}
+	if err := p.grouping(&aggregate); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	aggregate.Expr = expr
+
+	// The grouping may also follow the expression
+	if len(aggregate.Grouping) == 0 {
+		if err := p.grouping(&aggregate); err != nil {
+			return nil, err
+		}
+	}
+	return aggregate, nil
+}
+
+func (p *promParser) call() (promExpr, error) {
+	call := promCall{Func: p.next().text}
+	if !promRangeFunctions[call.Func] && call.Func != "histogram_quantile" {
+		return nil, fmt.Errorf("unsupported function '%s'", call.Func)
+	}
+	p.next() // (
+
+	for {
+		if token := p.peek(); token.kind == "op" && token.text == ")" {
+			p.next()
+			break
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if token := p.peek(); token.kind == "op" && token.text == "," {
+			p.next()
+		}
+	}
+
+	if promRangeFunctions[call.Func] {
+		if len(call.Args) != 1 {
+			return nil, fmt.Errorf("%s expects one argument", call.Func)
+		}
+		if selector, ok := call.Args[0].(promSelector); !ok || selector.Range == 0 {
+			return nil, fmt.Errorf("%s expects a range selector such as metric[5m]", call.Func)
+		}
+		return call, nil
+	}
+
+	if len(call.Args) != 2 {
+		return nil, fmt.Errorf("histogram_quantile expects two arguments")
+	}
+	if _, ok := call.Args[0].(promNumber); !ok {
+		return nil, fmt.Errorf("histogram_quantile expects a number as its first argument")
+	}
+	return call, nil
+}
+
+// promResult is a series of a query result with a value at every step where it is present
+type promResult struct {
+	Labels  map[string]string
+	Values  []float64
+	Present []bool
+}
+
+func newPromResult(labels map[string]string, steps int) promResult {
+	return promResult{Labels: labels, Values: make([]float64, steps), Present: make([]bool, steps)}
+}
+
+// promEvaluator evaluates an expression at evenly spaced steps, all in milliseconds
+type promEvaluator struct {
+	start, end, step int64
+	steps            int
+}
+
+func newPromEvaluator(start, end, step int64) *promEvaluator {
+	return &promEvaluator{start: start, end: end, step: step, steps: int((end-start)/step) + 1}
+}
+
+func (e *promEvaluator) at(i int) int64 {
+	return e.start + int64(i)*e.step
+}
+
+func (e *promEvaluator) eval(expr promExpr) ([]promResult, error) {
+	switch node := expr.(type) {
+	case promNumber:
+		result := newPromResult(map[string]string{}, e.steps)
+		for i := range result.Values {
+			result.Values[i], result.Present[i] = node.Value, true
+		}
+		return []promResult{result}, nil
+
+	case promSelector:
+		if node.Range > 0 {
+			return nil, fmt.Errorf("a range selector must be passed to a function such as rate")
+		}
+		return e.instant(node)
+
+	case promCall:
+		if node.Func == "histogram_quantile" {
+			return e.histogramQuantile(node.Args[0].(promNumber).Value, node.Args[1])
+		}
+		return e.rangeFunction(node.Func, node.Args[0].(promSelector))
+
+	case promAggregate:
+		return e.aggregate(node)
+	}
+	return nil, fmt.Errorf("unsupported expression")
+}
+
+// instant takes the latest sample of each series within the lookback before every step
+func (e *promEvaluator) instant(selector promSelector) ([]promResult, error) {
+	selected, err := selectPromSeries(selector.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []promResult{}
+	for _, series := range selected {
+		samples, err := promSamples(series.Series, e.start-promLookback, e.end)
+		if err != nil {
+			return nil, err
+		}
+
+		result := newPromResult(series.Labels, e.steps)
+		for i := 0; i < e.steps; i++ {
+			t := e.at(i)
+			after := sort.Search(len(samples), func(j int) bool { return samples[j].Time > t })
+			if after > 0 && t-samples[after-1].Time < promLookback {
+				result.Values[i], result.Present[i] = samples[after-1].Value, true
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// rangeFunction reduces the samples of each series in the window ending at every step
+func (e *promEvaluator) rangeFunction(function string, selector promSelector) ([]promResult, error) {
+	selected, err := selectPromSeries(selector.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []promResult{}
+	for _, series := range selected {
+		samples, err := promSamples(series.Series, e.start-selector.Range, e.end)
+		if err != nil {
+			return nil, err
+		}
+
+		// Functions drop the metric name
+		labels := map[string]string{}
+		for key, value := range series.Labels {
+			if key != "__name__" {
+				labels[key] = value
+			}
+		}
+
+		result := newPromResult(labels, e.steps)
+		for i := 0; i < e.steps; i++ {
+			t := e.at(i)
+			from := sort.Search(len(samples), func(j int) bool { return samples[j].Time > t-selector.Range })
+			to := sort.Search(len(samples), func(j int) bool { return samples[j].Time > t })
+			result.Values[i], result.Present[i] = reduceWindow(function, samples[from:to], t-selector.Range, t)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// reduceWindow applies a range function to the samples of one window
+func reduceWindow(function string, window []promSample, rangeStart, rangeEnd int64) (float64, bool) {
+	if len(window) == 0 {
+		return 0, false
+	}
+
+	switch function {
+	case "rate", "increase":
+		return extrapolatedRate(window, rangeStart, rangeEnd, function == "rate")
+	case "count_over_time":
+		return float64(len(window)), true
+	}
+
+	result := window[0].Value
+	sum := 0.0
+	for _, sample := range window {
+		sum += sample.Value
+		switch function {
+		case "min_over_time":
+			result = math.Min(result, sample.Value)
+		case "max_over_time":
+			result = math.Max(result, sample.Value)
+		}
+	}
+	switch function {
+	case "sum_over_time":
+		return sum, true
+	case "avg_over_time":
+		return sum / float64(len(window)), true
+	}
+	return result, true
+}
+
+// extrapolatedRate computes the increase of a counter over a window the way Prometheus does:
+// counter resets are corrected and the increase is extrapolated towards the window bounds
+func extrapolatedRate(window []promSample, rangeStart, rangeEnd int64, isRate bool) (float64, bool) {
+	if len(window) < 2 {
+		return 0, false
+	}
+
+	first, last := window[0], window[len(window)-1]
+	increase := last.Value - first.Value
+	for i := 1; i < len(window); i++ {
+		if window[i].Value < window[i-1].Value {
+			increase += window[i-1].Value
+		}
+	}
+
+	sampled := float64(last.Time-first.Time) / 1000
+	toStart := float64(first.Time-rangeStart) / 1000
+	toEnd := float64(rangeEnd-last.Time) / 1000
+	average := sampled / float64(len(window)-1)
+
+	// A counter cannot be extrapolated below zero
+	if increase > 0 && first.Value >= 0 {
+		if toZero := sampled * (first.Value / increase); toZero < toStart {
+			toStart = toZero
+		}
+	}
+
+	threshold := average * 1.1
+	interval := sampled
+	if toStart < threshold {
+		interval += toStart
+	} else {
+		interval += average / 2
+	}
+	if toEnd < threshold {
+		interval += toEnd
+	} else {
+		interval += average / 2
+	}
+
+	increase *= interval / sampled
+	if isRate {
+		increase /= float64(rangeEnd-rangeStart) / 1000
+	}
+	return increase, true
+}
+
+// promGroupKey returns the labels an aggregation keeps for a series and their canonical form
+func promGroupKey(labels map[string]string, grouping []string, without bool) (map[string]string, string) {
+	kept := map[string]string{}
+	if without {
+		excluded := map[string]bool{"__name__": true}
+		for _, label := range grouping {
+			excluded[label] = true
+		}
+		for key, value := range labels {
+			if !excluded[key] {
+				kept[key] = value
+			}
+		}
+	} else {
+		for _, label := range grouping {
+			if value, exists := labels[label]; exists {
+				kept[label] = value
+			}
+		}
+	}
+	return kept, seriesKey(kept)
+}
+
+func (e *promEvaluator) aggregate(node promAggregate) ([]promResult, error) {
+	inputs, err := e.eval(node.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []promResult{}
+	counts := [][]int{}
+	positions := map[string]int{}
+	for _, input := range inputs {
+		labels, key := promGroupKey(input.Labels, node.Grouping, node.Without)
+		position, exists := positions[key]
+		if !exists {
+			position = len(groups)
+			positions[key] = position
+			groups = append(groups, newPromResult(labels, e.steps))
+			counts = append(counts, make([]int, e.steps))
+		}
+
+		group := groups[position]
+		for i, present := range input.Present {
+			if !present {
+				continue
+			}
+			value := input.Values[i]
+			switch {
+			case !group.Present[i]:
+				group.Values[i] = value
+			case node.Op == "sum" || node.Op == "avg":
+				group.Values[i] += value
+			case node.Op == "min":
+				group.Values[i] = math.Min(group.Values[i], value)
+			case node.Op == "max":
+				group.Values[i] = math.Max(group.Values[i], value)
+			}
+			group.Present[i] = true
+			counts[position][i]++
+		}
+	}
+
+	for position, group := range groups {
+		for i := range group.Values {
+			switch node.Op {
+			case "avg":
+				if counts[position][i] > 0 {
+					group.Values[i] /= float64(counts[position][i])
+				}
+			case "count":
+				group.Values[i] = float64(counts[position][i])
+			}
+		}
+	}
+	return groups, nil
+}
+
+// histogramQuantile estimates a quantile from the cumulative "le" buckets of each histogram
+func (e *promEvaluator) histogramQuantile(q float64, expr promExpr) ([]promResult, error) {
+	inputs, err := e.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	type bucket struct {
+		upper float64
+		count float64
+	}
+
+	// Series differing only in "le" are the buckets of one histogram
+	results := []promResult{}
+	buckets := [][][]bucket{} // Histogram -> step -> buckets
+	positions := map[string]int{}
+	for _, input := range inputs {
+		upper, err := strconv.ParseFloat(input.Labels["le"], 64)
+		if err != nil {
+			continue
+		}
+
+		labels := map[string]string{}
+		for key, value := range input.Labels {
+			if key != "le" && key != "__name__" {
+				labels[key] = value
+			}
+		}
+		key := seriesKey(labels)
+		position, exists := positions[key]
+		if !exists {
+			position = len(results)
+			positions[key] = position
+			results = append(results, newPromResult(labels, e.steps))
+			buckets = append(buckets, make([][]bucket, e.steps))
+		}
+
+		for i, present := range input.Present {
+			if present {
+				buckets[position][i] = append(buckets[position][i], bucket{upper: upper, count: input.Values[i]})
+			}
+		}
+	}
+
+	for position, result := range results {
+		for i, stepBuckets := range buckets[position] {
+			if len(stepBuckets) == 0 {
+				continue
+			}
+			sort.Slice(stepBuckets, func(a, b int) bool { return stepBuckets[a].upper < stepBuckets[b].upper })
+
+			upper := make([]float64, len(stepBuckets))
+			counts := make([]float64, len(stepBuckets))
+			for j, b := range stepBuckets {
+				upper[j], counts[j] = b.upper, b.count
+			}
+			result.Values[i], result.Present[i] = bucketQuantile(q, upper, counts), true
+		}
+	}
+	return results, nil
+}
+
+// bucketQuantile interpolates a quantile within sorted cumulative buckets, as Prometheus does
+func bucketQuantile(q float64, upper, counts []float64) float64 {
+	switch {
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	if len(upper) < 2 || !math.IsInf(upper[len(upper)-1], 1) {
+		return math.NaN()
+	}
+
+	// Rates of different buckets can be slightly out of step
+	for i := 1; i < len(counts); i++ {
+		if counts[i] < counts[i-1] {
+			counts[i] = counts[i-1]
+		}
+	}
+
+	observations := counts[len(counts)-1]
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	b := sort.SearchFloat64s(counts, rank)
+
+	if b == len(upper)-1 {
+		return upper[len(upper)-2]
+	}
+	if b == 0 && upper[0] <= 0 {
+		return upper[0]
+	}
+
+	start, end, count := 0.0, upper[b], counts[b]
+	if b > 0 {
+		start = upper[b-1]
+		count -= counts[b-1]
+		rank -= counts[b-1]
+	}
+	return start + (end-start)*(rank/count)
+}
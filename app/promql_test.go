@@ -0,0 +1,233 @@
+package app
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// equalMatcher builds a matcher that needs no regular expression
+func equalMatcher(name, value string) promMatcher {
+	matcher, _ := newPromMatcher(name, "=", value)
+	return matcher
+}
+
+func TestParsePromQL(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    promExpr // Checked when set
+		wantErr bool
+	}{
+		{query: "42", want: promNumber{Value: 42}},
+		{query: "up", want: promSelector{Matchers: []promMatcher{equalMatcher("__name__", "up")}}},
+		{
+			query: `up{job="node",instance!="a"}`,
+			want: promSelector{Matchers: []promMatcher{
+				equalMatcher("__name__", "up"),
+				equalMatcher("job", "node"),
+				{Name: "instance", Type: "!=", Value: "a"},
+			}},
+		},
+		{
+			query: "rate(http_requests_total[5m])",
+			want: promCall{Func: "rate", Args: []promExpr{
+				promSelector{Matchers: []promMatcher{equalMatcher("__name__", "http_requests_total")}, Range: 300000},
+			}},
+		},
+		{
+			query: "sum by (job) (rate(requests[1m]))",
+			want: promAggregate{Op: "sum", Grouping: []string{"job"}, Expr: promCall{Func: "rate", Args: []promExpr{
+				promSelector{Matchers: []promMatcher{equalMatcher("__name__", "requests")}, Range: 60000},
+			}}},
+		},
+		{
+			query: "sum(up) without (instance)",
+			want:  promAggregate{Op: "sum", Grouping: []string{"instance"}, Without: true, Expr: promSelector{Matchers: []promMatcher{equalMatcher("__name__", "up")}}},
+		},
+		{
+			query: "histogram_quantile(0.9, latency_bucket)",
+			want: promCall{Func: "histogram_quantile", Args: []promExpr{
+				promNumber{Value: 0.9},
+				promSelector{Matchers: []promMatcher{equalMatcher("__name__", "latency_bucket")}},
+			}},
+		},
+		{query: `{__name__=~"up|down"}`},
+
+		{query: "rate(up)", wantErr: true},
+		{query: "rate(up[5m], up[5m])", wantErr: true},
+		{query: "histogram_quantile(up, latency_bucket)", wantErr: true},
+		{query: "predict_linear(up[5m], 60)", wantErr: true},
+		{query: `up{job~"node"}`, wantErr: true},
+		{query: `up{job=~"("}`, wantErr: true},
+		{query: "sum by (job (up)", wantErr: true},
+		{query: "(up", wantErr: true},
+		{query: "up up", wantErr: true},
+		{query: "rate(", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			got, err := parsePromQL(test.query)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.want != nil && !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// promTestStart is the time of the first sample written by writeSamples, in milliseconds
+const promTestStart = 1000000
+
+// writeSamples stores values of a metric, one every 15 seconds from promTestStart
+func writeSamples(t *testing.T, metric string, tags map[string]string, values []float64) {
+	t.Helper()
+	points := map[int64]interface{}{}
+	for i, value := range values {
+		points[int64(promTestStart+i*15000)] = value
+	}
+	writePoints(t, metric, "ms", tags, points)
+}
+
+// counter returns n samples rising by step from 0
+func counter(n int, step float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = float64(i) * step
+	}
+	return values
+}
+
+func TestEvaluatePromQL(t *testing.T) {
+	useDataDir(t)
+
+	writeSamples(t, "requests", map[string]string{"job": "api", "instance": "a"}, counter(21, 10))
+	writeSamples(t, "requests", map[string]string{"job": "api", "instance": "b"}, counter(21, 20))
+	writeSamples(t, "requests", map[string]string{"job": "web", "instance": "c"}, counter(21, 3))
+
+	// A counter reset from 40 to 5 counts as an increase of 5
+	writeSamples(t, "restarts", nil, []float64{0, 10, 20, 30, 40, 5, 15, 25})
+
+	// 10 observations up to 0.1, 30 up to 0.5 and 40 in all
+	writeSamples(t, "latency_bucket", map[string]string{"le": "0.1"}, []float64{10})
+	writeSamples(t, "latency_bucket", map[string]string{"le": "0.5"}, []float64{30})
+	writeSamples(t, "latency_bucket", map[string]string{"le": "+Inf"}, []float64{40})
+
+	type sample struct {
+		labels map[string]string
+		value  float64
+	}
+
+	tests := []struct {
+		query string
+		at    int64 // Evaluation time in milliseconds after promTestStart
+		want  []sample
+	}{
+		{
+			query: "requests",
+			at:    300000,
+			want: []sample{
+				{map[string]string{"__name__": "requests", "instance": "a", "job": "api"}, 200},
+				{map[string]string{"__name__": "requests", "instance": "b", "job": "api"}, 400},
+				{map[string]string{"__name__": "requests", "instance": "c", "job": "web"}, 60},
+			},
+		},
+		{
+			query: `rate(requests{instance="a"}[1m])`,
+			at:    300000,
+			want:  []sample{{map[string]string{"instance": "a", "job": "api"}, 10.0 / 15}},
+		},
+		{
+			query: "sum by (job) (rate(requests[1m]))",
+			at:    300000,
+			want: []sample{
+				{map[string]string{"job": "api"}, 30.0 / 15},
+				{map[string]string{"job": "web"}, 3.0 / 15},
+			},
+		},
+		{
+			query: "sum(requests) without (instance)",
+			at:    300000,
+			want: []sample{
+				{map[string]string{"job": "api"}, 600},
+				{map[string]string{"job": "web"}, 60},
+			},
+		},
+		{
+			// 25 between the samples at 60s and 105s, extrapolated to the start of the window
+			query: "increase(restarts[1m])",
+			at:    105000,
+			want:  []sample{{map[string]string{}, 25 * 60.0 / 45}},
+		},
+		{
+			query: "max_over_time(restarts[1m])",
+			at:    105000,
+			want:  []sample{{map[string]string{}, 40}},
+		},
+		{
+			query: "histogram_quantile(0.5, latency_bucket)",
+			at:    0,
+			want:  []sample{{map[string]string{}, 0.3}},
+		},
+		{
+			query: "histogram_quantile(0.95, latency_bucket)",
+			at:    0,
+			want:  []sample{{map[string]string{}, 0.5}},
+		},
+		{query: "missing", at: 300000, want: []sample{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			_, results, _, _, err := evaluatePromQL(test.query, newPromEvaluator(promTestStart+test.at, promTestStart+test.at, 1000))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := []sample{}
+			for _, result := range results {
+				if result.Present[0] {
+					got = append(got, sample{result.Labels, result.Values[0]})
+				}
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+			for i := range got {
+				if !reflect.DeepEqual(got[i].labels, test.want[i].labels) || math.Abs(got[i].value-test.want[i].value) > 1e-9 {
+					t.Fatalf("got %+v, want %+v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluatePromQLErrors(t *testing.T) {
+	useDataDir(t)
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{query: "rate(", code: 400},
+		{query: "requests[5m]", code: 422},
+		{query: `{job="api"}`, code: 422},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			_, _, code, _, err := evaluatePromQL(test.query, newPromEvaluator(0, 0, 1000))
+			if err == nil || code != test.code {
+				t.Fatalf("got %d %v, want %d", code, err, test.code)
+			}
+		})
+	}
+}
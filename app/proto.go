@@ -0,0 +1,156 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Protocol buffer wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoReader walks the fields of an encoded protocol buffer message
+type protoReader struct {
+	buf []byte
+}
+
+// next returns the number and wire type of the next field, or false at the end of the message
+func (r *protoReader) next() (int, int, bool, error) {
+	if len(r.buf) == 0 {
+		return 0, 0, false, nil
+	}
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return int(key >> 3), int(key & 7), true, nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	value, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid varint")
+	}
+	r.buf = r.buf[n:]
+	return value, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(r.buf) < 8 {
+		return 0, fmt.Errorf("truncated fixed64")
+	}
+	value := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return value, nil
+}
+
+func (r *protoReader) double() (float64, error) {
+	bits, err := r.fixed64()
+	return math.Float64frombits(bits), err
+}
+
+// bytes returns a length-delimited field: a string, bytes or an embedded message
+func (r *protoReader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(r.buf)) {
+		return nil, fmt.Errorf("truncated field")
+	}
+	value := r.buf[:length]
+	r.buf = r.buf[length:]
+	return value, nil
+}
+
+// skip passes over a field that is not read
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case protoVarint:
+		_, err = r.varint()
+	case protoFixed64:
+		_, err = r.fixed64()
+	case protoBytes:
+		_, err = r.bytes()
+	case protoFixed32:
+		if len(r.buf) < 4 {
+			return fmt.Errorf("truncated fixed32")
+		}
+		r.buf = r.buf[4:]
+	default:
+		return fmt.Errorf("unsupported wire type %d", wireType)
+	}
+	return err
+}
+
+// protoWriter encodes a protocol buffer message
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) key(field, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field<<3|wireType))
+}
+
+func (w *protoWriter) varint(field int, value uint64) {
+	w.key(field, protoVarint)
+	w.buf = binary.AppendUvarint(w.buf, value)
+}
+
+func (w *protoWriter) double(field int, value float64) {
+	w.key(field, protoFixed64)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(value))
+}
+
+// bytes writes a string, bytes or an embedded message encoded by another writer
+func (w *protoWriter) bytes(field int, value []byte) {
+	w.key(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+// readFields calls fn for every field of a message. fn reads the fields it knows and
+// returns false for the others, which are skipped.
+func readFields(buf []byte, fn func(field, wireType int, r *protoReader) (bool, error)) error {
+	reader := &protoReader{buf: buf}
+	for {
+		field, wireType, ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		known, err := fn(field, wireType, reader)
+		if err != nil {
+			return err
+		}
+		if !known {
+			if err := reader.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// doubles reads a repeated double field, packed or not
+func (r *protoReader) doubles(wireType int, values []float64) ([]float64, error) {
+	if wireType == protoFixed64 {
+		value, err := r.double()
+		return append(values, value), err
+	}
+	packed, err := r.bytes()
+	if err != nil {
+		return values, err
+	}
+	if len(packed)%8 != 0 {
+		return values, fmt.Errorf("invalid packed doubles")
+	}
+	for i := 0; i < len(packed); i += 8 {
+		values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(packed[i:])))
+	}
+	return values, nil
+}
@@ -0,0 +1,263 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type queryRequest struct {
+	Collections []string          `json:"collections"` // Explicit collection names
+	Pattern     string            `json:"pattern"`     // Glob such as "sensor_*"
+	Start       json.RawMessage   `json:"start"`       // Timestamp in each collection's precision, RFC3339 or "now-1h"
+	End         json.RawMessage   `json:"end"`         // Same as start, defaults to now
+	Limit       int               `json:"limit"`       // Maximum records per collection
+	Tags        map[string]string `json:"tags"`        // Only read series carrying these tags
+	Fields      []string          `json:"fields"`      // JSON paths to keep
+	Aggregate   *aggregateSpec    `json:"aggregate"`   // Optional aggregation
+	Transform   string            `json:"transform"`   // Optional transform chain, e.g. "non_negative_rate"
+	Field       string            `json:"field"`       // Numeric JSON path the transforms read from raw points
+	Unit        string            `json:"unit"`        // Time unit of derivatives and rates, defaults to 1s
+}
+
+// resolveCollections expands the explicit names and glob pattern of a query
+func resolveCollections(names []string, pattern string) ([]string, error) {
+	dataPath := "./data" // Path to the data directory
+
+	resolved := []string{}
+	seen := map[string]bool{}
+
+	for _, name := range names {
+		if !validCollectionName(name) {
+			return nil, fmt.Errorf("invalid collection name '%s'", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			resolved = append(resolved, name)
+		}
+	}
+
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s'", pattern)
+		}
+
+		files, err := os.ReadDir(dataPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read data directory: %w", err)
+		}
+
+		for _, file := range files {
+			if !file.IsDir() || seen[file.Name()] {
+				continue
+			}
+			if matched, _ := path.Match(pattern, file.Name()); matched {
+				seen[file.Name()] = true
+				resolved = append(resolved, file.Name())
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// runQuery reads one collection for a multi-collection query. Relative bounds such as
+// "now-1h" are evaluated against now, which is the same for every collection.
+func runQuery(collectionName string, request queryRequest, now time.Time) ([]map[string]interface{}, error) {
+	dataPath := "./data" // Base directory for data
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("collection '%s' does not exist", collectionName)
+	}
+
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numeric bounds are read in the precision of each collection
+	start, err := decodeTimestampAt(request.Start, manifest.Precision, now)
+	if err != nil {
+		return nil, err
+	}
+	end, err := decodeTimestampAt(request.End, manifest.Precision, now)
+	if err != nil {
+		return nil, err
+	}
+	if end < start {
+		return nil, fmt.Errorf("'end' must not be before 'start'")
+	}
+
+	// Transforms keep state, so every collection gets its own pipeline
+	transforms, err := parseTransforms(request.Transform)
+	if err != nil {
+		return nil, err
+	}
+	unit, err := parseInterval(request.Unit, manifest.Precision)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := findSeries(collectionDir, request.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Aggregate != nil {
+		var result []map[string]interface{}
+		if len(request.Tags) == 0 {
+			result, err = aggregateRange(collectionDir, start, end, *request.Aggregate)
+		} else {
+			result, err = aggregateSeries(list, manifest.Precision, start, end, *request.Aggregate)
+		}
+		if err != nil || len(transforms) == 0 {
+			return result, err
+		}
+		return transformSeries(result, transforms, unit), nil
+	}
+
+	fields := parseFields(strings.Join(request.Fields, ","))
+	fieldPath := []string{}
+	if request.Field != "" {
+		fieldPath = strings.Split(request.Field, ".")
+	}
+	result := []map[string]interface{}{}
+
+	errLimit := fmt.Errorf("limit reached")
+	pipelines := newSeriesTransforms(transforms)
+	err = scanSeries(list, start, end, func(series seriesInfo, point dataPoint) error {
+		if request.Limit > 0 && len(result) >= request.Limit {
+			return errLimit
+		}
+
+		if len(transforms) > 0 {
+			value, ok := numericValue(decodeData(point.Data), fieldPath)
+			if !ok {
+				return nil
+			}
+			if value, ok = pipelines.apply(series, point.Time, value, unit); ok {
+				result = append(result, seriesPoint(series, point, value))
+			}
+			return nil
+		}
+
+		result = append(result, seriesPoint(series, point, projectFields(decodeData(point.Data), fields)))
+		return nil
+	})
+	if err != nil && err != errLimit {
+		return nil, err
+	}
+	return result, nil
+}
+
+func query_data(c *gin.Context) {
+	var request queryRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if len(request.Collections) == 0 && request.Pattern == "" {
+		c.JSON(400, gin.H{"error": "Either 'collections' or 'pattern' must be provided"})
+		return
+	}
+
+	// Without an end the range runs up to now
+	now := time.Now()
+	if len(request.End) == 0 {
+		request.End = json.RawMessage(`"now"`)
+	}
+	if _, err := decodeTimestampAt(request.Start, "ms", now); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid start: %v", err)})
+		return
+	}
+	if _, err := decodeTimestampAt(request.End, "ms", now); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid end: %v", err)})
+		return
+	}
+
+	if err := validateTags(request.Tags); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid tags: %v", err)})
+		return
+	}
+
+	if request.Unit == "" {
+		request.Unit = "1s"
+	}
+	if _, err := parseTransforms(request.Transform); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid transform: %v", err)})
+		return
+	}
+	// Intervals are checked again in the precision of each collection
+	if _, err := parseInterval(request.Unit, "ns"); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid unit: %v", err)})
+		return
+	}
+
+	if request.Aggregate != nil {
+		if err := validateAggregate(*request.Aggregate, "ns", 0, 0); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid aggregate: %v", err)})
+			return
+		}
+	}
+
+	collectionNames, err := resolveCollections(request.Collections, request.Pattern)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(collectionNames) == 0 {
+		c.JSON(404, gin.H{"error": "No collection matches the query"})
+		return
+	}
+
+	workers := AppConfig.Query.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+
+	results := map[string]interface{}{}
+	errors := map[string]string{}
+	var mutex sync.Mutex
+
+	// Scan the collections concurrently with a bounded worker pool
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(collectionNames); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for collectionName := range jobs {
+				result, err := runQuery(collectionName, request, now)
+
+				mutex.Lock()
+				if err != nil {
+					errors[collectionName] = err.Error()
+				} else {
+					results[collectionName] = result
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, collectionName := range collectionNames {
+		jobs <- collectionName
+	}
+	close(jobs)
+	wg.Wait()
+
+	response := gin.H{"results": results}
+	if len(errors) > 0 {
+		response["errors"] = errors
+	}
+	respondData(c, acceptFormat(c), 200, response)
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDecodeTimestampAt(t *testing.T) {
+	now := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+
+	tests := []struct {
+		raw       string
+		precision string
+		want      int64
+		wantErr   bool
+	}{
+		{raw: `1700000000`, precision: "s", want: 1700000000},
+		{raw: `"1700000000"`, precision: "s", want: 1700000000},
+		{raw: `"now"`, precision: "s", want: 1700000000},
+		{raw: `"now"`, precision: "ms", want: 1700000000000},
+		{raw: `"now-1h"`, precision: "s", want: 1700000000 - 3600},
+		{raw: `"now-1d/d"`, precision: "s", want: 1699833600},
+		{raw: `"2023-11-14T22:13:20Z"`, precision: "ms", want: 1700000000000},
+		{raw: `""`, precision: "s", wantErr: true},
+		{raw: `"soon"`, precision: "s", wantErr: true},
+		{raw: `"unterminated`, precision: "s", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.raw+" "+test.precision, func(t *testing.T) {
+			got, err := decodeTimestampAt(json.RawMessage(test.raw), test.precision, now)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Fatalf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunQueryNow(t *testing.T) {
+	useDataDir(t)
+	now := time.Unix(1700000000, 0)
+
+	// One point half an hour before now in collections of different precisions
+	for name, precision := range map[string]string{"seconds": "s", "millis": "ms"} {
+		ts := timestampOf(now.Add(-30*time.Minute), precision)
+		writePoints(t, name, precision, nil, map[int64]interface{}{ts: 1.0})
+	}
+
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		at    time.Time
+		want  int
+	}{
+		{name: "last hour", start: `"now-1h"`, end: `"now"`, at: now, want: 1},
+		{name: "last ten minutes", start: `"now-10m"`, end: `"now"`, at: now, want: 0},
+		{name: "an hour later", start: `"now-1h"`, end: `"now"`, at: now.Add(time.Hour), want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := queryRequest{Start: json.RawMessage(test.start), End: json.RawMessage(test.end), Unit: "1s"}
+			for _, name := range []string{"seconds", "millis"} {
+				result, err := runQuery(name, request, test.at)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(result) != test.want {
+					t.Fatalf("got %d point(s) in %s, want %d", len(result), name, test.want)
+				}
+			}
+		})
+	}
+}
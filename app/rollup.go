@@ -0,0 +1,536 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rollupDefinition declares a collection maintained as interval aggregates of another one
+type rollupDefinition struct {
+	Source    string   `json:"source"`    // Collection the rollup reads from
+	Interval  string   `json:"interval"`  // Bucket width such as "1h"
+	Fields    []string `json:"fields"`    // Numeric JSON paths to aggregate
+	Functions []string `json:"functions"` // count, sum, mean, min, max, first or last
+}
+
+var rollupFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"mean":  true,
+	"min":   true,
+	"max":   true,
+	"first": true,
+	"last":  true,
+}
+
+var rollupMutex sync.Mutex // Serializes rollup declarations and maintenance
+
+const rollupsFile = "./data/.rollups.json"
+
+// loadRollups reads the rollup definitions keyed by target collection
+func loadRollups() (map[string]rollupDefinition, error) {
+	rollups := map[string]rollupDefinition{}
+
+	content, err := os.ReadFile(rollupsFile)
+	if os.IsNotExist(err) {
+		return rollups, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollups: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &rollups); err != nil {
+		return nil, fmt.Errorf("failed to decode rollups: %w", err)
+	}
+	return rollups, nil
+}
+
+func saveRollups(rollups map[string]rollupDefinition) error {
+	content, err := json.MarshalIndent(rollups, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode rollups: %w", err)
+	}
+	if err := os.WriteFile(rollupsFile, content, 0644); err != nil {
+		return fmt.Errorf("failed to save rollups: %w", err)
+	}
+	return nil
+}
+
+// rebuildRollup recomputes the rollup buckets overlapping from..to from the source data
+func rebuildRollup(target string, rollup rollupDefinition, from, to int64) error {
+	dataPath := "./data" // Base directory for data
+	sourceDir := fmt.Sprintf("%s/%s", dataPath, rollup.Source)
+	targetDir := fmt.Sprintf("%s/%s", dataPath, target)
+
+	// The target shares the precision of the source, so bucket times carry over
+	precision := collectionPrecision(rollup.Source)
+	interval, err := parseInterval(rollup.Interval, precision)
+	if err != nil {
+		return err
+	}
+	from = bucketStart(from, interval)
+	to = bucketStart(to, interval) + interval - 1
+
+	paths := [][]string{}
+	for _, field := range rollup.Fields {
+		paths = append(paths, strings.Split(field, "."))
+	}
+
+	buckets := []int64{}
+	states := map[int64][]*aggregateState{}
+
+	err = scanRange(sourceDir, from, to, func(point dataPoint) error {
+		data := decodeData(point.Data)
+		bucket := bucketStart(point.Time, interval)
+
+		bucketStates, exists := states[bucket]
+		if !exists {
+			bucketStates = make([]*aggregateState, len(paths))
+			states[bucket] = bucketStates
+			buckets = append(buckets, bucket)
+		}
+
+		for i, path := range paths {
+			value, ok := numericValue(data, path)
+			if !ok {
+				continue
+			}
+			if bucketStates[i] == nil {
+				bucketStates[i] = &aggregateState{}
+			}
+			bucketStates[i].add(value, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Each rollup point holds the count and the declared functions of every field
+	points := []dataPoint{}
+	for _, bucket := range buckets {
+		payload := map[string]interface{}{}
+		for i, field := range rollup.Fields {
+			state := states[bucket][i]
+			if state == nil {
+				continue
+			}
+			stats := map[string]interface{}{"count": state.Count}
+			for _, function := range rollup.Functions {
+				stats[function] = state.result(aggregateSpec{Function: function})
+			}
+			payload[field] = stats
+		}
+		if len(payload) == 0 {
+			continue
+		}
+
+		dataJSON, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encode rollup point: %w", err)
+		}
+		points = append(points, dataPoint{Time: bucket, Data: dataJSON})
+	}
+
+	if err := deleteRange(targetDir, precision, from, to); err != nil {
+		return err
+	}
+	return storePoints(targetDir, points)
+}
+
+// updateRollups recomputes the rollup buckets of a collection touched by the given timestamps
+func updateRollups(collectionName string, times []int64) error {
+	rollupMutex.Lock()
+	defer rollupMutex.Unlock()
+
+	rollups, err := loadRollups()
+	if err != nil {
+		return err
+	}
+
+	for target, rollup := range rollups {
+		if rollup.Source != collectionName {
+			continue
+		}
+		interval, err := parseInterval(rollup.Interval, collectionPrecision(collectionName))
+		if err != nil {
+			return err
+		}
+
+		buckets := map[int64]bool{}
+		for _, ts := range times {
+			buckets[bucketStart(ts, interval)] = true
+		}
+		for bucket := range buckets {
+			if err := rebuildRollup(target, rollup, bucket, bucket); err != nil {
+				return fmt.Errorf("failed to update rollup '%s': %w", target, err)
+			}
+		}
+	}
+	return nil
+}
+
+// updateRollupsRange recomputes the rollup buckets of a collection overlapping start..end
+func updateRollupsRange(collectionName string, start, end int64) error {
+	rollupMutex.Lock()
+	defer rollupMutex.Unlock()
+
+	rollups, err := loadRollups()
+	if err != nil {
+		return err
+	}
+
+	for target, rollup := range rollups {
+		if rollup.Source != collectionName {
+			continue
+		}
+		if err := rebuildRollup(target, rollup, start, end); err != nil {
+			return fmt.Errorf("failed to update rollup '%s': %w", target, err)
+		}
+	}
+	return nil
+}
+
+// renameRollups follows a collection rename, or drops its rollups when newName is empty
+func renameRollups(oldName, newName string) error {
+	rollupMutex.Lock()
+	defer rollupMutex.Unlock()
+
+	rollups, err := loadRollups()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for target, rollup := range rollups {
+		if target != oldName && rollup.Source != oldName {
+			continue
+		}
+		changed = true
+		delete(rollups, target)
+		if newName == "" {
+			continue
+		}
+
+		if rollup.Source == oldName {
+			rollup.Source = newName
+		}
+		if target == oldName {
+			target = newName
+		}
+		rollups[target] = rollup
+	}
+
+	if !changed {
+		return nil
+	}
+	return saveRollups(rollups)
+}
+
+// findRollup picks the coarsest rollup of a collection able to answer an aggregation
+func findRollup(collectionName string, spec aggregateSpec) (string, rollupDefinition, bool) {
+	if spec.NoRollup || spec.Interval == "" || !rollupFunctions[spec.Function] {
+		return "", rollupDefinition{}, false
+	}
+	// Intervals are only compared, so they are read in nanoseconds
+	interval, err := parseInterval(spec.Interval, "ns")
+	if err != nil {
+		return "", rollupDefinition{}, false
+	}
+
+	rollupMutex.Lock()
+	rollups, err := loadRollups()
+	rollupMutex.Unlock()
+	if err != nil {
+		return "", rollupDefinition{}, false
+	}
+
+	bestTarget, bestInterval := "", int64(0)
+	for target, rollup := range rollups {
+		rollupInterval, err := parseInterval(rollup.Interval, "ns")
+		if err != nil || rollup.Source != collectionName || interval%rollupInterval != 0 || rollupInterval <= bestInterval {
+			continue
+		}
+		if !containsString(rollup.Fields, spec.Field) {
+			continue
+		}
+		if spec.Function != "count" && !containsString(rollup.Functions, spec.Function) {
+			continue
+		}
+		bestTarget, bestInterval = target, rollupInterval
+	}
+
+	if bestTarget == "" {
+		return "", rollupDefinition{}, false
+	}
+	return bestTarget, rollups[bestTarget], true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// rollupAccumulator merges the stored values of several rollup buckets
+type rollupAccumulator struct {
+	Count    float64
+	Value    float64
+	Weighted float64 // Sum of mean*count for mean
+	Seen     bool
+}
+
+func (acc *rollupAccumulator) add(function string, value, count float64) {
+	first := !acc.Seen
+	acc.Seen = true
+	acc.Count += count
+
+	switch function {
+	case "count":
+		acc.Value += count
+	case "sum":
+		acc.Value += value
+	case "mean":
+		acc.Weighted += value * count
+		acc.Value = acc.Weighted / acc.Count
+	case "min":
+		if first || value < acc.Value {
+			acc.Value = value
+		}
+	case "max":
+		if first || value > acc.Value {
+			acc.Value = value
+		}
+	case "first":
+		if first {
+			acc.Value = value
+		}
+	case "last":
+		acc.Value = value
+	}
+}
+
+// aggregateRollup answers an aggregation of a whole collection over start..end. The rollup
+// buckets between from and to are read from the rollup, and the partial buckets before
+// and after them from the raw points of the source, so the result matches the raw data.
+func aggregateRollup(sourceDir, target string, spec aggregateSpec, start, end, from, to, interval int64) ([]map[string]interface{}, error) {
+	dataPath := "./data" // Base directory for data
+	targetDir := fmt.Sprintf("%s/%s", dataPath, target)
+
+	buckets := []int64{}
+	accumulators := map[int64]*rollupAccumulator{}
+	add := func(ts int64, value, count float64) {
+		bucket := bucketStart(ts, interval)
+		acc, exists := accumulators[bucket]
+		if !exists {
+			acc = &rollupAccumulator{}
+			accumulators[bucket] = acc
+			buckets = append(buckets, bucket)
+		}
+		acc.add(spec.Function, value, count)
+	}
+
+	// Raw points count as buckets of one value, like the points a rollup is built from
+	path := strings.Split(spec.Field, ".")
+	addRaw := func(from, to int64) error {
+		if from > to {
+			return nil
+		}
+		return scanRange(sourceDir, from, to, func(point dataPoint) error {
+			if value, ok := numericValue(decodeData(point.Data), path); ok {
+				add(point.Time, value, 1)
+			}
+			return nil
+		})
+	}
+
+	if err := addRaw(start, from-1); err != nil {
+		return nil, err
+	}
+
+	err := scanRange(targetDir, from, to, func(point dataPoint) error {
+		payload, ok := decodeData(point.Data).(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		stats, ok := payload[spec.Field].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		count, _ := stats["count"].(float64)
+		value, ok := stats[spec.Function].(float64)
+		if !ok && spec.Function != "count" {
+			return nil
+		}
+		add(point.Time, value, count)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addRaw(to+1, end); err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+	for _, bucket := range buckets {
+		result = append(result, map[string]interface{}{"time": bucket, "data": accumulators[bucket].Value})
+	}
+	return fillBuckets(result, start, end, interval, spec.Fill)
+}
+
+func rollups(c *gin.Context) {
+	rollupMutex.Lock()
+	definitions, err := loadRollups()
+	rollupMutex.Unlock()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"rollups": definitions})
+}
+
+func add_rollup(c *gin.Context) {
+	target := c.Param("rollup_name")
+	dataPath := "./data" // Base directory for data
+
+	var rollup rollupDefinition
+	if err := c.ShouldBindJSON(&rollup); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Validate the definition
+	if !validCollectionName(target) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid collection name '%s'", target)})
+		return
+	}
+	if !validCollectionName(rollup.Source) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid source collection name '%s'", rollup.Source)})
+		return
+	}
+	if _, err := parseInterval(rollup.Interval, collectionPrecision(rollup.Source)); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid interval: %v", err)})
+		return
+	}
+	if len(rollup.Fields) == 0 || len(rollup.Functions) == 0 {
+		c.JSON(400, gin.H{"error": "Both 'fields' and 'functions' must be provided"})
+		return
+	}
+	for _, function := range rollup.Functions {
+		if !rollupFunctions[function] {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Unsupported rollup function '%s'", function)})
+			return
+		}
+	}
+	if rollup.Source == target {
+		c.JSON(400, gin.H{"error": "A rollup cannot write into its source collection"})
+		return
+	}
+
+	sourceDir := fmt.Sprintf("%s/%s", dataPath, rollup.Source)
+	targetDir := fmt.Sprintf("%s/%s", dataPath, target)
+	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", rollup.Source)})
+		return
+	}
+
+	rollupMutex.Lock()
+	defer rollupMutex.Unlock()
+
+	definitions, err := loadRollups()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Rollups of rollups are not supported, so both ends must be plain collections
+	if _, exists := definitions[rollup.Source]; exists {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Collection '%s' is itself a rollup", rollup.Source)})
+		return
+	}
+	for name, definition := range definitions {
+		if definition.Source == target && name != target {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Collection '%s' is the source of rollup '%s'", target, name)})
+			return
+		}
+	}
+
+	// Start from an empty target and backfill it from the existing source data. A redeclared
+	// rollup only loses its points, a new one must not take over an existing collection.
+	if _, exists := definitions[target]; exists {
+		first, last, found, err := collectionBounds(targetDir)
+		if err == nil && found {
+			err = deleteRange(targetDir, collectionPrecision(target), first, last)
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to reset collection '%s': %v", target, err)})
+			return
+		}
+	} else if err := os.Mkdir(targetDir, os.ModePerm); os.IsExist(err) {
+		c.JSON(409, gin.H{"error": fmt.Sprintf("Collection '%s' already exists", target)})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to create collection '%s': %v", target, err)})
+		return
+	}
+	manifest := collectionManifest{WriteMode: "overwrite", Precision: collectionPrecision(rollup.Source)}
+	if err := saveManifest(targetDir, manifest); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	definitions[target] = rollup
+	if err := saveRollups(definitions); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	first, last, found, err := collectionBounds(sourceDir)
+	if err == nil && found {
+		err = rebuildRollup(target, rollup, first, last)
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to build rollup '%s': %v", target, err)})
+		return
+	}
+
+	c.JSON(201, gin.H{"message": fmt.Sprintf("Rollup '%s' of '%s' created", target, rollup.Source)})
+}
+
+func delete_rollup(c *gin.Context) {
+	target := c.Param("rollup_name")
+
+	rollupMutex.Lock()
+	defer rollupMutex.Unlock()
+
+	definitions, err := loadRollups()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, exists := definitions[target]; !exists {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Rollup '%s' does not exist", target)})
+		return
+	}
+
+	// The collection keeps its data and stops being maintained
+	delete(definitions, target)
+	if err := saveRollups(definitions); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": fmt.Sprintf("Rollup '%s' deleted successfully", target)})
+}
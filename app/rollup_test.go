@@ -0,0 +1,139 @@
+package app
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// addRollup posts a rollup definition to add_rollup
+func addRollup(t *testing.T, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Params = gin.Params{{Key: "rollup_name", Value: target}}
+	c.Request = httptest.NewRequest("PUT", "/rollups/"+target, strings.NewReader(body))
+	add_rollup(c)
+	c.Writer.WriteHeaderNow()
+	return recorder
+}
+
+// rollupCounts reads the count of the load field in every bucket of a rollup
+func rollupCounts(t *testing.T, target string, start, end int64) map[int64]float64 {
+	t.Helper()
+	counts := map[int64]float64{}
+	err := scanRange("./data/"+target, start, end, func(point dataPoint) error {
+		value, _ := numericValue(decodeData(point.Data), []string{"load", "count"})
+		counts[point.Time] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func TestRollupReadsUnsavedSegments(t *testing.T) {
+	useDataDir(t)
+	day := time.Date(2023, 11, 14, 0, 0, 0, 0, time.Local).Unix()
+	hour := int64(3600)
+
+	if err := ensureCollection("./data/cpu", "s"); err != nil {
+		t.Fatal(err)
+	}
+	recorder := addRollup(t, "cpu_hourly", `{"source":"cpu","interval":"1h","fields":["load"],"functions":["sum"]}`)
+	if recorder.Code != 201 {
+		t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	write := func(times ...int64) {
+		points := map[int64]interface{}{}
+		for _, ts := range times {
+			points[ts] = map[string]interface{}{"load": 1.0}
+		}
+		writePoints(t, "cpu", "s", nil, points)
+	}
+
+	// The first points of a segment are read back before the segment is saved
+	write(day+60, day+120)
+	if counts := rollupCounts(t, "cpu_hourly", day, day+24*hour-1); counts[day] != 2 || len(counts) != 1 {
+		t.Fatalf("got %v after the first write, want 2 points in bucket %d", counts, day)
+	}
+
+	write(day+180, day+7*hour)
+	counts := rollupCounts(t, "cpu_hourly", day, day+24*hour-1)
+	if counts[day] != 3 || counts[day+7*hour] != 1 || len(counts) != 2 {
+		t.Fatalf("got %v after the second write", counts)
+	}
+}
+
+func TestAddRollupNames(t *testing.T) {
+	const body = `{"source":"%s","interval":"1h","fields":["load"],"functions":["sum"]}`
+
+	tests := []struct {
+		name   string
+		target string
+		source string
+		code   int
+	}{
+		{name: "new collection", target: "cpu_hourly", source: "cpu", code: 201},
+		{name: "hidden target", target: ".rollups.json", source: "cpu", code: 400},
+		{name: "log target", target: ".wal", source: "cpu", code: 400},
+		{name: "source outside the data directory", target: "cpu_hourly", source: "../cpu", code: 400},
+		{name: "existing collection", target: "mem", source: "cpu", code: 409},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useDataDir(t)
+			for _, name := range []string{"cpu", "mem"} {
+				if err := ensureCollection("./data/"+name, "s"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile("./data/.wal", []byte("log"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := addRollup(t, test.target, fmt.Sprintf(body, test.source))
+			if recorder.Code != test.code {
+				t.Fatalf("got %d, want %d: %s", recorder.Code, test.code, recorder.Body.String())
+			}
+
+			// Files named by a refused request are left alone
+			if info, err := os.Stat("./data/.wal"); err != nil || info.IsDir() {
+				t.Fatalf("the log was replaced: %v", err)
+			}
+			if _, err := loadRollups(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAddRollupAgain(t *testing.T) {
+	useDataDir(t)
+	day := time.Date(2023, 11, 14, 0, 0, 0, 0, time.Local).Unix()
+
+	writePoints(t, "cpu", "s", nil, map[int64]interface{}{
+		day + 60:   map[string]interface{}{"load": 1.0},
+		day + 7200: map[string]interface{}{"load": 1.0},
+	})
+
+	// Redeclaring the rollup with wider buckets replaces its points
+	for _, interval := range []string{"1h", "6h"} {
+		recorder := addRollup(t, "cpu_hourly", `{"source":"cpu","interval":"`+interval+`","fields":["load"],"functions":["sum"]}`)
+		if recorder.Code != 201 {
+			t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	if counts := rollupCounts(t, "cpu_hourly", day, day+86399); counts[day] != 2 || len(counts) != 1 {
+		t.Fatalf("got %v, want 2 points in bucket %d", counts, day)
+	}
+}
@@ -0,0 +1,463 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jsonSchema is the subset of JSON Schema checked on ingest. Annotations such as
+// `title` or `$schema` are accepted and ignored.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Const                json.RawMessage        `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"` // false or a schema
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	Not                  *jsonSchema            `json:"not"`
+
+	pattern    *regexp.Regexp
+	constValue interface{}
+	closed     bool        // additionalProperties is false
+	additional *jsonSchema // Schema of properties not listed in properties
+}
+
+// schemaTypes is the `type` keyword, a single name or a list of names
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+var schemaTypeNames = map[string]bool{
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"null":    true,
+}
+
+// collectionSchema is the schema attached to a collection
+type collectionSchema struct {
+	Schema json.RawMessage `json:"schema"`
+	Coerce bool            `json:"coerce"` // Numeric strings are converted where a number is expected
+
+	compiled *jsonSchema
+}
+
+// itemErrors lists why one item of a batch was rejected
+type itemErrors struct {
+	Index  int      `json:"index"`
+	Errors []string `json:"errors"`
+}
+
+// compileSchema parses a schema and checks its keywords
+func compileSchema(raw json.RawMessage) (*jsonSchema, error) {
+	var schema jsonSchema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+	if err := schema.compile("#"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+func (s *jsonSchema) compile(path string) error {
+	for _, name := range s.Type {
+		if !schemaTypeNames[name] {
+			return fmt.Errorf("%s: unknown type '%s'", path, name)
+		}
+	}
+
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %v", path, err)
+		}
+		s.pattern = pattern
+	}
+
+	if len(s.Const) > 0 {
+		if err := json.Unmarshal(s.Const, &s.constValue); err != nil {
+			return fmt.Errorf("%s: invalid const", path)
+		}
+	}
+
+	if len(s.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(s.AdditionalProperties, &allowed); err == nil {
+			s.closed = !allowed
+		} else {
+			additional, err := compileSchema(s.AdditionalProperties)
+			if err != nil {
+				return fmt.Errorf("%s/additionalProperties: %v", path, err)
+			}
+			s.additional = additional
+		}
+	}
+
+	for name, property := range s.Properties {
+		if err := property.compile(path + "/properties/" + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(path + "/items"); err != nil {
+			return err
+		}
+	}
+	for keyword, list := range map[string][]*jsonSchema{"allOf": s.AllOf, "anyOf": s.AnyOf, "oneOf": s.OneOf} {
+		for i, sub := range list {
+			if err := sub.compile(fmt.Sprintf("%s/%s/%d", path, keyword, i)); err != nil {
+				return err
+			}
+		}
+	}
+	if s.Not != nil {
+		return s.Not.compile(path + "/not")
+	}
+	return nil
+}
+
+// schemaType names the JSON type of a decoded value
+func schemaType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// allows reports whether the schema accepts a JSON type; integers are also numbers
+func (s *jsonSchema) allows(valueType string) bool {
+	if len(s.Type) == 0 {
+		return true
+	}
+	for _, name := range s.Type {
+		if name == valueType || (name == "number" && valueType == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a value and returns it with numeric strings converted when coerce is set
+func (s *jsonSchema) validate(value interface{}, path string, coerce bool) (interface{}, []string) {
+	errors := []string{}
+
+	if text, ok := value.(string); ok && coerce && !s.allows("string") && (s.allows("number") || s.allows("integer")) {
+		if number, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil {
+			value = number
+		}
+	}
+
+	valueType := schemaType(value)
+	if !s.allows(valueType) {
+		found := valueType
+		if found == "integer" {
+			found = "number"
+		}
+		return value, append(errors, fmt.Sprintf("%s: expected %s, found %s", path, strings.Join(s.Type, " or "), found))
+	}
+
+	if len(s.Enum) > 0 {
+		matched := false
+		for _, option := range s.Enum {
+			if reflect.DeepEqual(option, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errors = append(errors, fmt.Sprintf("%s: value is not one of the allowed values", path))
+		}
+	}
+	if len(s.Const) > 0 && !reflect.DeepEqual(s.constValue, value) {
+		errors = append(errors, fmt.Sprintf("%s: value must be %s", path, s.Const))
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errors = append(errors, fmt.Sprintf("%s: %v is less than the minimum %v", path, v, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			errors = append(errors, fmt.Sprintf("%s: %v is greater than the maximum %v", path, v, *s.Maximum))
+		}
+		if s.ExclusiveMinimum != nil && v <= *s.ExclusiveMinimum {
+			errors = append(errors, fmt.Sprintf("%s: %v must be greater than %v", path, v, *s.ExclusiveMinimum))
+		}
+		if s.ExclusiveMaximum != nil && v >= *s.ExclusiveMaximum {
+			errors = append(errors, fmt.Sprintf("%s: %v must be less than %v", path, v, *s.ExclusiveMaximum))
+		}
+
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			errors = append(errors, fmt.Sprintf("%s: must be at least %d characters long", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errors = append(errors, fmt.Sprintf("%s: must be at most %d characters long", path, *s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			errors = append(errors, fmt.Sprintf("%s: does not match the pattern '%s'", path, s.Pattern))
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			errors = append(errors, fmt.Sprintf("%s: must have at least %d items", path, *s.MinItems))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			errors = append(errors, fmt.Sprintf("%s: must have at most %d items", path, *s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				var itemErrors []string
+				v[i], itemErrors = s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), coerce)
+				errors = append(errors, itemErrors...)
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, exists := v[name]; !exists {
+				errors = append(errors, fmt.Sprintf("%s: missing required property '%s'", path, name))
+			}
+		}
+
+		// Report properties in a stable order
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			property, listed := s.Properties[name]
+			switch {
+			case listed:
+			case s.closed:
+				errors = append(errors, fmt.Sprintf("%s: property '%s' is not allowed", path, name))
+				continue
+			case s.additional != nil:
+				property = s.additional
+			default:
+				continue
+			}
+
+			var propertyErrors []string
+			v[name], propertyErrors = property.validate(v[name], path+"."+name, coerce)
+			errors = append(errors, propertyErrors...)
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		var subErrors []string
+		value, subErrors = sub.validate(value, path, coerce)
+		errors = append(errors, subErrors...)
+	}
+
+	// Branches coerce a copy, so only the branch that matches changes the value
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, sub := range s.AnyOf {
+			if coerced, subErrors := sub.validate(copyValue(value), path, coerce); len(subErrors) == 0 {
+				value, matched = coerced, true
+				break
+			}
+		}
+		if !matched {
+			errors = append(errors, fmt.Sprintf("%s: does not match any of the anyOf schemas", path))
+		}
+	}
+
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if coerced, subErrors := sub.validate(copyValue(value), path, coerce); len(subErrors) == 0 {
+				matches++
+				if matches == 1 {
+					value = coerced
+				}
+			}
+		}
+		if matches != 1 {
+			errors = append(errors, fmt.Sprintf("%s: must match exactly one of the oneOf schemas, matched %d", path, matches))
+		}
+	}
+
+	if s.Not != nil {
+		if _, subErrors := s.Not.validate(value, path, false); len(subErrors) == 0 {
+			errors = append(errors, fmt.Sprintf("%s: must not match the schema in 'not'", path))
+		}
+	}
+
+	return value, errors
+}
+
+// copyValue copies the objects and arrays of a decoded JSON value, which validate changes
+// in place
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = copyValue(v[i])
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[key] = copyValue(item)
+		}
+		return object
+	}
+	return value
+}
+
+// loadSchema returns the schema attached to a collection, or nil when it has none
+func loadSchema(collectionDir string) (*collectionSchema, error) {
+	content, err := os.ReadFile(collectionDir + "/schema.json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+
+	var schema collectionSchema
+	if err := json.Unmarshal(content, &schema); err != nil {
+		return nil, fmt.Errorf("failed to decode schema: %w", err)
+	}
+	if schema.compiled, err = compileSchema(schema.Schema); err != nil {
+		return nil, fmt.Errorf("invalid stored schema: %w", err)
+	}
+	return &schema, nil
+}
+
+func collection_schema(c *gin.Context) {
+	collectionName := c.Param("collection_name")
+	dataPath := "./data" // Path to the data directory
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", collectionName)})
+		return
+	}
+
+	schema, err := loadSchema(collectionDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if schema == nil {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' has no schema", collectionName)})
+		return
+	}
+
+	c.JSON(200, gin.H{"schema": schema.Schema, "coerce": schema.Coerce})
+}
+
+func add_schema(c *gin.Context) {
+	collectionName := c.Param("collection_name")
+	dataPath := "./data" // Path to the data directory
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", collectionName)})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil || !json.Valid(body) {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if _, err := compileSchema(body); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid schema: %v", err)})
+		return
+	}
+
+	schema := collectionSchema{Schema: body, Coerce: c.Query("coerce") == "true"}
+	content, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to encode schema: %v", err)})
+		return
+	}
+	if err := os.WriteFile(collectionDir+"/schema.json", content, 0644); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to save schema: %v", err)})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": fmt.Sprintf("Schema of collection '%s' updated", collectionName)})
+}
+
+func delete_schema(c *gin.Context) {
+	collectionName := c.Param("collection_name")
+	dataPath := "./data" // Path to the data directory
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", collectionName)})
+		return
+	}
+
+	if err := os.Remove(collectionDir + "/schema.json"); err != nil {
+		if os.IsNotExist(err) {
+			c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' has no schema", collectionName)})
+			return
+		}
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to delete schema: %v", err)})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": fmt.Sprintf("Schema of collection '%s' deleted", collectionName)})
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		data    string
+		coerce  bool
+		want    string // Validated data as JSON, checked when there are no errors
+		wantErr []string
+	}{
+		{
+			name:   "valid object",
+			schema: `{"type": "object", "required": ["temp"], "properties": {"temp": {"type": "number", "minimum": -50}}}`,
+			data:   `{"temp": 21.5, "room": "a"}`,
+			want:   `{"temp": 21.5, "room": "a"}`,
+		},
+		{
+			name:    "errors in a stable order",
+			schema:  `{"type": "object", "required": ["temp"], "additionalProperties": false, "properties": {"room": {"type": "string"}}}`,
+			data:    `{"room": 1, "extra": true}`,
+			wantErr: []string{"data: missing required property 'temp'", "data: property 'extra' is not allowed", "data.room: expected string, found number"},
+		},
+		{
+			name:   "coerced number",
+			schema: `{"type": "object", "properties": {"temp": {"type": "number"}, "list": {"items": {"type": "integer"}}}}`,
+			data:   `{"temp": " 21.5 ", "list": ["1", "2"]}`,
+			coerce: true,
+			want:   `{"temp": 21.5, "list": [1, 2]}`,
+		},
+		{
+			name:    "strings are kept without coerce",
+			schema:  `{"type": "object", "properties": {"temp": {"type": "number"}}}`,
+			data:    `{"temp": "21.5"}`,
+			wantErr: []string{"data.temp: expected number, found string"},
+		},
+		{
+			// The first branch coerces "5" before failing on the missing property; the
+			// second branch must still see the string
+			name: "anyOf keeps only the coercions of the matching branch",
+			schema: `{"anyOf": [
+				{"type": "object", "required": ["unit"], "properties": {"level": {"type": "number"}}},
+				{"type": "object", "properties": {"level": {"type": "string"}}}
+			]}`,
+			data:   `{"level": "5"}`,
+			coerce: true,
+			want:   `{"level": "5"}`,
+		},
+		{
+			name: "anyOf coerces through the matching branch",
+			schema: `{"anyOf": [
+				{"type": "object", "required": ["unit"], "properties": {"level": {"type": "string", "maxLength": 0}}},
+				{"type": "object", "properties": {"level": {"type": "number"}}}
+			]}`,
+			data:   `{"level": "5"}`,
+			coerce: true,
+			want:   `{"level": 5}`,
+		},
+		{
+			name: "oneOf keeps only the coercions of the matching branch",
+			schema: `{"oneOf": [
+				{"type": "array", "items": {"type": "number"}, "maxItems": 1},
+				{"type": "array", "items": {"type": "string"}}
+			]}`,
+			data:   `["1", "2"]`,
+			coerce: true,
+			want:   `["1", "2"]`,
+		},
+		{
+			name:    "anyOf without a match",
+			schema:  `{"anyOf": [{"type": "string"}, {"type": "boolean"}]}`,
+			data:    `1`,
+			wantErr: []string{"data: does not match any of the anyOf schemas"},
+		},
+		{
+			name:    "oneOf with two matches",
+			schema:  `{"oneOf": [{"type": "number"}, {"minimum": 0}]}`,
+			data:    `1`,
+			wantErr: []string{"data: must match exactly one of the oneOf schemas, matched 2"},
+		},
+		{
+			name:    "not",
+			schema:  `{"not": {"const": "off"}}`,
+			data:    `"off"`,
+			wantErr: []string{"data: must not match the schema in 'not'"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema, err := compileSchema(json.RawMessage(test.schema))
+			if err != nil {
+				t.Fatalf("invalid schema: %v", err)
+			}
+			var data interface{}
+			if err := json.Unmarshal([]byte(test.data), &data); err != nil {
+				t.Fatal(err)
+			}
+
+			got, errors := schema.validate(data, "data", test.coerce)
+			if test.wantErr != nil {
+				if !reflect.DeepEqual(errors, test.wantErr) {
+					t.Fatalf("got errors %q, want %q", errors, test.wantErr)
+				}
+				return
+			}
+			if len(errors) > 0 {
+				t.Fatalf("unexpected errors: %q", errors)
+			}
+
+			var want interface{}
+			if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// seriesInfo is one tag set of a collection and the directory its points are stored in.
+// Points written without tags belong to the collection directory itself.
+type seriesInfo struct {
+	Dir       string
+	Tags      map[string]string
+	Append    bool   // Points carry the sequence number of their value
+	Precision string // Precision of the timestamps
+}
+
+// seriesGroup is a set of series sharing the values of the group_by tags
+type seriesGroup struct {
+	Tags   map[string]string
+	Series []seriesInfo
+}
+
+// seriesIndex lists the tag sets of a collection and maps every tag to the series carrying it
+type seriesIndex struct {
+	Series map[string]map[string]string   `json:"series"` // Series id -> tags
+	Tags   map[string]map[string][]string `json:"tags"`   // Tag key -> value -> series ids
+}
+
+var (
+	seriesIndexes = make(map[string]*seriesIndex) // Collection directory -> series index
+	seriesMutex   sync.Mutex                      // Guards seriesIndexes and the index files
+)
+
+// seriesKey returns the canonical form of a tag set, e.g. "device=a1,site=north". Commas and
+// backslashes are escaped in values holding a comma. Other values are kept as they are, so
+// their keys, and the series ids derived from them, stay the same.
+func seriesKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := tags[key]
+		if strings.Contains(value, ",") {
+			value = tagEscaper.Replace(value)
+		}
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`)
+
+// sameTags reports whether two tag sets are equal
+func sameTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, exists := b[key]; !exists || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// seriesID derives the directory name of a tag set
+func seriesID(tags map[string]string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(seriesKey(tags)))
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// validateTags rejects tags that cannot be written back as "key=value" pairs. Values may hold
+// commas, which seriesKey escapes.
+func validateTags(tags map[string]string) error {
+	for key, value := range tags {
+		if key == "" || value == "" {
+			return fmt.Errorf("tag keys and values must not be empty")
+		}
+		if strings.ContainsAny(key, "=,") {
+			return fmt.Errorf("invalid tag '%s=%s'", key, value)
+		}
+	}
+	return nil
+}
+
+// parseTags parses a tag filter such as "device=a1,site=north"
+func parseTags(param string) (map[string]string, error) {
+	tags := map[string]string{}
+	if param == "" {
+		return tags, nil
+	}
+
+	for _, pair := range strings.Split(param, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid tag '%s'", pair)
+		}
+		tags[key] = value
+	}
+	return tags, validateTags(tags)
+}
+
+// loadSeriesIndexLocked returns the series index of a collection, reading it from disk if needed.
+// The caller must hold seriesMutex.
+func loadSeriesIndexLocked(collectionDir string) (*seriesIndex, error) {
+	if index, exists := seriesIndexes[collectionDir]; exists {
+		return index, nil
+	}
+
+	index := &seriesIndex{Series: map[string]map[string]string{}, Tags: map[string]map[string][]string{}}
+
+	content, err := os.ReadFile(collectionDir + "/series/index.json")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read series index: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, index); err != nil {
+			return nil, fmt.Errorf("failed to decode series index: %w", err)
+		}
+	}
+
+	seriesIndexes[collectionDir] = index
+	return index, nil
+}
+
+// seriesPath returns the directory a tag set is stored in, whether or not it was written
+func seriesPath(collectionDir string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return collectionDir
+	}
+	return fmt.Sprintf("%s/series/%s", collectionDir, seriesID(tags))
+}
+
+// seriesDir returns the directory of a tag set, registering the series on its first write
+func seriesDir(collectionDir string, tags map[string]string) (string, error) {
+	if len(tags) == 0 {
+		return collectionDir, nil
+	}
+
+	id := seriesID(tags)
+	dir := seriesPath(collectionDir, tags)
+
+	seriesMutex.Lock()
+	defer seriesMutex.Unlock()
+
+	index, err := loadSeriesIndexLocked(collectionDir)
+	if err != nil {
+		return "", err
+	}
+	if stored, exists := index.Series[id]; exists {
+		// Two tag sets hashing alike must not share a directory
+		if !sameTags(stored, tags) {
+			return "", fmt.Errorf("tags '%s' collide with series '%s'", seriesKey(tags), seriesKey(stored))
+		}
+		return dir, nil
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create series directory: %w", err)
+	}
+
+	stored := map[string]string{}
+	for key, value := range tags {
+		stored[key] = value
+		if index.Tags[key] == nil {
+			index.Tags[key] = map[string][]string{}
+		}
+		index.Tags[key][value] = append(index.Tags[key][value], id)
+	}
+	index.Series[id] = stored
+
+	// Write the index next to the series and swap it in, so a crash never leaves half a file
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode series index: %w", err)
+	}
+	tempPath := collectionDir + "/series/index.json.tmp"
+	if err := os.WriteFile(tempPath, content, 0644); err != nil {
+		return "", fmt.Errorf("failed to save series index: %w", err)
+	}
+	if err := os.Rename(tempPath, collectionDir+"/series/index.json"); err != nil {
+		return "", fmt.Errorf("failed to save series index: %w", err)
+	}
+	return dir, nil
+}
+
+// findSeries returns the series of a collection carrying every tag of the filter.
+// Untagged points only match an empty filter.
+func findSeries(collectionDir string, filter map[string]string) ([]seriesInfo, error) {
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		return nil, err
+	}
+
+	seriesMutex.Lock()
+	defer seriesMutex.Unlock()
+
+	index, err := loadSeriesIndexLocked(collectionDir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []seriesInfo{}
+	if len(filter) == 0 {
+		list = append(list, seriesInfo{Dir: collectionDir, Append: manifest.WriteMode == "append", Precision: manifest.Precision})
+	}
+
+	// Intersect the series ids of every filter tag
+	var matches map[string]bool
+	for key, value := range filter {
+		next := map[string]bool{}
+		for _, id := range index.Tags[key][value] {
+			if matches == nil || matches[id] {
+				next[id] = true
+			}
+		}
+		matches = next
+	}
+
+	ids := []string{}
+	for id := range index.Series {
+		if matches == nil || matches[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return seriesKey(index.Series[ids[i]]) < seriesKey(index.Series[ids[j]])
+	})
+
+	for _, id := range ids {
+		list = append(list, seriesInfo{
+			Dir:       fmt.Sprintf("%s/series/%s", collectionDir, id),
+			Tags:      index.Series[id],
+			Append:    manifest.WriteMode == "append",
+			Precision: manifest.Precision,
+		})
+	}
+	return list, nil
+}
+
+// groupSeries splits series by their values of the group_by tags, in tag order.
+// Series without one of the tags are grouped under its absence.
+func groupSeries(list []seriesInfo, groupBy []string) []seriesGroup {
+	groups := []seriesGroup{}
+	positions := map[string]int{}
+
+	for _, series := range list {
+		tags := map[string]string{}
+		for _, key := range groupBy {
+			if value, exists := series.Tags[key]; exists {
+				tags[key] = value
+			}
+		}
+
+		key := seriesKey(tags)
+		position, exists := positions[key]
+		if !exists {
+			position = len(groups)
+			positions[key] = position
+			groups = append(groups, seriesGroup{Tags: tags})
+		}
+		groups[position].Series = append(groups[position].Series, series)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return seriesKey(groups[i].Tags) < seriesKey(groups[j].Tags)
+	})
+	return groups
+}
+
+// seriesSegmentFiles lists the .san files of several series that may hold data between start and end
+func seriesSegmentFiles(list []seriesInfo, start, end int64) ([]string, error) {
+	paths := []string{}
+	for _, series := range list {
+		files, err := segmentFiles(series.Dir, series.Precision, start, end)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, files...)
+	}
+	return paths, nil
+}
+
+// segmentFile is a .san file of one series
+type segmentFile struct {
+	series   seriesInfo
+	filePath string
+}
+
+// seriesSegments groups the .san files of several series that may hold data between start
+// and end by the 6-hour segment they cover, in time order
+func seriesSegments(list []seriesInfo, start, end int64) ([][]segmentFile, error) {
+	segments := map[string][]segmentFile{}
+	keys := []string{}
+	for _, series := range list {
+		files, err := segmentFiles(series.Dir, series.Precision, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, filePath := range files {
+			key := strings.TrimPrefix(filePath, series.Dir+"/")
+			if _, exists := segments[key]; !exists {
+				keys = append(keys, key)
+			}
+			segments[key] = append(segments[key], segmentFile{series: series, filePath: filePath})
+		}
+	}
+
+	// Only the order of the segments matters, so any precision will do
+	sort.SliceStable(keys, func(i, j int) bool {
+		first, _, _ := segmentBounds(segments[keys[i]][0].filePath, "s")
+		second, _, _ := segmentBounds(segments[keys[j]][0].filePath, "s")
+		return first < second
+	})
+
+	groups := make([][]segmentFile, len(keys))
+	for i, key := range keys {
+		groups[i] = segments[key]
+	}
+	return groups, nil
+}
+
+// scanSeries calls fn for every point of several series between start and end, in time order.
+// Series are merged one 6-hour segment at a time, so only one segment per series is held.
+func scanSeries(list []seriesInfo, start, end int64, fn func(series seriesInfo, point dataPoint) error) error {
+	segments, err := seriesSegments(list, start, end)
+	if err != nil {
+		return err
+	}
+
+	type mergedPoint struct {
+		series seriesInfo
+		point  dataPoint
+	}
+
+	for _, group := range segments {
+		merged := []mergedPoint{}
+		for _, file := range group {
+			points, err := readSegment(file.filePath, start, end)
+			if err != nil {
+				return err
+			}
+			for _, point := range expandPoints(points) {
+				merged = append(merged, mergedPoint{series: file.series, point: point})
+			}
+		}
+
+		if len(group) > 1 {
+			sort.SliceStable(merged, func(i, j int) bool {
+				return merged[i].point.Time < merged[j].point.Time
+			})
+		}
+
+		for _, item := range merged {
+			if err := fn(item.series, item.point); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// seriesBounds returns the first and last timestamps stored between start and end in several series
+func seriesBounds(list []seriesInfo, start, end int64) (int64, int64, bool, error) {
+	first, last, found := int64(0), int64(0), false
+	for _, series := range list {
+		seriesFirst, seriesLast, seriesFound, err := rangeBounds(series.Dir, series.Precision, start, end)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if !seriesFound {
+			continue
+		}
+		if !found || seriesFirst < first {
+			first = seriesFirst
+		}
+		if !found || seriesLast > last {
+			last = seriesLast
+		}
+		found = true
+	}
+	return first, last, found, nil
+}
+
+// seriesPoint formats a point for a response, naming its series when it has tags
+func seriesPoint(series seriesInfo, point dataPoint, data interface{}) map[string]interface{} {
+	formatted := map[string]interface{}{"time": point.Time, "data": data}
+	if len(series.Tags) > 0 {
+		formatted["tags"] = series.Tags
+	}
+	if series.Append {
+		formatted["seq"] = point.Seq
+	}
+	return formatted
+}
+
+// dropSeriesIndex forgets the cached series index of a collection directory
+func dropSeriesIndex(collectionDir string) {
+	seriesMutex.Lock()
+	defer seriesMutex.Unlock()
+	delete(seriesIndexes, collectionDir)
+}
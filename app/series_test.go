@@ -0,0 +1,24 @@
+package app
+
+import "testing"
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{tags: map[string]string{}, want: ""},
+		{tags: map[string]string{"site": "north", "device": "a1"}, want: "device=a1,site=north"},
+		{tags: map[string]string{"instance": "a,b"}, want: `instance=a\,b`},
+		{tags: map[string]string{"instance": `a\,b`}, want: `instance=a\\\,b`},
+		{tags: map[string]string{"path": `c:\tmp`}, want: `path=c:\tmp`}, // Kept as written before commas were allowed
+	}
+
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			if got := seriesKey(test.tags); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"github.com/gin-gonic/gin"
 )
@@ -15,9 +16,23 @@ func StartServer() {
 	addr := fmt.Sprintf(":%d", AppConfig.Server.Port)
 	fmt.Printf("Starting Gin server on %s...\n", addr)
 
+	// Finish a batch interrupted by a crash before serving requests
+	if err := replayWAL(); err != nil {
+		fmt.Printf("Failed to replay write-ahead log: %v\n", err)
+		return
+	}
+
+	// Graphite and OpenTSDB listeners of legacy collectors
+	if err := startListeners(); err != nil {
+		fmt.Printf("Failed to start listeners: %v\n", err)
+		stopListeners()
+		return
+	}
+
 	r := gin.Default()
 	r.Use(func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
+		// Prometheus and Grafana send the token as "Bearer <token>"
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
 		if token != AppConfig.Server.Token {
 			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
 			return
@@ -43,6 +58,18 @@ func StartServer() {
 		}
 	}()
 
+	// The gRPC API runs on a second port over cleartext HTTP/2
+	var grpcServer *http.Server
+	if AppConfig.Server.GRPCPort > 0 {
+		grpcServer = newGRPCServer(fmt.Sprintf(":%d", AppConfig.Server.GRPCPort))
+		fmt.Printf("Starting gRPC server on %s...\n", grpcServer.Addr)
+		go func() {
+			if err := grpcServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Failed to start gRPC server: %v\n", err)
+			}
+		}()
+	}
+
 	// Capture termination signals (CTRL+C, Docker Stop, Kubernetes SIGTERM)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
@@ -60,6 +87,14 @@ func StartServer() {
 	if err := srv.Shutdown(ctx); err != nil {
 		fmt.Printf("Server forced to shutdown: %v\n", err)
 	}
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(ctx); err != nil {
+			fmt.Printf("gRPC server forced to shutdown: %v\n", err)
+		}
+	}
+
+	// Write the points the listeners still hold
+	stopListeners()
 
 	fmt.Println("Server gracefully stopped.")
 }
@@ -78,8 +113,38 @@ func RegisterRoutes(r *gin.Engine) {
 	r.PUT("/collections/:collection_name", add_collection)
 	r.DELETE("/collections/:collection_name", delete_collection)
 	r.PATCH("/collections/:collection_name", update_collection)
+	r.GET("/collections/:collection_name/schema", collection_schema)
+	r.PUT("/collections/:collection_name/schema", add_schema)
+	r.DELETE("/collections/:collection_name/schema", delete_schema)
 	
 	r.PUT("/data/:collection_name", add_data)
 	r.GET("/data/:collection_name", get_data)
 	r.DELETE("/data/:collection_name", delete_data)
+	r.POST("/data/:collection_name/stream", stream_data)
+	r.PUT("/data/:collection_name/:timestamp", add_value)
+	r.GET("/data/:collection_name/:timestamp", get_value)
+
+	r.POST("/batch", batch_data)
+
+	// InfluxDB line protocol
+	r.POST("/write", write_line_protocol)
+	r.GET("/ping", ping)
+	r.HEAD("/ping", ping)
+
+	// Prometheus remote storage
+	r.POST("/api/v1/write", remote_write)
+	r.POST("/api/v1/read", remote_read)
+	r.GET("/api/v1/query", query_instant)
+	r.POST("/api/v1/query", query_instant)
+	r.GET("/api/v1/query_range", query_range)
+	r.POST("/api/v1/query_range", query_range)
+
+	r.GET("/listeners", listener_stats)
+
+	r.POST("/query", query_data)
+	r.POST("/sql", sql_query)
+
+	r.GET("/rollups", rollups)
+	r.PUT("/rollups/:rollup_name", add_rollup)
+	r.DELETE("/rollups/:rollup_name", delete_rollup)
 }
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// The package reads config/config.yml from the working directory when it is initialized,
+// so tests run from the repository root like the server does. Package variables are set
+// before any init function runs.
+var _ = os.Chdir("..")
+
+// useDataDir runs a test in an empty directory with its own ./data and no cached segments
+func useDataDir(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("data", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	resetCaches()
+	t.Cleanup(resetCaches)
+}
+
+// resetCaches forgets the segments, series indexes and keys cached for the previous directory.
+// Saves still pending find no access time and skip their segments.
+func resetCaches() {
+	dataMutex.Lock()
+	inMemoryData = make(map[string]map[int64][]byte)
+	lastAccessTimestamps = make(map[string]int64)
+	dataMutex.Unlock()
+
+	seriesMutex.Lock()
+	seriesIndexes = make(map[string]*seriesIndex)
+	seriesMutex.Unlock()
+
+	blobMutex.Lock()
+	releasedBlobs = make(map[string]map[string]bool)
+	blobMutex.Unlock()
+
+	idempotencyMutex.Lock()
+	if idempotencyLog != nil {
+		idempotencyLog.Close()
+	}
+	idempotencyKeys, idempotencyLog, idempotencyRecords = nil, nil, 0
+	idempotencyPending = map[string]bool{}
+	idempotencyMutex.Unlock()
+}
+
+// writePoints writes data at the given times into a collection, creating it with a precision
+// if needed. Reads see the points straight away, before the save started by the write.
+func writePoints(t *testing.T, collection, precision string, tags map[string]string, points map[int64]interface{}) {
+	t.Helper()
+	if err := ensureCollection("./data/"+collection, precision); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []ingestItem{}
+	for ts, data := range points {
+		items = append(items, ingestItem{Time: json.RawMessage(strconv.FormatInt(ts, 10)), Data: data, Tags: tags})
+	}
+	result, err := ingest(collection, items, false)
+	if err != nil || len(result.Failures) > 0 {
+		t.Fatalf("failed to write %s: %v %+v", collection, err, result.Failures)
+	}
+}
+
+// saveSegments writes every cached segment to disk, for tests of reads served from saved files
+func saveSegments(t *testing.T) {
+	t.Helper()
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+	for filePath, fileData := range inMemoryData {
+		if err := writeSegmentLocked(filePath, fileData); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package app
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sketchAccuracy is the relative accuracy of the quantiles returned by a ddSketch
+const sketchAccuracy = 0.01
+
+// ddSketch is a mergeable quantile sketch (DDSketch). Values are counted in logarithmic
+// buckets so that any quantile is returned within sketchAccuracy of its true value.
+type ddSketch struct {
+	Positive map[int]uint64
+	Negative map[int]uint64
+	Zero     uint64
+	Count    uint64
+	Min      float64
+	Max      float64
+}
+
+func newSketch() *ddSketch {
+	return &ddSketch{Positive: map[int]uint64{}, Negative: map[int]uint64{}}
+}
+
+func sketchGamma() float64 {
+	return (1 + sketchAccuracy) / (1 - sketchAccuracy)
+}
+
+// sketchIndex returns the bucket of a positive value
+func sketchIndex(value float64) int {
+	return int(math.Ceil(math.Log(value) / math.Log(sketchGamma())))
+}
+
+// sketchValue returns the representative value of a bucket
+func sketchValue(index int) float64 {
+	gamma := sketchGamma()
+	return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+func (s *ddSketch) add(value float64) {
+	switch {
+	case value > 0:
+		s.Positive[sketchIndex(value)]++
+	case value < 0:
+		s.Negative[sketchIndex(-value)]++
+	default:
+		s.Zero++
+	}
+
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Count++
+}
+
+func (s *ddSketch) merge(other *ddSketch) {
+	if other.Count == 0 {
+		return
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+
+	for index, count := range other.Positive {
+		s.Positive[index] += count
+	}
+	for index, count := range other.Negative {
+		s.Negative[index] += count
+	}
+	s.Zero += other.Zero
+	s.Count += other.Count
+}
+
+// quantile returns the value below which a fraction q (0 to 1) of the values fall
+func (s *ddSketch) quantile(q float64) float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return s.Min
+	}
+	if q >= 1 {
+		return s.Max
+	}
+
+	rank := uint64(q * float64(s.Count-1))
+	seen := uint64(0)
+
+	// Walk from the most negative bucket up to the largest positive one
+	negative := sortedIndexes(s.Negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		seen += s.Negative[negative[i]]
+		if seen > rank {
+			return math.Max(-sketchValue(negative[i]), s.Min)
+		}
+	}
+
+	seen += s.Zero
+	if seen > rank {
+		return 0
+	}
+
+	for _, index := range sortedIndexes(s.Positive) {
+		seen += s.Positive[index]
+		if seen > rank {
+			return math.Min(sketchValue(index), s.Max)
+		}
+	}
+	return s.Max
+}
+
+func sortedIndexes(buckets map[int]uint64) []int {
+	indexes := make([]int, 0, len(buckets))
+	for index := range buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// numericLeaves collects every numeric value of a decoded payload keyed by its dotted path.
+// A payload that is itself a number is stored under the empty path.
+func numericLeaves(data interface{}, prefix string, leaves map[string]float64) {
+	switch value := data.(type) {
+	case float64:
+		leaves[prefix] = value
+	case map[string]interface{}:
+		for key, child := range value {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			numericLeaves(child, path, leaves)
+		}
+	}
+}
+
+// sketchPath returns the sketch file stored next to a .san file
+func sketchPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".san") + ".sketch"
+}
+
+// buildSketches computes one sketch per numeric field of the values of a segment
+func buildSketches(fileData map[int64][]byte) map[string]*ddSketch {
+	sketches := map[string]*ddSketch{}
+	for _, stored := range fileData {
+		for _, data := range splitValues(stored) {
+			leaves := map[string]float64{}
+			numericLeaves(decodeData(data), "", leaves)
+			for path, value := range leaves {
+				sketch, exists := sketches[path]
+				if !exists {
+					sketch = newSketch()
+					sketches[path] = sketch
+				}
+				sketch.add(value)
+			}
+		}
+	}
+	return sketches
+}
+
+// writeSketch stores the sketches of a segment in a temporary file, returning its path
+func writeSketch(filePath string, sketches map[string]*ddSketch) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(sketchPath(filePath))+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create sketch file: %w", err)
+	}
+	defer file.Close()
+	tmpPath := file.Name()
+
+	if err := gob.NewEncoder(file).Encode(sketches); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to encode sketch file: %w", err)
+	}
+	return tmpPath, nil
+}
+
+// dropSketch removes the sketch of a segment whose data changed. It is built again from the
+// saved segment by the next percentile query, so saves never decode the values they write.
+func dropSketch(filePath string) {
+	if err := os.Remove(sketchPath(filePath)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Failed to remove sketch of %s: %v\n", filePath, err)
+	}
+}
+
+// segmentBounds returns the first and last tick of a precision covered by a .san file
+func segmentBounds(filePath, precision string) (int64, int64, bool) {
+	parts := strings.Split(strings.TrimSuffix(filePath, ".san"), "/")
+	if len(parts) < 3 {
+		return 0, 0, false
+	}
+
+	year, errYear := strconv.Atoi(parts[len(parts)-3])
+	day, errDay := strconv.Atoi(parts[len(parts)-2])
+	segment, errSegment := strconv.Atoi(parts[len(parts)-1])
+	if errYear != nil || errDay != nil || errSegment != nil {
+		return 0, 0, false
+	}
+
+	start := time.Date(year, 1, day, (segment-1)*6, 0, 0, 0, time.Local)
+	end := time.Date(year, 1, day, segment*6, 0, 0, 0, time.Local)
+	return timestampOf(start, precision), timestampOf(end, precision) - 1, true
+}
+
+// storedSketch returns the sketch of a field for a segment saved on disk, building and
+// saving the sketches of the segment if they are missing or older than it. Segments held in
+// memory may have unsaved changes and are never served from their sketch.
+func storedSketch(filePath, field string) *ddSketch {
+	segmentInfo, ok := savedSegment(filePath, nil)
+	if !ok {
+		return nil
+	}
+
+	// The files are read without dataMutex, and the segment is checked again afterwards
+	var sketches map[string]*ddSketch
+	if sketchInfo, err := os.Stat(sketchPath(filePath)); err == nil && !sketchInfo.ModTime().Before(segmentInfo.ModTime()) {
+		if file, err := os.Open(sketchPath(filePath)); err == nil {
+			if gob.NewDecoder(file).Decode(&sketches) != nil {
+				sketches = nil
+			}
+			file.Close()
+		}
+	}
+
+	tmpPath := ""
+	if sketches == nil {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil
+		}
+		fileData := make(map[int64][]byte)
+		err = gob.NewDecoder(file).Decode(&fileData)
+		file.Close()
+		if err != nil {
+			return nil
+		}
+
+		sketches = buildSketches(fileData)
+		if tmpPath, err = writeSketch(filePath, sketches); err != nil {
+			fmt.Printf("Failed to save sketch of %s: %v\n", filePath, err)
+		}
+	}
+
+	// A segment loaded or saved meanwhile is read point by point, and its sketch is not kept
+	if _, ok := savedSegment(filePath, func(info os.FileInfo) bool {
+		if !info.ModTime().Equal(segmentInfo.ModTime()) || info.Size() != segmentInfo.Size() {
+			return false
+		}
+		return tmpPath == "" || os.Rename(tmpPath, sketchPath(filePath)) == nil
+	}); !ok {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+		return nil
+	}
+
+	if sketch, exists := sketches[field]; exists {
+		return sketch
+	}
+	return newSketch() // No point of the segment has this field
+}
+
+// savedSegment stats a segment that is on disk and not held in memory, and runs check on it
+// under dataMutex. Segments are only written while held in memory, so the file cannot change
+// while check runs.
+func savedSegment(filePath string, check func(info os.FileInfo) bool) (os.FileInfo, bool) {
+	dataMutex.RLock()
+	defer dataMutex.RUnlock()
+	if _, inMemory := inMemoryData[filePath]; inMemory {
+		return nil, false
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil || (check != nil && !check(info)) {
+		return nil, false
+	}
+	return info, true
+}
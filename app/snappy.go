@@ -0,0 +1,131 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// snappyMaxLength bounds the decoded size of a snappy block
+const snappyMaxLength = 256 * 1024 * 1024
+
+// snappyDecode decompresses a block in the snappy format, as used by the Prometheus
+// remote protocols (not the framed stream format)
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > snappyMaxLength {
+		return nil, fmt.Errorf("invalid snappy length")
+	}
+	src = src[n:]
+
+	// A copy of at most 64 bytes takes 3 bytes, so a block never expands more than 22 times.
+	// A larger declared length is a lie that must not size the buffer.
+	if length > uint64(len(src))*22 {
+		return nil, fmt.Errorf("invalid snappy length")
+	}
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0: // Literal
+			size := int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				extra := size - 59
+				if len(src) < extra {
+					return nil, fmt.Errorf("truncated snappy literal")
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			size++
+			if size > len(src) || len(dst)+size > int(length) {
+				return nil, fmt.Errorf("invalid snappy literal")
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+
+		case 1: // Copy with a 1-byte offset
+			if len(src) < 2 {
+				return nil, fmt.Errorf("truncated snappy copy")
+			}
+			size := 4 + int(tag>>2&7)
+			offset := int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+			if err := snappyCopy(&dst, offset, size, int(length)); err != nil {
+				return nil, err
+			}
+
+		case 2: // Copy with a 2-byte offset
+			if len(src) < 3 {
+				return nil, fmt.Errorf("truncated snappy copy")
+			}
+			size := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+			if err := snappyCopy(&dst, offset, size, int(length)); err != nil {
+				return nil, err
+			}
+
+		case 3: // Copy with a 4-byte offset
+			if len(src) < 5 {
+				return nil, fmt.Errorf("truncated snappy copy")
+			}
+			size := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+			if err := snappyCopy(&dst, offset, size, int(length)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(dst) != int(length) {
+		return nil, fmt.Errorf("snappy length mismatch")
+	}
+	return dst, nil
+}
+
+// snappyCopy repeats size bytes starting offset bytes back; the ranges may overlap
+func snappyCopy(dst *[]byte, offset, size, limit int) error {
+	if offset <= 0 || offset > len(*dst) || len(*dst)+size > limit {
+		return fmt.Errorf("invalid snappy copy")
+	}
+	start := len(*dst) - offset
+	for i := 0; i < size; i++ {
+		*dst = append(*dst, (*dst)[start+i])
+	}
+	return nil
+}
+
+// snappyEncode compresses a block in the snappy format. It only emits literals, which
+// every decoder accepts, trading size for simplicity.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+
+	for len(src) > 0 {
+		size := len(src)
+		if size > 65536 {
+			size = 65536
+		}
+
+		// Short literals keep their length in the tag, longer ones in 1 or 2 more bytes
+		n := size - 1
+		switch {
+		case n < 60:
+			dst = append(dst, byte(n)<<2)
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+
+		dst = append(dst, src[:size]...)
+		src = src[size:]
+	}
+	return dst
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSnappyDecode(t *testing.T) {
+	long := strings.Repeat("0123456789", 10)
+
+	// Blocks written by hand from the snappy format description
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", input: []byte{0x00}, want: ""},
+		{name: "short literal", input: []byte{0x01, 0x00, 'a'}, want: "a"},
+		{name: "literal with 1-byte length", input: append([]byte{100, 60 << 2, 99}, long...), want: long},
+		{name: "literal with 2-byte length", input: append([]byte{100, 61 << 2, 99, 0}, long...), want: long},
+		{name: "copy with 1-byte offset", input: []byte{12, 2 << 2, 'a', 'b', 'c', 0x01 | 5<<2, 3}, want: "abcabcabcabc"},
+		{name: "copy with 2-byte offset", input: []byte{12, 1 << 2, 'a', 'b', 0x02 | 9<<2, 2, 0}, want: "abababababab"},
+		{name: "copy with 4-byte offset", input: []byte{12, 1 << 2, 'a', 'b', 0x03 | 9<<2, 2, 0, 0, 0}, want: "abababababab"},
+		{name: "overlapping copy", input: []byte{9, 0, 'x', 0x01 | 4<<2, 1}, want: "xxxxxxxxx"},
+
+		{name: "missing length", input: []byte{}, wantErr: true},
+		{name: "truncated literal", input: []byte{3, 2 << 2, 'a'}, wantErr: true},
+		{name: "truncated literal length", input: []byte{100, 60 << 2}, wantErr: true},
+		{name: "truncated copy", input: []byte{4, 0, 'a', 0x01}, wantErr: true},
+		{name: "zero offset", input: []byte{5, 0, 'a', 0x01, 0}, wantErr: true},
+		{name: "offset before start", input: []byte{5, 0, 'a', 0x01, 2}, wantErr: true},
+		{name: "output longer than declared", input: []byte{2, 2 << 2, 'a', 'b', 'c'}, wantErr: true},
+		{name: "output shorter than declared", input: []byte{4, 1 << 2, 'a', 'b'}, wantErr: true},
+		{name: "declared length beyond any expansion", input: []byte{0xff, 0xff, 0xff, 0x7f, 0, 'a'}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := snappyDecode(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "empty", input: []byte{}},
+		{name: "short", input: []byte("hello")},
+		{name: "one long literal", input: bytes.Repeat([]byte{7}, 300)},
+		{name: "several literals", input: bytes.Repeat([]byte("abcdefgh"), 20000)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := snappyDecode(snappyEncode(test.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, test.input) {
+				t.Fatalf("round trip changed %d bytes into %d", len(test.input), len(got))
+			}
+		})
+	}
+}
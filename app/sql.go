@@ -0,0 +1,577 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// sqlStatement is a parsed SELECT statement
+type sqlStatement struct {
+	Explain    bool
+	Fields     []sqlField // Empty for SELECT *
+	Collection string
+	Where      sqlExpr
+	Interval   int64  // GROUP BY time(...) in milliseconds, 0 when absent
+	Fill       string // FILL(...) mode
+	Descending bool   // ORDER BY time DESC
+	Limit      int
+	Offset     int
+}
+
+// sqlField is one item of the SELECT list, e.g. `mean(temp) AS t`, `percentile(latency, 95)` or `meta.location`
+type sqlField struct {
+	Function string // Empty for raw fields
+	Path     string
+	Args     []float64 // Numeric arguments after the field
+	Alias    string
+}
+
+type sqlExpr interface{}
+
+// sqlBinary is a comparison or a logical AND/OR
+type sqlBinary struct {
+	Op    string
+	Left  sqlExpr
+	Right sqlExpr
+}
+
+type sqlNot struct {
+	Expr sqlExpr
+}
+
+// sqlRef references `time` or a payload field
+type sqlRef struct {
+	Path []string
+}
+
+type sqlLiteral struct {
+	Value interface{} // int64, float64, string or bool; integers and times stay exact
+}
+
+type sqlToken struct {
+	Kind  string // ident, string, number, duration, op or eof
+	Value string
+	Pos   int
+}
+
+var sqlOperators = map[string]bool{
+	"(": true, ")": true, "*": true, ",": true, "+": true, "-": true,
+	"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+var sqlComparisons = map[string]bool{
+	"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+// lexSQL splits a statement into tokens
+func lexSQL(input string) ([]sqlToken, error) {
+	tokens := []sqlToken{}
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{Kind: "ident", Value: string(runes[start:i]), Pos: start})
+
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			kind := "number"
+			if i < len(runes) && unicode.IsLetter(runes[i]) {
+				// A number followed by a unit is a duration literal such as 15m
+				kind = "duration"
+				for i < len(runes) && unicode.IsLetter(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, sqlToken{Kind: kind, Value: string(runes[start:i]), Pos: start})
+
+		case r == '\'' || r == '"':
+			start := i
+			i++
+			var value strings.Builder
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+
+			// Single quotes are string literals, double quotes are identifiers
+			kind := "string"
+			if r == '"' {
+				kind = "ident"
+			}
+			tokens = append(tokens, sqlToken{Kind: kind, Value: value.String(), Pos: start})
+
+		default:
+			op := string(r)
+			if i+1 < len(runes) && sqlOperators[string(runes[i:i+2])] {
+				op = string(runes[i : i+2])
+			}
+			if !sqlOperators[op] {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", r, i)
+			}
+			tokens = append(tokens, sqlToken{Kind: "op", Value: op, Pos: i})
+			i += len([]rune(op))
+		}
+	}
+
+	return append(tokens, sqlToken{Kind: "eof", Pos: len(runes)}), nil
+}
+
+type sqlParser struct {
+	tokens      []sqlToken
+	pos         int
+	now         time.Time
+	precision   string // Precision of the collection, known once FROM is parsed
+	precisionOf func(string) string
+}
+
+// parseSQL parses a statement such as
+// `SELECT mean(temp) FROM sensor_1 WHERE time > now()-1h GROUP BY time(1m) FILL(previous)`.
+// Times and durations are folded to ticks of the precision of the collection.
+func parseSQL(input string, now time.Time, precisionOf func(collection string) string) (*sqlStatement, error) {
+	tokens, err := lexSQL(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sqlParser{tokens: tokens, now: now, precision: "ms", precisionOf: precisionOf}
+	return p.parseStatement()
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) next() sqlToken {
+	token := p.tokens[p.pos]
+	if token.Kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+// keyword reports whether the next token is the given keyword and consumes it
+func (p *sqlParser) keyword(word string) bool {
+	token := p.peek()
+	if token.Kind == "ident" && strings.EqualFold(token.Value, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// op reports whether the next token is the given operator and consumes it
+func (p *sqlParser) op(value string) bool {
+	token := p.peek()
+	if token.Kind == "op" && token.Value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) errorf(format string, args ...interface{}) error {
+	token := p.peek()
+	found := token.Value
+	if token.Kind == "eof" {
+		found = "end of statement"
+	}
+	return fmt.Errorf("%s at position %d (found '%s')", fmt.Sprintf(format, args...), token.Pos, found)
+}
+
+func (p *sqlParser) expectOp(value string) error {
+	if !p.op(value) {
+		return p.errorf("expected '%s'", value)
+	}
+	return nil
+}
+
+func (p *sqlParser) parseStatement() (*sqlStatement, error) {
+	stmt := &sqlStatement{}
+	stmt.Explain = p.keyword("EXPLAIN")
+
+	if !p.keyword("SELECT") {
+		return nil, p.errorf("expected SELECT")
+	}
+
+	if !p.op("*") {
+		for {
+			field, err := p.parseField()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Fields = append(stmt.Fields, field)
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+
+	if !p.keyword("FROM") {
+		return nil, p.errorf("expected FROM")
+	}
+	token := p.next()
+	if token.Kind != "ident" {
+		return nil, fmt.Errorf("expected collection name at position %d", token.Pos)
+	}
+	if !validCollectionName(token.Value) {
+		return nil, fmt.Errorf("invalid collection name '%s' at position %d", token.Value, token.Pos)
+	}
+	stmt.Collection = token.Value
+	p.precision = p.precisionOf(stmt.Collection)
+
+	if p.keyword("WHERE") {
+		where, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+
+	if p.keyword("GROUP") {
+		if !p.keyword("BY") || !p.keyword("time") {
+			return nil, p.errorf("expected GROUP BY time(...)")
+		}
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		token := p.next()
+		if token.Kind != "duration" {
+			return nil, fmt.Errorf("expected interval at position %d", token.Pos)
+		}
+		interval, err := parseInterval(token.Value, p.precision)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Interval = interval
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("FILL") {
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		fill := ""
+		if p.op("-") {
+			fill = "-"
+		}
+		token := p.next()
+		if token.Kind != "ident" && token.Kind != "number" {
+			return nil, fmt.Errorf("expected fill mode at position %d", token.Pos)
+		}
+		stmt.Fill = strings.ToLower(fill + token.Value)
+		if err := validateFill(stmt.Fill); err != nil {
+			return nil, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("ORDER") {
+		if !p.keyword("BY") || !p.keyword("time") {
+			return nil, p.errorf("expected ORDER BY time")
+		}
+		if p.keyword("DESC") {
+			stmt.Descending = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		limit, err := p.parseCount()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Limit = limit
+	}
+
+	if p.keyword("OFFSET") {
+		offset, err := p.parseCount()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Offset = offset
+	}
+
+	if p.peek().Kind != "eof" {
+		return nil, p.errorf("unexpected token")
+	}
+
+	return stmt, nil
+}
+
+func (p *sqlParser) parseCount() (int, error) {
+	token := p.next()
+	count, err := strconv.Atoi(token.Value)
+	if token.Kind != "number" || err != nil || count < 0 {
+		return 0, fmt.Errorf("expected a non-negative integer at position %d", token.Pos)
+	}
+	return count, nil
+}
+
+func (p *sqlParser) parseField() (sqlField, error) {
+	token := p.next()
+	if token.Kind != "ident" {
+		return sqlField{}, fmt.Errorf("expected field at position %d", token.Pos)
+	}
+
+	field := sqlField{Path: token.Value}
+	if p.op("(") {
+		field.Function = strings.ToLower(token.Value)
+		if !aggregateFunctions[field.Function] {
+			return sqlField{}, fmt.Errorf("unknown function '%s' at position %d", token.Value, token.Pos)
+		}
+
+		field.Path = ""
+		if !p.op("*") {
+			arg := p.next()
+			if arg.Kind != "ident" {
+				return sqlField{}, fmt.Errorf("expected field at position %d", arg.Pos)
+			}
+			field.Path = arg.Value
+		}
+		for p.op(",") {
+			arg, err := p.parseTerm()
+			if err != nil {
+				return sqlField{}, err
+			}
+			literal, ok := arg.(*sqlLiteral)
+			number, isNumber := 0.0, false
+			if ok {
+				number, isNumber = sqlFloat(literal.Value)
+			}
+			if !isNumber {
+				return sqlField{}, fmt.Errorf("function '%s' only takes numeric arguments after the field", field.Function)
+			}
+			field.Args = append(field.Args, number)
+		}
+		if err := p.expectOp(")"); err != nil {
+			return sqlField{}, err
+		}
+	}
+
+	if p.keyword("AS") {
+		alias := p.next()
+		if alias.Kind != "ident" {
+			return sqlField{}, fmt.Errorf("expected alias at position %d", alias.Pos)
+		}
+		field.Alias = alias.Value
+	}
+
+	return field, nil
+}
+
+func (p *sqlParser) parseOr() (sqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{Op: "OR", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseAnd() (sqlExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{Op: "AND", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseUnary() (sqlExpr, error) {
+	if p.keyword("NOT") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlNot{Expr: expr}, nil
+	}
+
+	if p.op("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.peek()
+	if token.Kind != "op" || !sqlComparisons[token.Value] {
+		return nil, p.errorf("expected comparison operator")
+	}
+	p.next()
+
+	op := token.Value
+	if op == "<>" {
+		op = "!="
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlBinary{Op: op, Left: left, Right: right}, nil
+}
+
+// parseOperand parses a field reference or a constant, folding `now() - 1h` style arithmetic
+func (p *sqlParser) parseOperand() (sqlExpr, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		sign := int64(0)
+		switch {
+		case p.op("+"):
+			sign = 1
+		case p.op("-"):
+			sign = -1
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		l, lok := left.(*sqlLiteral)
+		r, rok := right.(*sqlLiteral)
+		if !lok || !rok {
+			return nil, fmt.Errorf("arithmetic is only supported between constants")
+		}
+		// Integers such as times and durations are added exactly
+		li, liok := l.Value.(int64)
+		ri, riok := r.Value.(int64)
+		if liok && riok {
+			left = &sqlLiteral{Value: li + sign*ri}
+			continue
+		}
+		lv, lok := sqlFloat(l.Value)
+		rv, rok := sqlFloat(r.Value)
+		if !lok || !rok {
+			return nil, fmt.Errorf("arithmetic is only supported between numbers and durations")
+		}
+		left = &sqlLiteral{Value: lv + float64(sign)*rv}
+	}
+}
+
+// sqlFloat converts a numeric literal to float64
+func sqlFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func (p *sqlParser) parseTerm() (sqlExpr, error) {
+	if p.op("-") {
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if literal, ok := term.(*sqlLiteral); ok {
+			switch number := literal.Value.(type) {
+			case int64:
+				return &sqlLiteral{Value: -number}, nil
+			case float64:
+				return &sqlLiteral{Value: -number}, nil
+			}
+		}
+		return nil, fmt.Errorf("expected number after '-'")
+	}
+
+	token := p.next()
+	switch token.Kind {
+	case "number":
+		// Integers are kept exact, so nanosecond times survive
+		if integer, err := strconv.ParseInt(token.Value, 10, 64); err == nil {
+			return &sqlLiteral{Value: integer}, nil
+		}
+		number, err := strconv.ParseFloat(token.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at position %d", token.Value, token.Pos)
+		}
+		return &sqlLiteral{Value: number}, nil
+
+	case "duration":
+		interval, err := parseInterval(token.Value, p.precision)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlLiteral{Value: interval}, nil
+
+	case "string":
+		return &sqlLiteral{Value: token.Value}, nil
+
+	case "ident":
+		switch strings.ToLower(token.Value) {
+		case "now":
+			if err := p.expectOp("("); err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return &sqlLiteral{Value: timestampOf(p.now, p.precision)}, nil
+		case "true":
+			return &sqlLiteral{Value: true}, nil
+		case "false":
+			return &sqlLiteral{Value: false}, nil
+		}
+		return &sqlRef{Path: strings.Split(token.Value, ".")}, nil
+	}
+
+	return nil, fmt.Errorf("expected value at position %d", token.Pos)
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sqlTestNow is the time now() resolves to in these tests
+var sqlTestNow = time.Unix(1700000000, 0)
+
+// parseTestSQL parses a statement where the collection `sensors` has second precision
+func parseTestSQL(input string) (*sqlStatement, error) {
+	return parseSQL(input, sqlTestNow, func(collection string) string {
+		if collection == "sensors" {
+			return "s"
+		}
+		return "ms"
+	})
+}
+
+func TestParseSQL(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    *sqlStatement
+		wantErr string // Part of the error message, when the statement is invalid
+	}{
+		{query: "SELECT * FROM sensors", want: &sqlStatement{Collection: "sensors"}},
+		{
+			query: "select mean(temp) AS t, percentile(latency, 95), meta.location from sensors",
+			want: &sqlStatement{Collection: "sensors", Fields: []sqlField{
+				{Function: "mean", Path: "temp", Alias: "t"},
+				{Function: "percentile", Path: "latency", Args: []float64{95}},
+				{Path: "meta.location"},
+			}},
+		},
+		{query: "SELECT count(*) FROM sensors", want: &sqlStatement{Collection: "sensors", Fields: []sqlField{{Function: "count"}}}},
+		{
+			query: "EXPLAIN SELECT max(temp) FROM sensors WHERE time > now() - 1h GROUP BY time(1m) FILL(previous) ORDER BY time DESC LIMIT 10 OFFSET 5",
+			want: &sqlStatement{
+				Explain:    true,
+				Fields:     []sqlField{{Function: "max", Path: "temp"}},
+				Collection: "sensors",
+				Where:      &sqlBinary{Op: ">", Left: &sqlRef{Path: []string{"time"}}, Right: &sqlLiteral{Value: int64(1700000000 - 3600)}},
+				Interval:   60,
+				Fill:       "previous",
+				Descending: true,
+				Limit:      10,
+				Offset:     5,
+			},
+		},
+		{
+			// Durations follow the precision of the collection
+			query: "SELECT * FROM events WHERE time >= now() - 1s",
+			want: &sqlStatement{Collection: "events", Where: &sqlBinary{
+				Op: ">=", Left: &sqlRef{Path: []string{"time"}}, Right: &sqlLiteral{Value: int64(1700000000000 - 1000)},
+			}},
+		},
+		{
+			query: `SELECT * FROM sensors WHERE NOT (room = 'a' OR "reading.temp" <> -1.5) AND on = true`,
+			want: &sqlStatement{Collection: "sensors", Where: &sqlBinary{
+				Op: "AND",
+				Left: &sqlNot{Expr: &sqlBinary{
+					Op:    "OR",
+					Left:  &sqlBinary{Op: "=", Left: &sqlRef{Path: []string{"room"}}, Right: &sqlLiteral{Value: "a"}},
+					Right: &sqlBinary{Op: "!=", Left: &sqlRef{Path: []string{"reading", "temp"}}, Right: &sqlLiteral{Value: -1.5}},
+				}},
+				Right: &sqlBinary{Op: "=", Left: &sqlRef{Path: []string{"on"}}, Right: &sqlLiteral{Value: true}},
+			}},
+		},
+		{query: "SELECT * FROM sensors FILL(-1)", want: &sqlStatement{Collection: "sensors", Fill: "-1"}},
+		{
+			// Integers stay exact, so nanosecond times keep every digit
+			query: "SELECT * FROM events WHERE time = 1700000000123456789",
+			want: &sqlStatement{Collection: "events", Where: &sqlBinary{
+				Op: "=", Left: &sqlRef{Path: []string{"time"}}, Right: &sqlLiteral{Value: int64(1700000000123456789)},
+			}},
+		},
+
+		{query: "", wantErr: "expected SELECT at position 0"},
+		{query: "SELECT temp sensors", wantErr: "expected FROM"},
+		{query: "SELECT * FROM", wantErr: "expected collection name"},
+		{query: "SELECT * FROM 'sensors'", wantErr: "expected collection name"},
+		{query: `SELECT * FROM ".."`, wantErr: "invalid collection name '..'"},
+		{query: `SELECT * FROM "a/b"`, wantErr: "invalid collection name 'a/b'"},
+		{query: "SELECT median(temp) FROM sensors", wantErr: "unknown function 'median'"},
+		{query: "SELECT percentile(latency, 'x') FROM sensors", wantErr: "only takes numeric arguments"},
+		{query: "SELECT * FROM sensors WHERE room", wantErr: "expected comparison operator"},
+		{query: "SELECT * FROM sensors WHERE temp > a + 1", wantErr: "only supported between constants"},
+		{query: "SELECT * FROM sensors WHERE temp > 'a' + 1", wantErr: "between numbers and durations"},
+		{query: "SELECT * FROM sensors WHERE room = 'a", wantErr: "unterminated string"},
+		{query: "SELECT * FROM sensors WHERE room = a;", wantErr: "unexpected character ';'"},
+		{query: "SELECT * FROM sensors GROUP BY room", wantErr: "expected GROUP BY time(...)"},
+		{query: "SELECT * FROM sensors GROUP BY time(10)", wantErr: "expected interval"},
+		{query: "SELECT * FROM sensors FILL(sideways)", wantErr: "invalid fill 'sideways'"},
+		{query: "SELECT * FROM sensors LIMIT -1", wantErr: "expected a non-negative integer"},
+		{query: "SELECT * FROM sensors LIMIT 1 extra", wantErr: "unexpected token at position 30 (found 'extra')"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			got, err := parseTestSQL(test.query)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTimeBounds(t *testing.T) {
+	tests := []struct {
+		where string
+		start int64
+		end   int64
+	}{
+		{where: "time > 10", start: 11, end: math.MaxInt64},
+		{where: "time >= 10", start: 10, end: math.MaxInt64},
+		{where: "time < 10", start: math.MinInt64, end: 9},
+		{where: "time <= 10", start: math.MinInt64, end: 10},
+		{where: "time = 10", start: 10, end: 10},
+		{where: "10 < time", start: 11, end: math.MaxInt64},
+		{where: "time >= 10 AND time < 20 AND temp > 5", start: 10, end: 19},
+
+		// Fractional bounds keep the whole ticks on their side
+		{where: "time > 5.5", start: 6, end: math.MaxInt64},
+		{where: "time >= 5.5", start: 6, end: math.MaxInt64},
+		{where: "time < 5.5", start: math.MinInt64, end: 5},
+		{where: "time <= 5.5", start: math.MinInt64, end: 5},
+		{where: "time = 5.5", start: 6, end: 5},
+		{where: "time > 100000000000000000000000", start: 1<<62 + 1, end: math.MaxInt64},
+
+		// Only comparisons joined by AND narrow the range
+		{where: "time > 10 OR time < 5", start: math.MinInt64, end: math.MaxInt64},
+		{where: "NOT time > 10", start: math.MinInt64, end: math.MaxInt64},
+		{where: "time != 10", start: math.MinInt64, end: math.MaxInt64},
+		{where: "temp > 10", start: math.MinInt64, end: math.MaxInt64},
+	}
+
+	for _, test := range tests {
+		t.Run(test.where, func(t *testing.T) {
+			stmt, err := parseTestSQL("SELECT * FROM events WHERE " + test.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			start, end := timeBounds(stmt.Where, math.MinInt64, math.MaxInt64)
+			if start != test.start || end != test.end {
+				t.Fatalf("got %d to %d, want %d to %d", start, end, test.start, test.end)
+			}
+		})
+	}
+}
+
+func TestEvalSQL(t *testing.T) {
+	data := map[string]interface{}{
+		"room":    "a",
+		"on":      true,
+		"reading": map[string]interface{}{"temp": 21.5},
+	}
+
+	tests := []struct {
+		where string
+		want  bool
+	}{
+		{where: "room = 'a'", want: true},
+		{where: "room < 'b'", want: true},
+		{where: "reading.temp > 21", want: true},
+		{where: "reading.temp = 21.5 AND time = 100", want: true},
+		{where: "reading.temp > 30 OR on = true", want: true},
+		{where: "NOT on = true", want: false},
+		{where: "time < 100.5", want: true},
+		{where: "time > 99.5 AND time < 100", want: false},
+
+		// Missing fields and mismatched types never match, even with !=
+		{where: "missing != 1", want: false},
+		{where: "room = 1", want: false},
+		{where: "on > false", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.where, func(t *testing.T) {
+			stmt, err := parseTestSQL("SELECT * FROM events WHERE " + test.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := evalSQL(stmt.Where, 100, data); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package app
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dataPoint struct {
+	Time int64
+	Data []byte
+	Seq  int // Sequence number of a value in an append collection
+}
+
+// segmentPath returns the directory and .san file holding a timestamp
+func segmentPath(collectionDir, precision string, ts int64) (string, string) {
+	t := unixTime(ts, precision)
+	segment := (t.Hour() / 6) + 1 // Calculate 6-hour segment (1-4)
+
+	segmentDir := fmt.Sprintf("%s/%d/%d", collectionDir, t.Year(), t.YearDay())
+	return segmentDir, fmt.Sprintf("%s/%d.san", segmentDir, segment)
+}
+
+// segmentFiles lists, in time order, the .san files that may hold data between start and end,
+// including segments written since the last save
+func segmentFiles(collectionDir, precision string, start, end int64) ([]string, error) {
+	paths, err := savedSegmentFiles(collectionDir, precision, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	dataMutex.RLock()
+	defer dataMutex.RUnlock()
+	return addCachedSegmentsLocked(paths, collectionDir, precision, start, end), nil
+}
+
+// segmentFilesLocked is segmentFiles for a caller already holding dataMutex
+func segmentFilesLocked(collectionDir, precision string, start, end int64) ([]string, error) {
+	paths, err := savedSegmentFiles(collectionDir, precision, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return addCachedSegmentsLocked(paths, collectionDir, precision, start, end), nil
+}
+
+// segmentOrder returns the year, day and segment number of a .san file path
+func segmentOrder(filePath string) ([3]int, bool) {
+	order := [3]int{}
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(filePath)), "/")
+	if len(parts) < 3 || !strings.HasSuffix(parts[len(parts)-1], ".san") {
+		return order, false
+	}
+	parts = parts[len(parts)-3:]
+	parts[2] = strings.TrimSuffix(parts[2], ".san")
+
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return order, false
+		}
+		order[i] = value
+	}
+	return order, true
+}
+
+func segmentBefore(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// addCachedSegmentsLocked adds to the saved .san files of a collection the in-memory segments
+// between start and end not yet written to disk, keeping the list in time order.
+// The caller must hold dataMutex.
+func addCachedSegmentsLocked(paths []string, collectionDir, precision string, start, end int64) []string {
+	first, last := segmentOf(start, precision), segmentOf(end, precision)
+
+	listed := map[string]bool{}
+	for _, filePath := range paths {
+		listed[filepath.Clean(filePath)] = true
+	}
+
+	prefix := filepath.Clean(collectionDir) + string(filepath.Separator)
+	added := false
+	for filePath := range inMemoryData {
+		cleanPath := filepath.Clean(filePath)
+		if listed[cleanPath] || !strings.HasPrefix(cleanPath, prefix) {
+			continue
+		}
+		// Only the segments of this directory, not those of its tagged series
+		if strings.Count(strings.TrimPrefix(cleanPath, prefix), string(filepath.Separator)) != 2 {
+			continue
+		}
+
+		order, ok := segmentOrder(cleanPath)
+		if !ok || segmentBefore(order, first) || segmentBefore(last, order) {
+			continue
+		}
+		paths = append(paths, filePath)
+		added = true
+	}
+
+	if added {
+		sort.SliceStable(paths, func(i, j int) bool {
+			a, _ := segmentOrder(paths[i])
+			b, _ := segmentOrder(paths[j])
+			return segmentBefore(a, b)
+		})
+	}
+	return paths
+}
+
+// segmentOf returns the year, day and segment number holding a timestamp
+func segmentOf(ts int64, precision string) [3]int {
+	t := unixTime(ts, precision)
+	return [3]int{t.Year(), t.YearDay(), (t.Hour() / 6) + 1}
+}
+
+// savedSegmentFiles lists, in time order, the .san files on disk that may hold data between
+// start and end
+func savedSegmentFiles(collectionDir, precision string, start, end int64) ([]string, error) {
+	startTime := unixTime(start, precision)
+	endTime := unixTime(end, precision)
+
+	startYear, startDay := startTime.Year(), startTime.YearDay()
+	startSegment := (startTime.Hour() / 6) + 1
+
+	endYear, endDay := endTime.Year(), endTime.YearDay()
+	endSegment := (endTime.Hour() / 6) + 1
+
+	paths := []string{}
+
+	// Loop through years
+	for year := startYear; year <= endYear; year++ {
+		yearDir := fmt.Sprintf("%s/%d", collectionDir, year)
+
+		if _, err := os.Stat(yearDir); os.IsNotExist(err) {
+			continue
+		}
+
+		// Determine day range
+		dayStart := 1
+		dayEnd := 366
+
+		if year == startYear {
+			dayStart = startDay
+		}
+		if year == endYear {
+			dayEnd = endDay
+		}
+
+		for day := dayStart; day <= dayEnd; day++ {
+			dayDir := fmt.Sprintf("%s/%d", yearDir, day)
+
+			if _, err := os.Stat(dayDir); os.IsNotExist(err) {
+				continue
+			}
+
+			files, err := os.ReadDir(dayDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read directory: %w", err)
+			}
+
+			for _, file := range files {
+				if file.IsDir() || !strings.HasSuffix(file.Name(), ".san") {
+					continue
+				}
+
+				segment, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".san"))
+				if err != nil {
+					continue
+				}
+
+				if (year == startYear && day == startDay && segment < startSegment) ||
+					(year == endYear && day == endDay && segment > endSegment) {
+					continue
+				}
+
+				paths = append(paths, fmt.Sprintf("%s/%s", dayDir, file.Name()))
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// loadSegmentLocked returns the in-memory map of a .san file, decoding it from disk if needed.
+// The caller must hold the write lock on dataMutex.
+func loadSegmentLocked(filePath string) (map[int64][]byte, error) {
+	if fileData, exists := inMemoryData[filePath]; exists {
+		return fileData, nil
+	}
+
+	fileData := make(map[int64][]byte)
+
+	// Load existing data if the file exists
+	file, err := os.Open(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open .san file: %w", err)
+	}
+	if err == nil {
+		defer file.Close()
+
+		decoder := gob.NewDecoder(file)
+		if err := decoder.Decode(&fileData); err != nil {
+			return nil, fmt.Errorf("failed to decode .san file: %w", err)
+		}
+	}
+
+	inMemoryData[filePath] = fileData
+	lastAccessTimestamps[filePath] = time.Now().Unix()
+	return fileData, nil
+}
+
+// readSegment returns the points of a .san file between start and end, sorted by time
+func readSegment(filePath string, start, end int64) ([]dataPoint, error) {
+	collect := func(fileData map[int64][]byte) []dataPoint {
+		points := []dataPoint{}
+		for ts, data := range fileData {
+			if ts >= start && ts <= end {
+				points = append(points, dataPoint{Time: ts, Data: data})
+			}
+		}
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].Time < points[j].Time
+		})
+		return points
+	}
+
+	// Fast path when the file is already in memory
+	dataMutex.RLock()
+	if fileData, exists := inMemoryData[filePath]; exists {
+		points := collect(fileData)
+		dataMutex.RUnlock()
+		return points, nil
+	}
+	dataMutex.RUnlock()
+
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+
+	fileData, err := loadSegmentLocked(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return collect(fileData), nil
+}
+
+// scanRange calls fn for every point of a collection between start and end, in time order.
+// The points of every series are included. Returning an error from fn stops the scan.
+func scanRange(collectionDir string, start, end int64, fn func(point dataPoint) error) error {
+	list, err := findSeries(collectionDir, nil)
+	if err != nil {
+		return err
+	}
+
+	return scanSeries(list, start, end, func(_ seriesInfo, point dataPoint) error {
+		return fn(point)
+	})
+}
+
+// decodeData unmarshals a stored value into a generic interface{}
+func decodeData(data []byte) interface{} {
+	if binary, ok := decodeBinary(data); ok {
+		return binary.Bytes
+	}
+	// Values stored out of line are described rather than loaded
+	if ref, ok := decodeBlobRef(data); ok {
+		return map[string]interface{}{"blob": map[string]interface{}{"content_type": ref.ContentType, "size": float64(ref.Size)}}
+	}
+	var deserializedData interface{}
+	if err := json.Unmarshal(data, &deserializedData); err != nil {
+		// If unmarshaling fails, keep the original data as is
+		return string(data)
+	}
+	return deserializedData
+}
+
+// rangeBounds returns the first and last timestamps stored between start and end
+func rangeBounds(collectionDir, precision string, start, end int64) (int64, int64, bool, error) {
+	files, err := segmentFiles(collectionDir, precision, start, end)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	first, found := int64(0), false
+	for _, filePath := range files {
+		points, err := readSegment(filePath, start, end)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if len(points) > 0 {
+			first, found = points[0].Time, true
+			break
+		}
+	}
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		points, err := readSegment(files[i], start, end)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if len(points) > 0 {
+			return first, points[len(points)-1].Time, true, nil
+		}
+	}
+	return first, first, true, nil
+}
+
+// writeSegmentLocked saves a segment and its sketch, or removes both when it is empty.
+// The caller must hold the write lock on dataMutex.
+func writeSegmentLocked(filePath string, fileData map[int64][]byte) error {
+	if len(fileData) == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+		dropSketch(filePath)
+		removeReleasedBlobs(filePath, nil)
+		delete(inMemoryData, filePath)         // Remove from inMemoryData
+		delete(lastAccessTimestamps, filePath) // Remove from lastAccessTimestamps
+		return nil
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite file: %w", err)
+	}
+	defer file.Close()
+
+	encoder := gob.NewEncoder(file)
+	if err := encoder.Encode(fileData); err != nil {
+		return fmt.Errorf("failed to encode file: %w", err)
+	}
+
+	dropSketch(filePath)
+	removeReleasedBlobs(filePath, fileData)
+	return nil
+}
+
+// deleteRange removes the points of a collection between start and end and rewrites the
+// affected segments
+func deleteRange(collectionDir, precision string, start, end int64) error {
+	files, err := segmentFiles(collectionDir, precision, start, end)
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range files {
+		dataMutex.Lock()
+		fileData, err := loadSegmentLocked(filePath)
+		if err != nil {
+			dataMutex.Unlock()
+			return err
+		}
+
+		// Remove data inside the range from inMemoryData
+		removed := false
+		for ts := range fileData {
+			if ts >= start && ts <= end {
+				releaseBlob(filePath, fileData[ts], nil)
+				delete(fileData, ts)
+				removed = true
+			}
+		}
+
+		// Rewrite the file if data remains, otherwise delete the file
+		if removed || len(fileData) == 0 {
+			err = writeSegmentLocked(filePath, fileData)
+		}
+		dataMutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storePoints inserts or overwrites points of a collection and saves the touched segments
+func storePoints(collectionDir string, points []dataPoint) error {
+	manifest, err := loadManifest(collectionDir)
+	if err != nil {
+		return err
+	}
+	nowTime := time.Now().Unix()
+
+	for _, point := range points {
+		segmentDir, sanFilePath := segmentPath(collectionDir, manifest.Precision, point.Time)
+
+		// Ensure directory exists
+		if err := os.MkdirAll(segmentDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+
+		dataMutex.Lock()
+		fileData, err := loadSegmentLocked(sanFilePath)
+		if err != nil {
+			dataMutex.Unlock()
+			return err
+		}
+		fileData[point.Time] = point.Data
+		lastAccessTimestamps[sanFilePath] = nowTime
+		dataMutex.Unlock()
+	}
+
+	go save_to_disk(nowTime)
+	return nil
+}
+
+// collectionBounds returns the first and last timestamps stored in a collection
+func collectionBounds(collectionDir string) (int64, int64, bool, error) {
+	list, err := findSeries(collectionDir, nil)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	firstYear, lastYear := 0, 0
+	for _, series := range list {
+		files, err := os.ReadDir(series.Dir)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("failed to read collection directory: %w", err)
+		}
+
+		for _, file := range files {
+			year, err := strconv.Atoi(file.Name())
+			if !file.IsDir() || err != nil {
+				continue
+			}
+			if firstYear == 0 || year < firstYear {
+				firstYear = year
+			}
+			if year > lastYear {
+				lastYear = year
+			}
+		}
+	}
+	if firstYear == 0 {
+		return 0, 0, false, nil
+	}
+
+	precision := list[0].Precision
+	start := timestampOf(time.Date(firstYear, 1, 1, 0, 0, 0, 0, time.Local), precision)
+	end := timestampOf(time.Date(lastYear+1, 1, 1, 0, 0, 0, 0, time.Local), precision) - 1
+	return seriesBounds(list, start, end)
+}
+
+// dropCachedCollection forgets the in-memory segments of a collection directory
+func dropCachedCollection(collectionDir string) {
+	dropSeriesIndex(collectionDir)
+
+	prefix := filepath.Clean(collectionDir) + string(filepath.Separator)
+
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+	for filePath := range inMemoryData {
+		if strings.HasPrefix(filepath.Clean(filePath), prefix) {
+			delete(inMemoryData, filePath)
+			delete(lastAccessTimestamps, filePath)
+		}
+	}
+}
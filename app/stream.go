@@ -0,0 +1,149 @@
+package app
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	streamChunkSize = 5000             // Lines ingested together
+	streamMaxLine   = 16 * 1024 * 1024 // Longest accepted line in bytes
+	streamMaxErrors = 100              // Rejected lines listed in the summary
+)
+
+// lineErrors lists why a line of a stream was rejected
+type lineErrors struct {
+	Line   int      `json:"line"`
+	Errors []string `json:"errors"`
+}
+
+// streamProgress is reported after every chunk and, with Done set, at the end of a stream
+type streamProgress struct {
+	Done     bool         `json:"done"`
+	Lines    int          `json:"lines"`
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Errors   []lineErrors `json:"errors,omitempty"` // The first rejected lines, in the summary only
+	Error    string       `json:"error,omitempty"`  // Why the stream stopped early
+}
+
+// stream_data ingests an NDJSON body, optionally gzip-compressed, one point per line. Lines
+// are written in chunks as they arrive, so memory stays bounded whatever the upload size.
+// Each line is accepted or rejected on its own, and progress is streamed back as NDJSON.
+func stream_data(c *gin.Context) {
+	dataPath := "./data" // Base directory for data
+	collectionName := c.Param("collection_name")
+
+	collectionDir := fmt.Sprintf("%s/%s", dataPath, collectionName)
+	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Collection '%s' does not exist", collectionName)})
+		return
+	}
+
+	var body io.Reader = c.Request.Body
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid gzip body: %v", err)})
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+
+	// A backfill can take longer than the server timeouts allow, and progress is written
+	// while the body is still being read
+	controller := http.NewResponseController(c.Writer)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	controller.EnableFullDuplex()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(200)
+
+	encoder := json.NewEncoder(c.Writer)
+	progress := streamProgress{Errors: []lineErrors{}}
+
+	// Chunk reports only carry the counts
+	report := func(summary bool) {
+		if summary {
+			encoder.Encode(progress)
+		} else {
+			encoder.Encode(streamProgress{Lines: progress.Lines, Accepted: progress.Accepted, Rejected: progress.Rejected})
+		}
+		c.Writer.Flush()
+	}
+	reject := func(line int, errors []string) {
+		progress.Rejected++
+		if len(progress.Errors) < streamMaxErrors {
+			progress.Errors = append(progress.Errors, lineErrors{Line: line, Errors: errors})
+		}
+	}
+
+	items := []ingestItem{}
+	lines := []int{} // Line number of each item
+
+	flush := func() error {
+		if len(items) == 0 {
+			return nil
+		}
+		result, err := ingest(collectionName, items, true)
+		if err != nil {
+			return err
+		}
+		progress.Accepted += len(result.Accepted)
+		for _, failure := range result.Failures {
+			reject(lines[failure.Index], failure.Errors)
+		}
+		items, lines = items[:0], lines[:0]
+
+		report(false)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), streamMaxLine)
+
+	for scanner.Scan() {
+		progress.Lines++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var item ingestItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			reject(progress.Lines, []string{fmt.Sprintf("invalid JSON: %v", err)})
+			continue
+		}
+		items = append(items, item)
+		lines = append(lines, progress.Lines)
+
+		if len(items) == streamChunkSize {
+			if err := flush(); err != nil {
+				progress.Error = err.Error()
+				report(true)
+				return
+			}
+		}
+	}
+
+	// Lines read before a broken body are still written
+	readErr := scanner.Err()
+	if err := flush(); err != nil {
+		progress.Error = err.Error()
+	} else if readErr != nil {
+		progress.Error = fmt.Sprintf("Failed to read body after line %d: %v", progress.Lines, readErr)
+	} else {
+		progress.Done = true
+	}
+	report(true)
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// transformStep is one stage of a transform pipeline, applied to points in time order
+type transformStep struct {
+	Name  string
+	N     int     // Window size of moving_average
+	Alpha float64 // Smoothing factor of exponential_moving_average
+
+	hasPrevious   bool
+	previousTime  int64
+	previousValue float64
+	window        []float64
+	sum           float64
+	average       float64
+}
+
+// parseTransforms parses a comma-separated chain such as "non_negative_rate,moving_average(5)"
+func parseTransforms(param string) ([]*transformStep, error) {
+	if param == "" {
+		return nil, nil
+	}
+
+	steps := []*transformStep{}
+	for _, item := range strings.Split(param, ",") {
+		item = strings.TrimSpace(item)
+		name, arg := item, ""
+		if open := strings.Index(item, "("); open >= 0 {
+			if !strings.HasSuffix(item, ")") {
+				return nil, fmt.Errorf("invalid transform '%s'", item)
+			}
+			name, arg = item[:open], item[open+1:len(item)-1]
+		}
+
+		step := &transformStep{Name: name}
+		switch name {
+		case "derivative", "non_negative_rate", "difference", "cumulative_sum":
+			if arg != "" {
+				return nil, fmt.Errorf("transform '%s' takes no argument", name)
+			}
+		case "moving_average":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("moving_average needs a positive window size")
+			}
+			step.N = n
+		case "exponential_moving_average":
+			alpha, err := strconv.ParseFloat(arg, 64)
+			if err != nil || alpha <= 0 || alpha > 1 {
+				return nil, fmt.Errorf("exponential_moving_average needs an alpha between 0 and 1")
+			}
+			step.Alpha = alpha
+		default:
+			return nil, fmt.Errorf("unknown transform '%s'", name)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// apply feeds one value through the step; false means the step emits nothing for it yet.
+// Rates are expressed per unit milliseconds.
+func (s *transformStep) apply(ts int64, value float64, unit int64) (float64, bool) {
+	previousTime, previousValue, hasPrevious := s.previousTime, s.previousValue, s.hasPrevious
+	s.previousTime, s.previousValue, s.hasPrevious = ts, value, true
+
+	switch s.Name {
+	case "difference":
+		return value - previousValue, hasPrevious
+
+	case "derivative":
+		if !hasPrevious || ts == previousTime {
+			return 0, false
+		}
+		return (value - previousValue) / (float64(ts-previousTime) / float64(unit)), true
+
+	case "non_negative_rate":
+		if !hasPrevious || ts == previousTime {
+			return 0, false
+		}
+		increase := value - previousValue
+		if increase < 0 {
+			// The counter was reset, so everything it counted since happened in this interval
+			increase = value
+		}
+		return increase / (float64(ts-previousTime) / float64(unit)), true
+
+	case "cumulative_sum":
+		s.sum += value
+		return s.sum, true
+
+	case "moving_average":
+		s.window = append(s.window, value)
+		s.sum += value
+		if len(s.window) > s.N {
+			s.sum -= s.window[0]
+			s.window = s.window[1:]
+		}
+		return s.sum / float64(len(s.window)), len(s.window) == s.N
+
+	case "exponential_moving_average":
+		if hasPrevious {
+			value = s.Alpha*value + (1-s.Alpha)*s.average
+		}
+		s.average = value
+		return value, true
+	}
+	return value, true
+}
+
+// applyTransforms runs a value through every step of a pipeline
+func applyTransforms(steps []*transformStep, ts int64, value float64, unit int64) (float64, bool) {
+	for _, step := range steps {
+		var ok bool
+		if value, ok = step.apply(ts, value, unit); !ok {
+			return 0, false
+		}
+	}
+	return value, true
+}
+
+// cloneTransforms copies a pipeline without the state of the points it has seen
+func cloneTransforms(steps []*transformStep) []*transformStep {
+	clones := make([]*transformStep, len(steps))
+	for i, step := range steps {
+		clones[i] = &transformStep{Name: step.Name, N: step.N, Alpha: step.Alpha}
+	}
+	return clones
+}
+
+// seriesTransforms runs a separate copy of a pipeline for every series, so a rate is never
+// computed between the points of two series
+type seriesTransforms struct {
+	steps    []*transformStep
+	bySeries map[string][]*transformStep // Series directory -> pipeline
+}
+
+func newSeriesTransforms(steps []*transformStep) *seriesTransforms {
+	return &seriesTransforms{steps: steps, bySeries: map[string][]*transformStep{}}
+}
+
+func (t *seriesTransforms) apply(series seriesInfo, ts int64, value float64, unit int64) (float64, bool) {
+	steps, exists := t.bySeries[series.Dir]
+	if !exists {
+		steps = cloneTransforms(t.steps)
+		t.bySeries[series.Dir] = steps
+	}
+	return applyTransforms(steps, ts, value, unit)
+}
+
+// transformSeries applies a fresh copy of a pipeline to a series of numeric points,
+// dropping null values
+func transformSeries(series []map[string]interface{}, steps []*transformStep, unit int64) []map[string]interface{} {
+	steps = cloneTransforms(steps)
+	result := []map[string]interface{}{}
+	for _, point := range series {
+		value, ok := point["data"].(float64)
+		if !ok {
+			continue
+		}
+		ts := point["time"].(int64)
+		if value, ok = applyTransforms(steps, ts, value, unit); ok {
+			result = append(result, map[string]interface{}{"time": ts, "data": value})
+		}
+	}
+	return result
+}
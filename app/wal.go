@@ -0,0 +1,126 @@
+package app
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// walFile holds the batch being committed: the full content of every segment it changes,
+// followed by the blob files the batch stops referencing. Batches are committed under
+// dataMutex, so there is at most one record.
+const walFile = "./data/.wal"
+
+// writeWAL durably records segment images before they are applied. The record is written
+// to a temporary file and renamed, so after a crash it is either whole or absent.
+func writeWAL(images map[string]map[int64][]byte, released map[string][]string) error {
+	file, err := os.Create(walFile + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create write-ahead log: %w", err)
+	}
+
+	encoder := gob.NewEncoder(file)
+	if err := encoder.Encode(images); err == nil {
+		err = encoder.Encode(released)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to encode write-ahead log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	file.Close()
+
+	if err := os.Rename(walFile+".tmp", walFile); err != nil {
+		return fmt.Errorf("failed to commit write-ahead log: %w", err)
+	}
+	return syncPath(filepath.Dir(walFile))
+}
+
+// syncPath flushes a file or directory to disk
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyImagesLocked makes segment images visible and saves them, removing empty segments.
+// The blobs released from a segment are removed once it is saved. The segments being
+// replaced are never read, so a segment torn by a crash does not stop a replay.
+// The caller must hold the write lock on dataMutex.
+func applyImagesLocked(images map[string]map[int64][]byte, released map[string][]string, nowTime int64) error {
+	for filePath, image := range images {
+		if len(image) > 0 {
+			if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			inMemoryData[filePath] = image
+			lastAccessTimestamps[filePath] = nowTime
+		}
+
+		if err := writeSegmentLocked(filePath, image); err != nil {
+			return err
+		}
+		if len(image) > 0 {
+			if err := syncPath(filePath); err != nil {
+				return err
+			}
+		}
+		removeBlobs(filePath, released[filePath])
+	}
+	return nil
+}
+
+// replayWAL finishes a batch interrupted by a crash. It runs at startup, before requests
+// are served.
+func replayWAL() error {
+	// A record that was never renamed was never committed
+	os.Remove(walFile + ".tmp")
+
+	file, err := os.Open(walFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
+	var images map[string]map[int64][]byte
+	var released map[string][]string
+	decoder := gob.NewDecoder(file)
+	err = decoder.Decode(&images)
+	if err == nil {
+		// Records written before blobs existed end after the images
+		if err = decoder.Decode(&released); err == io.EOF {
+			err = nil
+		}
+	}
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode write-ahead log: %w", err)
+	}
+
+	dataMutex.Lock()
+	err = applyImagesLocked(images, released, 0)
+	dataMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(walFile); err != nil {
+		return fmt.Errorf("failed to clear write-ahead log: %w", err)
+	}
+	fmt.Printf("Replayed write-ahead log: %d segment(s)\n", len(images))
+	return nil
+}
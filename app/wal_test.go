@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// walRecord encodes a write-ahead log record; without released blobs it is written the
+// way records were before blobs existed
+func walRecord(t *testing.T, images map[string]map[int64][]byte, released map[string][]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	if err := encoder.Encode(images); err != nil {
+		t.Fatal(err)
+	}
+	if released != nil {
+		if err := encoder.Encode(released); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// segmentOnDisk decodes a segment file, or returns nil when it does not exist
+func segmentOnDisk(t *testing.T, filePath string) map[int64][]byte {
+	t.Helper()
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var fileData map[int64][]byte
+	if err := gob.NewDecoder(file).Decode(&fileData); err != nil {
+		t.Fatalf("failed to decode %s: %v", filePath, err)
+	}
+	return fileData
+}
+
+func TestReplayWAL(t *testing.T) {
+	const segment = "data/sensors/2023/318/1.san"
+	const blob = "data/sensors/2023/318/1700000000.blob"
+	image := map[int64][]byte{1700000000: []byte(`21.5`)}
+
+	tests := []struct {
+		name     string
+		existing []byte // Segment content before the replay, nil when absent
+		wal      []byte // Committed record, nil when absent
+		tmp      bool   // A record that was never renamed is left over
+		want     map[int64][]byte
+		blobGone bool
+		wantErr  bool
+	}{
+		{name: "no record", want: nil},
+		{name: "record", wal: walRecord(t, map[string]map[int64][]byte{segment: image}, map[string][]string{}), want: image},
+		{
+			name:     "record with released blobs",
+			wal:      walRecord(t, map[string]map[int64][]byte{segment: image}, map[string][]string{segment: {"1700000000.blob"}}),
+			want:     image,
+			blobGone: true,
+		},
+		{name: "record written before blobs existed", wal: walRecord(t, map[string]map[int64][]byte{segment: image}, nil), want: image},
+		{name: "torn segment is replaced", existing: []byte("torn"), wal: walRecord(t, map[string]map[int64][]byte{segment: image}, nil), want: image},
+		{name: "empty image removes the segment", existing: []byte("torn"), wal: walRecord(t, map[string]map[int64][]byte{segment: {}}, nil), want: nil},
+		{name: "uncommitted record is dropped", tmp: true, want: nil},
+		{name: "corrupt record", wal: []byte("not a record"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useDataDir(t)
+			if err := os.MkdirAll("data/sensors/2023/318", os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(blob, []byte("blob"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if len(test.existing) > 0 {
+				if err := os.WriteFile(segment, test.existing, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.wal != nil {
+				if err := os.WriteFile(walFile, test.wal, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.tmp {
+				if err := os.WriteFile(walFile+".tmp", walRecord(t, map[string]map[int64][]byte{segment: image}, nil), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := replayWAL()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				if _, err := os.Stat(walFile); err != nil {
+					t.Fatalf("the record was not kept for the next start: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := segmentOnDisk(t, segment); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got segment %v, want %v", got, test.want)
+			}
+			if _, err := os.Stat(blob); os.IsNotExist(err) != test.blobGone {
+				t.Fatalf("blob removed: %v, want %v", os.IsNotExist(err), test.blobGone)
+			}
+			for _, path := range []string{walFile, walFile + ".tmp"} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Fatalf("%s was not removed", path)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteWAL(t *testing.T) {
+	useDataDir(t)
+	images := map[string]map[int64][]byte{"data/sensors/2023/318/1.san": {1: []byte(`1`)}}
+	released := map[string][]string{"data/sensors/2023/318/1.san": {"1.blob"}}
+
+	if err := writeWAL(images, released); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(walFile + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("the temporary record was left behind")
+	}
+	content, err := os.ReadFile(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := walRecord(t, images, released); !bytes.Equal(content, want) {
+		t.Fatalf("got record % x, want % x", content, want)
+	}
+}